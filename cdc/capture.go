@@ -0,0 +1,359 @@
+package cdc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/krilor/skabelon/dbx"
+)
+
+// ErrUnexpectedMessage is returned for protocol messages that the replication connection does not expect.
+var ErrUnexpectedMessage = errors.New("unexpected message")
+
+const (
+	// statusInterval is how often the acknowledged position is reported to the server
+	statusInterval = 10 * time.Second
+
+	// retryInterval is the wait before reconnecting after an error
+	retryInterval = 5 * time.Second
+)
+
+// Config configures Capture.
+type Config struct {
+	// Publication is the name of the publication, which is created or changed to have the relations
+	Publication string
+
+	// Slot is the name of the replication slot, which is created if it does not exist
+	Slot string
+
+	// Relations are the relations to capture. Their hidden columns are left out of events.
+	Relations []dbx.Relation
+
+	// Schema is the schema of the positions table
+	Schema string
+
+	// Table is the name of the positions table, see db/api.sql
+	Table string
+
+	// Sink is where events are delivered
+	Sink Sink
+}
+
+// Capture streams changes from a replication slot to a sink.
+type Capture struct {
+	db          *pgxpool.Pool
+	conn        *pgconn.Config
+	slot        string
+	publication string
+	table       string
+	sink        Sink
+	omit        map[string]map[string]bool
+	stop        context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// New creates the publication and the replication slot, and captures changes until ctx is done or Close is called.
+// The replication connection uses the configuration of db, and the role needs the REPLICATION attribute.
+func New(ctx context.Context, db *pgxpool.Pool, cfg Config) (*Capture, error) {
+	conn := db.Config().ConnConfig.Config.Copy()
+	conn.RuntimeParams["replication"] = "database"
+
+	c := &Capture{ //nolint:exhaustruct
+		db:          db,
+		conn:        conn,
+		slot:        cfg.Slot,
+		publication: cfg.Publication,
+		table:       pgx.Identifier{cfg.Schema, cfg.Table}.Sanitize(),
+		sink:        cfg.Sink,
+		omit:        map[string]map[string]bool{},
+	}
+
+	tables := make([]string, len(cfg.Relations))
+
+	for i, rel := range cfg.Relations {
+		tables[i] = pgx.Identifier{rel.Schema, rel.Name}.Sanitize()
+
+		omit := map[string]bool{}
+		for _, col := range rel.Hidden {
+			omit[col] = true
+		}
+
+		c.omit[rel.Schema+"."+rel.Name] = omit
+	}
+
+	err := c.setup(ctx, tables)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, c.stop = context.WithCancel(ctx)
+
+	c.wg.Go(func() {
+		c.run(ctx)
+	})
+
+	return c, nil
+}
+
+// Close stops capturing and waits for the transaction being delivered.
+func (c *Capture) Close() {
+	c.stop()
+	c.wg.Wait()
+}
+
+// setup creates or changes the publication to have tables, and creates the slot if it does not exist.
+func (c *Capture) setup(ctx context.Context, tables []string) error {
+	var exists bool
+
+	err := c.db.QueryRow(ctx, `SELECT EXISTS (SELECT FROM pg_publication WHERE pubname = $1)`,
+		c.publication).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("could not look up publication: %w", err)
+	}
+
+	qry := "CREATE PUBLICATION %s FOR TABLE %s"
+	if exists {
+		qry = "ALTER PUBLICATION %s SET TABLE %s"
+	}
+
+	_, err = c.db.Exec(ctx, fmt.Sprintf(qry, pgx.Identifier{c.publication}.Sanitize(), strings.Join(tables, ", ")))
+	if err != nil {
+		return fmt.Errorf("could not create publication: %w", err)
+	}
+
+	_, err = c.db.Exec(ctx, `SELECT pg_create_logical_replication_slot($1, 'pgoutput')
+		WHERE NOT EXISTS (SELECT FROM pg_replication_slots WHERE slot_name = $1)`, c.slot)
+	if err != nil {
+		return fmt.Errorf("could not create replication slot: %w", err)
+	}
+
+	return nil
+}
+
+// run streams until ctx is done, reconnecting after errors.
+// Streaming restarts from the saved position, so events that were not acknowledged are delivered again.
+func (c *Capture) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := c.stream(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "change data capture stopped", "slot", c.slot, "error", err)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(retryInterval):
+			}
+		}
+	}
+}
+
+// position returns the position of the last delivered transaction, or 0 if none has been delivered.
+func (c *Capture) position(ctx context.Context) (LSN, error) {
+	var lsn string
+
+	err := c.db.QueryRow(ctx, fmt.Sprintf(`SELECT lsn::text FROM %s WHERE slot = $1`, c.table), c.slot).Scan(&lsn)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("could not read position: %w", err)
+	}
+
+	return ParseLSN(lsn)
+}
+
+// save saves the position of the last delivered transaction.
+func (c *Capture) save(ctx context.Context, lsn LSN) error {
+	_, err := c.db.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (slot, lsn) VALUES ($1, $2::pg_lsn)
+		ON CONFLICT (slot) DO UPDATE SET lsn = excluded.lsn, updated_at = now()`, c.table), c.slot, lsn.String())
+	if err != nil {
+		return fmt.Errorf("could not save position: %w", err)
+	}
+
+	return nil
+}
+
+// stream streams changes on a replication connection until an error or ctx is done.
+func (c *Capture) stream(ctx context.Context) error {
+	acked, err := c.position(ctx)
+	if err != nil {
+		return err
+	}
+
+	conn, err := pgconn.ConnectConfig(ctx, c.conn)
+	if err != nil {
+		return fmt.Errorf("could not connect for replication: %w", err)
+	}
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	err = c.start(ctx, conn, acked)
+	if err != nil {
+		return err
+	}
+
+	dec := newDecoder(c.omit)
+	next := time.Now().Add(statusInterval)
+
+	for {
+		if !time.Now().Before(next) {
+			err = sendStatus(conn, acked)
+			if err != nil {
+				return err
+			}
+
+			next = time.Now().Add(statusInterval)
+		}
+
+		receiveCtx, cancel := context.WithDeadline(ctx, next)
+		msg, err := conn.ReceiveMessage(receiveCtx)
+
+		cancel()
+
+		if err != nil {
+			if ctx.Err() == nil && pgconn.Timeout(err) {
+				continue
+			}
+
+			return fmt.Errorf("could not receive replication message: %w", err)
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyData:
+			acked, err = c.handle(ctx, conn, dec, msg.Data, acked)
+			if err != nil {
+				return err
+			}
+		case *pgproto3.ErrorResponse:
+			return fmt.Errorf("replication failed: %w", pgconn.ErrorResponseToPgError(msg))
+		default:
+			return fmt.Errorf("%w: %T", ErrUnexpectedMessage, msg)
+		}
+	}
+}
+
+// start starts replication from the slot after position from.
+func (c *Capture) start(ctx context.Context, conn *pgconn.PgConn, from LSN) error {
+	// publication_names is a list of identifiers in a string literal
+	qry := fmt.Sprintf("START_REPLICATION SLOT %s LOGICAL %s (proto_version '1', publication_names '%s')",
+		pgx.Identifier{c.slot}.Sanitize(),
+		from,
+		strings.ReplaceAll(pgx.Identifier{c.publication}.Sanitize(), "'", "''"),
+	)
+
+	slog.InfoContext(ctx, "starting replication", "query", qry)
+
+	conn.Frontend().Send(&pgproto3.Query{String: qry})
+
+	err := conn.Frontend().Flush()
+	if err != nil {
+		return fmt.Errorf("could not start replication: %w", err)
+	}
+
+	msg, err := conn.ReceiveMessage(ctx)
+	if err != nil {
+		return fmt.Errorf("could not start replication: %w", err)
+	}
+
+	switch msg := msg.(type) {
+	case *pgproto3.CopyBothResponse:
+		return nil
+	case *pgproto3.ErrorResponse:
+		return fmt.Errorf("could not start replication: %w", pgconn.ErrorResponseToPgError(msg))
+	default:
+		return fmt.Errorf("%w: %T", ErrUnexpectedMessage, msg)
+	}
+}
+
+// handle handles a message of the replication stream, and returns the new acknowledged position.
+// Transactions are delivered to the sink when they commit, and their end is saved before it is acknowledged.
+func (c *Capture) handle(ctx context.Context, conn *pgconn.PgConn, dec *decoder, data []byte, acked LSN) (LSN, error) {
+	r := &reader{b: data} //nolint:exhaustruct
+
+	switch kind := r.byte(); kind {
+	case 'k':
+		end := LSN(r.uint64())
+		r.uint64() // server time
+		reply := r.byte() == 1
+
+		if r.err != nil {
+			return acked, r.err
+		}
+
+		// with no transaction in progress, everything up to the end of the log has been delivered
+		if dec.tx == nil && end > acked {
+			acked = end
+		}
+
+		if reply {
+			return acked, sendStatus(conn, acked)
+		}
+
+		return acked, nil
+	case 'w':
+		start := LSN(r.uint64())
+		r.uint64() // end of the log
+		r.uint64() // server time
+
+		if r.err != nil {
+			return acked, r.err
+		}
+
+		tx, err := dec.decode(start, data[r.i:])
+		if err != nil || tx == nil {
+			return acked, err
+		}
+
+		// the slot can send transactions again that were delivered before its position was reported
+		if tx.end <= acked {
+			return acked, nil
+		}
+
+		if len(tx.events) > 0 {
+			err = c.sink.Write(ctx, tx.events)
+			if err != nil {
+				return acked, err
+			}
+
+			err = c.save(context.WithoutCancel(ctx), tx.end)
+			if err != nil {
+				return acked, err
+			}
+		}
+
+		return tx.end, nil
+	default:
+		return acked, fmt.Errorf("%w: replication message %q", ErrUnexpectedMessage, kind)
+	}
+}
+
+// sendStatus reports that everything up to acked has been delivered.
+func sendStatus(conn *pgconn.PgConn, acked LSN) error {
+	now := uint64(time.Since(postgresEpoch).Microseconds()) //nolint:gosec
+
+	b := make([]byte, 0, 34) //nolint:mnd
+	b = append(b, 'r')
+	b = binary.BigEndian.AppendUint64(b, uint64(acked)) // written
+	b = binary.BigEndian.AppendUint64(b, uint64(acked)) // flushed
+	b = binary.BigEndian.AppendUint64(b, uint64(acked)) // applied
+	b = binary.BigEndian.AppendUint64(b, now)
+	b = append(b, 0) // no reply requested
+
+	conn.Frontend().Send(&pgproto3.CopyData{Data: b})
+
+	err := conn.Frontend().Flush()
+	if err != nil {
+		return fmt.Errorf("could not send status: %w", err)
+	}
+
+	return nil
+}
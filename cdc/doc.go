@@ -0,0 +1,5 @@
+// Package cdc captures changes to relations through logical replication, and delivers them to sinks.
+//
+// Changes are decoded from the pgoutput plugin into events, and delivered one transaction at a time.
+// The position of the last delivered transaction is kept in a table, so that a restart continues where it stopped.
+package cdc
@@ -0,0 +1,56 @@
+package cdc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidLSN is returned for log sequence numbers that cannot be parsed.
+var ErrInvalidLSN = errors.New("invalid lsn")
+
+// LSN is a log sequence number, a position in the write-ahead log.
+type LSN uint64
+
+// ParseLSN parses the textual form of an LSN, such as 16/B374D848.
+func ParseLSN(s string) (LSN, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidLSN, s)
+	}
+
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidLSN, s)
+	}
+
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidLSN, s)
+	}
+
+	return LSN(h<<32 | l), nil
+}
+
+// String returns the textual form of the LSN.
+func (l LSN) String() string {
+	return fmt.Sprintf("%X/%X", uint64(l)>>32, uint32(l)) //nolint:gosec
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (l LSN) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (l *LSN) UnmarshalText(text []byte) error {
+	lsn, err := ParseLSN(string(text))
+	if err != nil {
+		return err
+	}
+
+	*l = lsn
+
+	return nil
+}
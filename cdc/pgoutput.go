@@ -0,0 +1,412 @@
+package cdc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Decoding of the pgoutput plugin, protocol version 1.
+// See https://www.postgresql.org/docs/current/protocol-logicalrep-message-formats.html
+
+// ErrInvalidMessage is returned for replication messages that cannot be decoded.
+var ErrInvalidMessage = errors.New("invalid replication message")
+
+// Op is the operation of a change.
+type Op string
+
+// Operations of changes.
+const (
+	OpInsert   Op = "insert"
+	OpUpdate   Op = "update"
+	OpDelete   Op = "delete"
+	OpTruncate Op = "truncate"
+)
+
+// Event is a change to a row of a relation.
+type Event struct {
+	// Relation is the qualified name of the relation, such as skabelon.resource
+	Relation string `json:"relation"`
+
+	// Op is the operation
+	Op Op `json:"op"`
+
+	// Old is the row before an update or delete.
+	// Only the replica identity columns are known, unless the replica identity is full.
+	Old map[string]any `json:"old,omitempty"`
+
+	// New is the row after an insert or update.
+	// Unchanged TOASTed values are not sent by the server, and are left out.
+	New map[string]any `json:"new,omitempty"`
+
+	// LSN is the position of the change
+	LSN LSN `json:"lsn"`
+
+	// Commit is the end of the transaction, which is the position acknowledged once the transaction is delivered.
+	// Receivers can drop transactions with a commit they have already seen.
+	Commit LSN `json:"commit"`
+
+	// XID is the id of the transaction
+	XID uint32 `json:"xid"`
+
+	// CommitTime is when the transaction committed
+	CommitTime time.Time `json:"commit_time"`
+}
+
+// transaction is a decoded transaction.
+type transaction struct {
+	events []Event
+	end    LSN
+}
+
+// relation is a relation as described by the server.
+type relation struct {
+	name    string
+	columns []column
+}
+
+// column is a column of a relation.
+type column struct {
+	name string
+	oid  uint32
+}
+
+// decoder decodes pgoutput messages into transactions.
+// Relations are described by the server before their first change in each session.
+type decoder struct {
+	types     *pgtype.Map
+	relations map[uint32]relation
+
+	// omit has the columns left out of events, by relation
+	omit map[string]map[string]bool
+
+	// tx is the transaction in progress, if any
+	tx *transaction
+	// xid and commitTime are those of tx
+	xid        uint32
+	commitTime time.Time
+}
+
+// newDecoder returns a decoder that leaves the omit columns out of events.
+func newDecoder(omit map[string]map[string]bool) *decoder {
+	return &decoder{ //nolint:exhaustruct
+		types:     pgtype.NewMap(),
+		relations: map[uint32]relation{},
+		omit:      omit,
+	}
+}
+
+// decode decodes the pgoutput message in data, at position lsn.
+// Returns the transaction when data is its commit, and nil otherwise.
+func (d *decoder) decode(lsn LSN, data []byte) (*transaction, error) {
+	r := &reader{b: data} //nolint:exhaustruct
+
+	switch r.byte() {
+	case 'B':
+		r.uint64() // final lsn
+		commitTime := r.time()
+		xid := r.uint32()
+
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		d.tx = &transaction{} //nolint:exhaustruct
+		d.xid = xid
+		d.commitTime = commitTime
+
+		return nil, nil
+	case 'C':
+		r.byte()   // flags
+		r.uint64() // commit lsn
+		end := LSN(r.uint64())
+
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		if d.tx == nil {
+			return nil, fmt.Errorf("%w: commit without begin", ErrInvalidMessage)
+		}
+
+		tx := d.tx
+		tx.end = end
+		d.tx = nil
+
+		for i := range tx.events {
+			tx.events[i].Commit = end
+		}
+
+		return tx, nil
+	case 'R':
+		return nil, d.relation(r)
+	case 'I', 'U', 'D':
+		r.i--
+
+		return nil, d.change(lsn, r)
+	case 'T':
+		return nil, d.truncate(lsn, r)
+	default:
+		// types, origins and logical decoding messages are not needed
+		return nil, nil
+	}
+}
+
+// relation decodes a relation message.
+func (d *decoder) relation(r *reader) error {
+	id := r.uint32()
+	schema := r.string()
+	name := r.string()
+	r.byte() // replica identity
+
+	rel := relation{name: schema + "." + name, columns: make([]column, r.uint16())}
+
+	for i := range rel.columns {
+		r.byte() // flags
+		rel.columns[i] = column{name: r.string(), oid: r.uint32()}
+		r.uint32() // type modifier
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+
+	d.relations[id] = rel
+
+	return nil
+}
+
+// change decodes an insert, update or delete message.
+func (d *decoder) change(lsn LSN, r *reader) error {
+	kind := r.byte()
+	id := r.uint32()
+
+	rel, ok := d.relations[id]
+	if !ok && r.err == nil {
+		return fmt.Errorf("%w: unknown relation %d", ErrInvalidMessage, id)
+	}
+
+	ev := d.event(rel.name, lsn)
+
+	switch kind {
+	case 'I':
+		ev.Op = OpInsert
+	case 'U':
+		ev.Op = OpUpdate
+	case 'D':
+		ev.Op = OpDelete
+	}
+
+	for r.err == nil && r.i < len(r.b) {
+		switch tuple := r.byte(); tuple {
+		case 'K', 'O':
+			ev.Old = d.tuple(rel, r)
+		case 'N':
+			ev.New = d.tuple(rel, r)
+		default:
+			return fmt.Errorf("%w: unknown tuple type %q", ErrInvalidMessage, tuple)
+		}
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+
+	return d.add(ev)
+}
+
+// truncate decodes a truncate message, which gives an event for each relation.
+func (d *decoder) truncate(lsn LSN, r *reader) error {
+	n := r.uint32()
+	r.byte() // options
+
+	for range n {
+		id := r.uint32()
+		if r.err != nil {
+			return r.err
+		}
+
+		rel, ok := d.relations[id]
+		if !ok {
+			return fmt.Errorf("%w: unknown relation %d", ErrInvalidMessage, id)
+		}
+
+		ev := d.event(rel.name, lsn)
+		ev.Op = OpTruncate
+
+		err := d.add(ev)
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.err
+}
+
+// event returns an event of the transaction in progress.
+func (d *decoder) event(name string, lsn LSN) Event {
+	return Event{ //nolint:exhaustruct
+		Relation:   name,
+		LSN:        lsn,
+		XID:        d.xid,
+		CommitTime: d.commitTime,
+	}
+}
+
+// add adds ev to the transaction in progress.
+func (d *decoder) add(ev Event) error {
+	if d.tx == nil {
+		return fmt.Errorf("%w: change outside a transaction", ErrInvalidMessage)
+	}
+
+	d.tx.events = append(d.tx.events, ev)
+
+	return nil
+}
+
+// tuple decodes the tuple data of a row of rel.
+// Values are sent as text, and are decoded by the type of their column.
+func (d *decoder) tuple(rel relation, r *reader) map[string]any {
+	n := int(r.uint16())
+	if r.err == nil && n != len(rel.columns) {
+		r.err = fmt.Errorf("%w: %d values for %d columns of %s", ErrInvalidMessage, n, len(rel.columns), rel.name)
+	}
+
+	row := map[string]any{}
+
+	for i := 0; i < n && r.err == nil; i++ {
+		col := rel.columns[i]
+
+		switch kind := r.byte(); kind {
+		case 'n':
+			row[col.name] = nil
+		case 'u':
+			// unchanged toasted value, which is not sent
+			continue
+		case 't':
+			row[col.name] = d.value(col.oid, r.bytes(int(r.uint32())))
+		default:
+			r.err = fmt.Errorf("%w: unknown value type %q", ErrInvalidMessage, kind)
+		}
+	}
+
+	for col := range d.omit[rel.name] {
+		delete(row, col)
+	}
+
+	return row
+}
+
+// value decodes the text value of a column of type oid.
+// Values of unknown types are kept as text.
+func (d *decoder) value(oid uint32, data []byte) any {
+	typ, ok := d.types.TypeForOID(oid)
+	if !ok {
+		return string(data)
+	}
+
+	v, err := typ.Codec.DecodeValue(d.types, oid, pgtype.TextFormatCode, data)
+	if err != nil {
+		return string(data)
+	}
+
+	return v
+}
+
+// postgresEpoch is the epoch of timestamps in the replication protocol.
+var postgresEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// reader reads the fields of a message.
+// The first error is kept, and later reads return zero values.
+type reader struct {
+	b   []byte
+	i   int
+	err error
+}
+
+// next returns the next n bytes.
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if n < 0 || r.i+n > len(r.b) {
+		r.err = fmt.Errorf("%w: message too short", ErrInvalidMessage)
+
+		return nil
+	}
+
+	b := r.b[r.i : r.i+n]
+	r.i += n
+
+	return b
+}
+
+func (r *reader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.next(2) //nolint:mnd
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.next(4) //nolint:mnd
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *reader) uint64() uint64 {
+	b := r.next(8) //nolint:mnd
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
+
+// time reads a timestamp in microseconds since postgresEpoch.
+func (r *reader) time() time.Time {
+	return postgresEpoch.Add(time.Duration(r.uint64()) * time.Microsecond) //nolint:gosec
+}
+
+// bytes reads n bytes.
+func (r *reader) bytes(n int) []byte {
+	return r.next(n)
+}
+
+// string reads a null-terminated string.
+func (r *reader) string() string {
+	if r.err != nil {
+		return ""
+	}
+
+	for j := r.i; j < len(r.b); j++ {
+		if r.b[j] == 0 {
+			s := string(r.b[r.i:j])
+			r.i = j + 1
+
+			return s
+		}
+	}
+
+	r.err = fmt.Errorf("%w: unterminated string", ErrInvalidMessage)
+
+	return ""
+}
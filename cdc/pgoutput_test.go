@@ -0,0 +1,164 @@
+package cdc
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// message builds a pgoutput message.
+type message []byte
+
+func (m message) byte(b byte) message      { return append(m, b) }
+func (m message) uint16(v uint16) message  { return binary.BigEndian.AppendUint16(m, v) }
+func (m message) uint32(v uint32) message  { return binary.BigEndian.AppendUint32(m, v) }
+func (m message) uint64(v uint64) message  { return binary.BigEndian.AppendUint64(m, v) }
+func (m message) string(s string) message  { return append(append(m, s...), 0) }
+func (m message) text(s string) message    { return m.byte('t').uint32(uint32(len(s))).bytes(s) }
+func (m message) bytes(s string) message   { return append(m, s...) }
+func (m message) begin(xid uint32) message { return m.byte('B').uint64(0).uint64(0).uint32(xid) }
+func (m message) commit(end uint64) message {
+	return m.byte('C').byte(0).uint64(0).uint64(end).uint64(0)
+}
+
+// relationMessage describes skabelon.resource with the columns id (int8), name (text) and secret (text).
+func relationMessage() message {
+	return message{}.byte('R').uint32(1).string("skabelon").string("resource").byte('d').uint16(3).
+		byte(1).string("id").uint32(20).uint32(0).
+		byte(0).string("name").uint32(25).uint32(0).
+		byte(0).string("secret").uint32(25).uint32(0)
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		changes []message
+		want    []Event
+		wantErr error
+	}{
+		{
+			name: "insert",
+			changes: []message{
+				message{}.byte('I').uint32(1).byte('N').uint16(3).text("7").text("a").text("s"),
+			},
+			want: []Event{{
+				Relation: "skabelon.resource", Op: OpInsert, New: map[string]any{"id": int64(7), "name": "a"},
+				LSN: 10, Commit: 99, XID: 5,
+			}},
+		},
+		{
+			name: "update with old key, null and unchanged toast",
+			changes: []message{
+				message{}.byte('U').uint32(1).
+					byte('K').uint16(3).text("7").byte('n').byte('n').
+					byte('N').uint16(3).text("8").byte('n').byte('u'),
+			},
+			want: []Event{{
+				Relation: "skabelon.resource", Op: OpUpdate,
+				Old: map[string]any{"id": int64(7), "name": nil}, New: map[string]any{"id": int64(8), "name": nil},
+				LSN: 10, Commit: 99, XID: 5,
+			}},
+		},
+		{
+			name: "delete and truncate",
+			changes: []message{
+				message{}.byte('D').uint32(1).byte('K').uint16(3).text("7").byte('n').byte('n'),
+				message{}.byte('T').uint32(1).byte(0).uint32(1),
+			},
+			want: []Event{
+				{
+					Relation: "skabelon.resource", Op: OpDelete, Old: map[string]any{"id": int64(7), "name": nil},
+					LSN: 10, Commit: 99, XID: 5,
+				},
+				{Relation: "skabelon.resource", Op: OpTruncate, LSN: 10, Commit: 99, XID: 5},
+			},
+		},
+		{
+			name:    "unknown relation",
+			changes: []message{message{}.byte('I').uint32(2).byte('N').uint16(0)},
+			wantErr: ErrInvalidMessage,
+		},
+		{
+			name:    "short message",
+			changes: []message{message{}.byte('I').uint32(1).byte('N').uint16(3).text("7")},
+			wantErr: ErrInvalidMessage,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			d := newDecoder(map[string]map[string]bool{"skabelon.resource": {"secret": true}})
+
+			for _, msg := range []message{relationMessage(), message{}.begin(5)} {
+				_, err := d.decode(1, msg)
+				if err != nil {
+					t.Fatalf("could not decode: %v", err)
+				}
+			}
+
+			for _, msg := range tt.changes {
+				_, err := d.decode(10, msg)
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+
+				if err != nil {
+					return
+				}
+			}
+
+			tx, err := d.decode(20, message{}.commit(99))
+			if err != nil {
+				t.Fatalf("could not decode commit: %v", err)
+			}
+
+			for i := range tx.events {
+				tx.events[i].CommitTime = tx.events[i].CommitTime.UTC()
+				tt.want[i].CommitTime = postgresEpoch
+			}
+
+			if tx.end != 99 || !reflect.DeepEqual(tx.events, tt.want) {
+				t.Errorf("got %+v at %s, want %+v", tx.events, tx.end, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLSN(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in      string
+		want    LSN
+		wantErr error
+	}{
+		{in: "0/0", want: 0, wantErr: nil},
+		{in: "16/B374D848", want: 0x16B374D848, wantErr: nil},
+		{in: "16B374D848", want: 0, wantErr: ErrInvalidLSN},
+		{in: "1/G", want: 0, wantErr: ErrInvalidLSN},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ParseLSN(tt.in)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+
+			if err == nil && got.String() != tt.in {
+				t.Errorf("got %s, want %s", got, tt.in)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package cdc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// ErrDelivery is returned when a sink could not deliver events.
+var ErrDelivery = errors.New("could not deliver events")
+
+// Sink delivers the events of transactions.
+//
+// A transaction is acknowledged when Write returns nil. Otherwise, it is delivered again, along with the ones after it.
+// Since the position is saved after Write returns, a crash in between delivers the last transaction twice,
+// so sinks that must not see duplicates should drop transactions with a commit they have already seen.
+type Sink interface {
+	Write(ctx context.Context, events []Event) error
+}
+
+// ndjson returns events as NDJSON, with one event per line.
+func ndjson(events []Event) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+
+	for _, ev := range events {
+		err := enc.Encode(ev)
+		if err != nil {
+			return nil, fmt.Errorf("could not marshal event: %w", err)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// WriterSink writes events as NDJSON to a writer, such as os.Stdout.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink returns a sink writing to w.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w} //nolint:exhaustruct
+}
+
+// Write implements Sink.
+func (s *WriterSink) Write(_ context.Context, events []Event) error {
+	b, err := ndjson(events)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.w.Write(b)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDelivery, err)
+	}
+
+	return nil
+}
+
+// FileSink appends events as NDJSON to a file, and syncs it before acknowledging.
+// Transactions that are already in the file are skipped, so the file never has duplicates.
+type FileSink struct {
+	mu   sync.Mutex
+	f    *os.File
+	last LSN
+}
+
+// NewFileSink opens or creates the file at path.
+// A partial line left by a crash is removed, and the commit of the last event is read, so that it is not written twice.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600) //nolint:mnd
+	if err != nil {
+		return nil, fmt.Errorf("could not open cdc file: %w", err)
+	}
+
+	b, err := io.ReadAll(f)
+	if err != nil {
+		f.Close() //nolint:errcheck,gosec
+
+		return nil, fmt.Errorf("could not read cdc file: %w", err)
+	}
+
+	// everything up to the last newline is complete
+	end := bytes.LastIndexByte(b, '\n') + 1
+
+	err = f.Truncate(int64(end))
+	if err == nil {
+		_, err = f.Seek(int64(end), io.SeekStart)
+	}
+
+	if err != nil {
+		f.Close() //nolint:errcheck,gosec
+
+		return nil, fmt.Errorf("could not truncate cdc file: %w", err)
+	}
+
+	sink := &FileSink{f: f} //nolint:exhaustruct
+
+	if end > 0 {
+		start := bytes.LastIndexByte(b[:end-1], '\n') + 1
+
+		var ev Event
+
+		err = json.Unmarshal(b[start:end], &ev)
+		if err != nil {
+			f.Close() //nolint:errcheck,gosec
+
+			return nil, fmt.Errorf("could not read last event of cdc file: %w", err)
+		}
+
+		sink.last = ev.Commit
+	}
+
+	return sink, nil
+}
+
+// Write implements Sink.
+func (s *FileSink) Write(_ context.Context, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	commit := events[0].Commit
+	if commit <= s.last {
+		return nil
+	}
+
+	b, err := ndjson(events)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.f.Write(b)
+	if err == nil {
+		err = s.f.Sync()
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDelivery, err)
+	}
+
+	s.last = commit
+
+	return nil
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	err := s.f.Close()
+	if err != nil {
+		return fmt.Errorf("could not close cdc file: %w", err)
+	}
+
+	return nil
+}
+
+// WebhookSink posts the events of each transaction as NDJSON to a URL.
+// Any status but 2xx is a failed delivery.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookSink returns a sink posting to url with client.
+func NewWebhookSink(url string, client *http.Client) *WebhookSink {
+	return &WebhookSink{url: url, client: client}
+}
+
+// Write implements Sink.
+func (s *WebhookSink) Write(ctx context.Context, events []Event) error {
+	b, err := ndjson(events)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("could not create webhook request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDelivery, err)
+	}
+	defer res.Body.Close()
+
+	io.Copy(io.Discard, res.Body) //nolint:errcheck,gosec
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%w: webhook responded %s", ErrDelivery, res.Status)
+	}
+
+	return nil
+}
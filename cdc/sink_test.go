@@ -0,0 +1,111 @@
+package cdc
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "cdc.ndjson")
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatalf("could not open sink: %v", err)
+	}
+
+	for _, commit := range []LSN{10, 20} {
+		err = sink.Write(t.Context(), []Event{{Relation: "s.r", Op: OpInsert, Commit: commit}}) //nolint:exhaustruct
+		if err != nil {
+			t.Fatalf("could not write: %v", err)
+		}
+	}
+
+	sink.Close() //nolint:errcheck,gosec
+
+	// a crash in the middle of a line
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	f.WriteString(`{"relation":"s.r"`) //nolint:errcheck,gosec
+	f.Close()                          //nolint:errcheck,gosec
+
+	sink, err = NewFileSink(path)
+	if err != nil {
+		t.Fatalf("could not reopen sink: %v", err)
+	}
+	defer sink.Close()
+
+	for _, commit := range []LSN{20, 30} {
+		err = sink.Write(t.Context(), []Event{{Relation: "s.r", Op: OpInsert, Commit: commit}}) //nolint:exhaustruct
+		if err != nil {
+			t.Fatalf("could not write: %v", err)
+		}
+	}
+
+	b, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+
+	want := []string{`"commit":"0/A"`, `"commit":"0/14"`, `"commit":"0/1E"`}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(want), b)
+	}
+
+	for i, line := range lines {
+		if !strings.Contains(line, want[i]) {
+			t.Errorf("line %d is %s, want %s", i, line, want[i])
+		}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "accepted", status: http.StatusNoContent, wantErr: false},
+		{name: "failed", status: http.StatusBadGateway, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var lines int
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Content-Type") != "application/x-ndjson" {
+					t.Errorf("got Content-Type %q", r.Header.Get("Content-Type"))
+				}
+
+				for s := bufio.NewScanner(r.Body); s.Scan(); {
+					lines++
+				}
+
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			sink := NewWebhookSink(server.URL, server.Client())
+
+			err := sink.Write(t.Context(), []Event{
+				{Relation: "s.r", Op: OpInsert}, //nolint:exhaustruct
+				{Relation: "s.r", Op: OpDelete}, //nolint:exhaustruct
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %t", err, tt.wantErr)
+			}
+
+			if lines != 2 {
+				t.Errorf("got %d lines, want 2", lines)
+			}
+		})
+	}
+}
@@ -2,6 +2,30 @@
 
 CREATE SCHEMA IF NOT EXISTS skabelon AUTHORIZATION skabelon;
 
+-- bump_version is a trigger function for the version ETag strategy.
+-- Use it as a BEFORE UPDATE trigger on tables with an integer "version" column.
+CREATE OR REPLACE FUNCTION skabelon.bump_version()
+RETURNS TRIGGER
+LANGUAGE plpgsql
+AS $$
+BEGIN
+    NEW.version := OLD.version + 1;
+    RETURN NEW;
+END;
+$$;
+
+-- set_updated_at is a trigger function that keeps an "updated_at" column current.
+-- Use it as a BEFORE UPDATE trigger.
+CREATE OR REPLACE FUNCTION skabelon.set_updated_at()
+RETURNS TRIGGER
+LANGUAGE plpgsql
+AS $$
+BEGIN
+    NEW.updated_at := now();
+    RETURN NEW;
+END;
+$$;
+
 CREATE TABLE IF NOT EXISTS skabelon.resource (
     id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
     rkey TEXT NOT NULL UNIQUE,
@@ -19,6 +43,143 @@ CREATE TABLE IF NOT EXISTS skabelon.resource (
     ) STORED -- VIRTUAL but sqlfluff complains ... :P
 );
 
+ALTER TABLE skabelon.resource
+ADD COLUMN IF NOT EXISTS created_by TEXT NULL;
+
+ALTER TABLE skabelon.resource
+ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+ALTER TABLE skabelon.resource
+ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ NULL;
+
+-- resource_deleted_at finds soft-deleted rows for retention.
+CREATE INDEX IF NOT EXISTS resource_deleted_at
+ON skabelon.resource (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE OR REPLACE TRIGGER set_updated_at BEFORE UPDATE ON skabelon.resource
+FOR EACH ROW EXECUTE FUNCTION skabelon.set_updated_at();
+
+-- dbx_operations records long-running operations, see dbx.Operations.
+CREATE TABLE IF NOT EXISTS skabelon.dbx_operations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    relation TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (
+        status IN ('pending', 'running', 'succeeded', 'failed', 'canceled')
+    ),
+    progress BIGINT NOT NULL DEFAULT 0,
+    result JSONB NULL,
+    result_type TEXT NULL,
+    error TEXT NULL,
+    created_by TEXT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ NULL
+);
+
+CREATE INDEX IF NOT EXISTS dbx_operations_unfinished
+ON skabelon.dbx_operations (status) WHERE status IN ('pending', 'running');
+
+-- cdc_positions records the position of the last delivered transaction of each replication slot, see cdc.Capture.
+CREATE TABLE IF NOT EXISTS skabelon.cdc_positions (
+    slot TEXT PRIMARY KEY,
+    lsn PG_LSN NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- dbx_webhooks are the webhooks that get outbox rows, see dbx.Outbox.
+-- relation is the schema qualified name of the relation, or NULL for every relation.
+CREATE TABLE IF NOT EXISTS skabelon.dbx_webhooks (
+    id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    url TEXT NOT NULL CHECK (url ~ '^https?://'),
+    secret TEXT NOT NULL CHECK (length(secret) >= 16),
+    relation TEXT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_by TEXT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- dbx_outbox has a row for each write and webhook, written in the same transaction as the write.
+CREATE TABLE IF NOT EXISTS skabelon.dbx_outbox (
+    id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    webhook_id BIGINT NOT NULL REFERENCES skabelon.dbx_webhooks (id) ON DELETE CASCADE,
+    relation TEXT NOT NULL,
+    op TEXT NOT NULL,
+    resource_id TEXT NOT NULL,
+    payload JSONB NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')),
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT NULL,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    delivered_at TIMESTAMPTZ NULL
+);
+
+CREATE INDEX IF NOT EXISTS dbx_outbox_pending
+ON skabelon.dbx_outbox (next_attempt_at) WHERE status = 'pending';
+
+-- dbx_audit records every write to audited relations, see dbx.Relation.AuditTable.
+CREATE TABLE IF NOT EXISTS skabelon.dbx_audit (
+    id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+    relation TEXT NOT NULL,
+    resource_id TEXT NOT NULL,
+    op TEXT NOT NULL CHECK (op IN ('insert', 'update', 'delete')),
+    actor TEXT NULL,
+    request_id TEXT NULL,
+    at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    old JSONB NULL,
+    new JSONB NULL,
+    diff JSONB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS dbx_audit_resource
+ON skabelon.dbx_audit (relation, resource_id, at DESC);
+
+-- actor_verified is false when the actor is only what the client claimed to be.
+ALTER TABLE skabelon.dbx_audit ADD COLUMN IF NOT EXISTS actor_verified BOOLEAN NOT NULL DEFAULT false;
+
+-- resource_stats counts the resources by my_int. It is a read-only view, keyed by bucket.
+CREATE OR REPLACE VIEW skabelon.resource_stats AS
+SELECT
+    my_int AS bucket,
+    count(*) AS resources
+FROM skabelon.resource
+WHERE deleted_at IS NULL AND my_int IS NOT NULL
+GROUP BY my_int;
+
+-- Functions in skabelon are served at /rpc/{name}, see dbx.RPCHandler.
+
+-- count_resources counts the resources that are not deleted, optionally only the fun ones.
+CREATE OR REPLACE FUNCTION skabelon.count_resources(fun BOOLEAN DEFAULT NULL)
+RETURNS BIGINT
+LANGUAGE sql
+STABLE
+AS $$
+    SELECT count(*) FROM skabelon.resource
+    WHERE deleted_at IS NULL AND (fun IS NULL OR is_fun = fun);
+$$;
+
+-- search_resources returns the resources that are not deleted, with term in the description.
+CREATE OR REPLACE FUNCTION skabelon.search_resources(term TEXT)
+RETURNS SETOF skabelon.resource
+LANGUAGE sql
+STABLE
+AS $$
+    SELECT * FROM skabelon.resource
+    WHERE deleted_at IS NULL AND description ILIKE '%' || term || '%';
+$$;
+
+-- make_fun makes a resource fun, and returns it.
+CREATE OR REPLACE FUNCTION skabelon.make_fun(resource_id BIGINT)
+RETURNS skabelon.resource
+LANGUAGE sql
+VOLATILE
+AS $$
+    UPDATE skabelon.resource SET is_fun = TRUE
+    WHERE id = resource_id AND deleted_at IS NULL
+    RETURNING *;
+$$;
+
 INSERT INTO skabelon.resource (rkey, description) VALUES
 ('RSK-1', 'High risk'),
 ('RSK-2', 'Medium risk'),
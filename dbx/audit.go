@@ -0,0 +1,211 @@
+package dbx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Audit log
+//
+// Relations with an audit table record every create, update and delete in it, in the same transaction as the write.
+// The history of a resource is served at GET /{id}/_history.
+
+// defaultHistoryLimit is the number of audit entries returned when no limit is given.
+const defaultHistoryLimit = 100
+
+// change is the old and new value of a column.
+type change struct {
+	Old json.RawMessage `json:"old"`
+	New json.RawMessage `json:"new"`
+}
+
+// auditRow returns the row with key as JSON, without hidden columns, or nil if it does not exist.
+// Returns nil without reading if the relation is not audited.
+// Before a write, the row is locked with lockRow, so that it is the row the write changes.
+func (s *CRUDHandler) auditRow(ctx context.Context, tx pgx.Tx, key keyValue) (json.RawMessage, error) {
+	if s.rel.AuditTable == "" {
+		return nil, nil
+	}
+
+	var (
+		row  json.RawMessage
+		args []any
+	)
+
+	err := tx.QueryRow(ctx, fmt.Sprintf(`SELECT %s FROM %s AS _dbx WHERE %s`,
+		s.rel.rowJSON("_dbx"), s.rel.identifier(), s.rel.keyWhere("_dbx", key, &args)), args...).Scan(&row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read audited row: %w", err)
+	}
+
+	return row, nil
+}
+
+// recordAudit records op on the resource with key in tx, with the row before and after the write.
+// Does nothing if the relation is not audited.
+func (s *CRUDHandler) recordAudit(
+	ctx context.Context, tx pgx.Tx, op string, key keyValue, oldRow, newRow json.RawMessage,
+) error {
+	if s.rel.AuditTable == "" {
+		return nil
+	}
+
+	diff, err := diffRows(oldRow, newRow)
+	if err != nil {
+		return err
+	}
+
+	// the actor is only as trustworthy as the identity, which clients can claim until it is authenticated
+	actor, _ := IdentityFrom(ctx)
+	requestID, _ := RequestIDFrom(ctx)
+
+	qry := fmt.Sprintf(`INSERT INTO %s (relation, resource_id, op, actor, actor_verified, request_id, old, new, diff)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6, ''), $7, $8, $9)`, s.rel.auditIdentifier())
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	_, err = tx.Exec(ctx, qry, s.rel.Schema+"."+s.rel.Name, key.String(), op, actor, IdentityVerified(ctx), requestID,
+		oldRow, newRow, diff)
+	if err != nil {
+		return fmt.Errorf("could not record audit: %w", err)
+	}
+
+	return nil
+}
+
+// auditImported returns a data-modifying WITH query that records the rows of the query rows in the audit table,
+// or "" if the relation is not audited. rows has the columns id, inserted, old and new, as from importReturning.
+// The diff is made in the database, as by diffRows, so that imported rows are not read back one by one.
+func (s *CRUDHandler) auditImported(ctx context.Context, rows string, args *[]any) string {
+	if s.rel.AuditTable == "" {
+		return ""
+	}
+
+	actor, _ := IdentityFrom(ctx)
+	requestID, _ := RequestIDFrom(ctx)
+
+	*args = append(*args, s.rel.Schema+"."+s.rel.Name, actor, IdentityVerified(ctx), requestID)
+	n := len(*args)
+
+	return fmt.Sprintf(`_dbx_audit AS (
+		INSERT INTO %[1]s (relation, resource_id, op, actor, actor_verified, request_id, old, new, diff)
+		SELECT $%[3]d, %[2]s.id, CASE WHEN %[2]s.inserted THEN %[7]s ELSE %[8]s END,
+			NULLIF($%[4]d, ''), $%[5]d, NULLIF($%[6]d, ''), %[2]s.old, %[2]s.new, %[9]s
+		FROM %[2]s
+		)`,
+		s.rel.auditIdentifier(),
+		rows,
+		n-3, n-2, n-1, n, //nolint:mnd
+		quoteLiteral(writeInsert),
+		quoteLiteral(writeUpdate),
+		diffExpr(rows+".old", rows+".new"),
+	)
+}
+
+// diffExpr returns the sql expression for the diff of the jsonb rows oldRow and newRow, as made by diffRows.
+func diffExpr(oldRow, newRow string) string {
+	return fmt.Sprintf(`(SELECT coalesce(jsonb_object_agg(key,
+			jsonb_build_object('old', _dbx_old_col.value, 'new', _dbx_new_col.value)), '{}')
+		FROM jsonb_each(%s) AS _dbx_old_col FULL JOIN jsonb_each(%s) AS _dbx_new_col USING (key)
+		WHERE _dbx_old_col.value IS DISTINCT FROM _dbx_new_col.value)`, oldRow, newRow)
+}
+
+// diffRows returns the columns that differ between the rows, with their old and new values.
+// A missing row, as before a create or after a delete, has no columns.
+func diffRows(oldRow, newRow json.RawMessage) (map[string]change, error) {
+	var oldCols, newCols map[string]json.RawMessage
+
+	for _, r := range []struct {
+		row  json.RawMessage
+		cols *map[string]json.RawMessage
+	}{{oldRow, &oldCols}, {newRow, &newCols}} {
+		if r.row == nil {
+			continue
+		}
+
+		err := json.Unmarshal(r.row, r.cols)
+		if err != nil {
+			return nil, fmt.Errorf("could not diff rows: %w", err)
+		}
+	}
+
+	diff := map[string]change{}
+
+	for col, oldValue := range oldCols {
+		newValue, ok := newCols[col]
+		if !ok || !bytes.Equal(oldValue, newValue) {
+			diff[col] = change{Old: oldValue, New: newValue}
+		}
+	}
+
+	for col, newValue := range newCols {
+		if _, ok := oldCols[col]; !ok {
+			diff[col] = change{Old: nil, New: newValue}
+		}
+	}
+
+	return diff, nil
+}
+
+// auditIdentifier returns the quoted, schema qualified identifier of the audit table.
+func (r Relation) auditIdentifier() string {
+	return quoteIdentifier(r.Schema) + "." + quoteIdentifier(r.AuditTable)
+}
+
+// history returns the audit entries of the resource with key as a JSON array, newest first.
+// _limit and _offset page through the entries.
+func (s *CRUDHandler) history(ctx context.Context, key keyValue, values url.Values) (string, error) {
+	if s.rel.AuditTable == "" {
+		return "", ErrNotFound
+	}
+
+	limit, offset := defaultHistoryLimit, 0
+
+	for _, param := range []struct {
+		key string
+		num *int
+	}{{limitParam, &limit}, {offsetParam, &offset}} {
+		if !values.Has(param.key) {
+			continue
+		}
+
+		num, err := strconv.Atoi(values.Get(param.key))
+		if err != nil || num < 0 {
+			return "", fmt.Errorf("%w: %s must be a non-negative integer", ErrInvalidQuery, param.key)
+		}
+
+		*param.num = num
+	}
+
+	qry := fmt.Sprintf(`SELECT coalesce(json_agg(_dbx_audit ORDER BY _dbx_audit.at DESC, _dbx_audit.id DESC), '[]')::text
+		FROM (
+			SELECT id, op, actor, actor_verified, request_id, at, old, new, diff
+			FROM %s
+			WHERE relation = $1 AND resource_id = $2
+			ORDER BY at DESC, id DESC
+			LIMIT $3 OFFSET $4
+		) AS _dbx_audit`, s.rel.auditIdentifier())
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	var entries string
+
+	err := s.db.QueryRow(ctx, qry, s.rel.Schema+"."+s.rel.Name, key.String(), limit, offset).Scan(&entries)
+	if err != nil {
+		return "", fmt.Errorf("could not read history: %w", err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,104 @@
+package dbx
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiffRows(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		old  string
+		new  string
+		want string
+	}{
+		{
+			name: "create",
+			old:  "",
+			new:  `{"id": 1, "name": "a"}`,
+			want: `{"id":{"old":null,"new":1},"name":{"old":null,"new":"a"}}`,
+		},
+		{
+			name: "update",
+			old:  `{"id": 1, "name": "a", "tags": [1]}`,
+			new:  `{"id": 1, "name": "b", "tags": [1]}`,
+			want: `{"name":{"old":"a","new":"b"}}`,
+		},
+		{
+			name: "update to null",
+			old:  `{"id": 1, "name": "a"}`,
+			new:  `{"id": 1, "name": null}`,
+			want: `{"name":{"old":"a","new":null}}`,
+		},
+		{
+			name: "update without changes",
+			old:  `{"id": 1}`,
+			new:  `{"id": 1}`,
+			want: `{}`,
+		},
+		{
+			name: "delete",
+			old:  `{"id": 1}`,
+			new:  "",
+			want: `{"id":{"old":1,"new":null}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var oldRow, newRow json.RawMessage
+			if tt.old != "" {
+				oldRow = json.RawMessage(tt.old)
+			}
+
+			if tt.new != "" {
+				newRow = json.RawMessage(tt.new)
+			}
+
+			diff, err := diffRows(oldRow, newRow)
+			if err != nil {
+				t.Fatalf("could not diff: %v", err)
+			}
+
+			got, _ := json.Marshal(diff)
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditImported(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		table    string
+		wantArgs int
+	}{
+		{name: "not audited", table: "", wantArgs: 1},
+		{name: "audited", table: "audit", wantArgs: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := CRUDHandler{rel: Relation{Schema: "s", Name: "n", AuditTable: tt.table}} //nolint:exhaustruct
+			args := []any{"assigned"}
+
+			qry := srv.auditImported(WithIdentity(t.Context(), "alice"), rowsAlias, &args)
+			if (qry != "") != (tt.table != "") || len(args) != tt.wantArgs {
+				t.Fatalf("got %q with %d args, want %d args", qry, len(args), tt.wantArgs)
+			}
+
+			if tt.table != "" && (args[1] != "s.n" || args[2] != "alice" || args[3] != false) {
+				t.Errorf("got args %v", args)
+			}
+		})
+	}
+}
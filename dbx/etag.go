@@ -0,0 +1,51 @@
+package dbx
+
+import (
+	"fmt"
+)
+
+// ETagStrategy computes the entity tag of a row.
+// The entity tag is computed in sql, so that it is available both when reading
+// and in the RETURNING clause of writes.
+type ETagStrategy interface {
+	// Expression returns a sql expression of type text with the entity tag of the row alias.
+	Expression(alias string) string
+}
+
+// ETagColumn uses a stored column as entity tag, such as a generated md5 column.
+type ETagColumn string
+
+// Expression implements ETagStrategy.
+func (c ETagColumn) Expression(alias string) string {
+	return fmt.Sprintf(`%s.%s::text`, alias, quoteIdentifier(string(c)))
+}
+
+// ETagRowHash uses the md5 hash of the whole row as entity tag.
+// It is computed at query time, so no extra column is needed
+// and new columns are picked up automatically.
+type ETagRowHash struct{}
+
+// Expression implements ETagStrategy.
+func (ETagRowHash) Expression(alias string) string {
+	return fmt.Sprintf(`md5(row_to_json(%s)::text)`, alias)
+}
+
+// ETagXmin uses the xmin system column combined with the table oid as entity tag.
+// xmin is the id of the transaction that wrote the row version, so it changes on every write,
+// including writes that don't change any values. Only works for tables.
+type ETagXmin struct{}
+
+// Expression implements ETagStrategy.
+func (ETagXmin) Expression(alias string) string {
+	return fmt.Sprintf(`%[1]s.tableoid::text || '-' || %[1]s.xmin::text`, alias)
+}
+
+// ETagVersion uses an integer version column as entity tag.
+// The column must be bumped on every update, typically by a trigger.
+// See db/api.sql for a trigger function.
+type ETagVersion string
+
+// Expression implements ETagStrategy.
+func (v ETagVersion) Expression(alias string) string {
+	return fmt.Sprintf(`%s.%s::text`, alias, quoteIdentifier(string(v)))
+}
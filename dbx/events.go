@@ -0,0 +1,495 @@
+package dbx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// Events
+//
+// GET /_events is a stream of changes to the relation as Server-Sent Events.
+// A trigger managed by dbx notifies a channel on every write, and a single connection
+// listens to the channel and fans the events out to subscribers.
+
+// mediaTypeEventStream is the media type of Server-Sent Events.
+var mediaTypeEventStream = header.NewMediaType("text", "event-stream") //nolint:gochecknoglobals
+
+const (
+	// notifyTrigger is the name of the trigger that notifies about changes.
+	notifyTrigger = "dbx_notify"
+
+	// maxPayloadSize is the maximum size of a notification payload, a bit below the 8000 bytes allowed.
+	maxPayloadSize = 7900
+
+	// heartbeatInterval is how often subscribers get a comment, keeping idle connections open.
+	heartbeatInterval = 15 * time.Second
+
+	// listenRetryInterval is how long to wait before listening again after losing the connection.
+	listenRetryInterval = time.Second
+
+	// resetEvent tells subscribers that events may have been lost, and that they should read again.
+	resetEvent = "reset"
+)
+
+// EventsConfig configures Events.
+type EventsConfig struct {
+	// Channel is the notification channel
+	Channel string
+
+	// Replay is the number of events kept for subscribers that resume with Last-Event-ID
+	Replay int
+
+	// Buffer is the number of events that can wait for a slow subscriber.
+	// Subscribers that fall further behind are disconnected, and can resume with Last-Event-ID.
+	Buffer int
+}
+
+// Events listens for changes to relations and fans them out to subscribers.
+type Events struct {
+	db      *pgxpool.Pool
+	channel string
+	buffer  int
+	stop    context.CancelFunc
+	wg      sync.WaitGroup
+
+	// epoch makes event ids from an earlier process unknown
+	epoch string
+
+	mu          sync.Mutex
+	seq         uint64
+	replay      []event
+	replaySize  int
+	subscribers map[*subscriber]struct{}
+}
+
+// event is a change to a row, or a reset.
+type event struct {
+	seq uint64
+
+	// name is the operation, such as insert, or resetEvent
+	name string
+
+	// Relation is the schema qualified name of the relation
+	Relation string `json:"relation"`
+
+	// Op is the operation: insert, update or delete
+	Op string `json:"op"`
+
+	// ID is the key of the row
+	ID string `json:"id"`
+
+	// ETag is the entity tag of the row after the change, or empty for deletes
+	ETag string `json:"etag,omitempty"`
+
+	// Row is the row with the readable columns, or nil if it didn't fit in the notification
+	Row json.RawMessage `json:"row,omitempty"`
+
+	// Deleted is true if the row is soft-deleted after the change
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// subscriber is a client of the event stream of a relation.
+type subscriber struct {
+	relation string
+	events   chan event
+}
+
+// NewEvents returns Events listening on cfg.Channel until ctx is done or Close is called.
+func NewEvents(ctx context.Context, db *pgxpool.Pool, cfg EventsConfig) *Events {
+	ctx, stop := context.WithCancel(ctx)
+
+	e := &Events{ //nolint:exhaustruct
+		db:          db,
+		channel:     cfg.Channel,
+		buffer:      cfg.Buffer,
+		stop:        stop,
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36), //nolint:mnd
+		replaySize:  cfg.Replay,
+		subscribers: map[*subscriber]struct{}{},
+	}
+
+	e.wg.Go(func() {
+		e.listen(ctx)
+	})
+
+	return e
+}
+
+// Close stops listening, and disconnects all subscribers.
+func (e *Events) Close() {
+	e.stop()
+	e.wg.Wait()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for sub := range e.subscribers {
+		delete(e.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// listen listens on a dedicated connection until ctx is done, reconnecting when the connection is lost.
+// Notifications sent while not listening are lost, so subscribers get a reset event after reconnecting.
+func (e *Events) listen(ctx context.Context) {
+	for first := true; ctx.Err() == nil; first = false {
+		if !first {
+			e.publish(event{name: resetEvent}) //nolint:exhaustruct
+		}
+
+		err := e.listenOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "lost event listener", "channel", e.channel, "error", err)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(listenRetryInterval):
+			}
+		}
+	}
+}
+
+// listenOnce listens on a connection from the pool, which is taken out of the pool for good.
+func (e *Events) listenOnce(ctx context.Context) error {
+	poolConn, err := e.db.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("could not acquire connection: %w", err)
+	}
+
+	conn := poolConn.Hijack()
+	defer conn.Close(context.WithoutCancel(ctx))
+
+	_, err = conn.Exec(ctx, "LISTEN "+quoteIdentifier(e.channel))
+	if err != nil {
+		return fmt.Errorf("could not listen: %w", err)
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("could not wait for notification: %w", err)
+		}
+
+		var ev event
+
+		err = json.Unmarshal([]byte(notification.Payload), &ev)
+		if err != nil {
+			slog.WarnContext(ctx, "invalid notification", "channel", e.channel, "error", err)
+			continue
+		}
+
+		ev.name = ev.Op
+		e.publish(ev)
+	}
+}
+
+// publish gives ev the next sequence number, keeps it for replay and sends it to subscribers.
+// Subscribers that are too far behind are disconnected.
+func (e *Events) publish(ev event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.seq++
+	ev.seq = e.seq
+
+	e.replay = append(e.replay, ev)
+	if len(e.replay) > e.replaySize {
+		e.replay = e.replay[len(e.replay)-e.replaySize:]
+	}
+
+	for sub := range e.subscribers {
+		if ev.name != resetEvent && sub.relation != ev.Relation {
+			continue
+		}
+
+		select {
+		case sub.events <- ev:
+		default:
+			delete(e.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// subscribe returns a subscriber to the events of relation.
+// If lastEventID is set, the events after it are sent first.
+// If the events after it are no longer kept, a reset event is sent instead.
+func (e *Events) subscribe(relation, lastEventID string) *subscriber {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var backlog []event
+
+	if lastEventID != "" {
+		// resuming after the reset starts from now
+		backlog = []event{{seq: e.seq, name: resetEvent}} //nolint:exhaustruct
+
+		epoch, seqStr, _ := strings.Cut(lastEventID, ".")
+		seq, err := strconv.ParseUint(seqStr, 10, 64)
+		known := err == nil && epoch == e.epoch && seq <= e.seq
+
+		// nothing is lost if the event after lastEventID is still kept, or hasn't happened yet
+		kept := seq == e.seq || (len(e.replay) > 0 && e.replay[0].seq <= seq+1)
+
+		if known && kept {
+			backlog = nil
+
+			for _, ev := range e.replay {
+				if ev.seq > seq && (ev.name == resetEvent || ev.Relation == relation) {
+					backlog = append(backlog, ev)
+				}
+			}
+		}
+	}
+
+	sub := &subscriber{relation: relation, events: make(chan event, e.buffer+len(backlog))}
+	for _, ev := range backlog {
+		sub.events <- ev
+	}
+
+	e.subscribers[sub] = struct{}{}
+
+	return sub
+}
+
+// unsubscribe removes sub, if it is still subscribed.
+func (e *Events) unsubscribe(sub *subscriber) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.subscribers[sub]; ok {
+		delete(e.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// eventID returns the id of ev, as sent to subscribers.
+func (e *Events) eventID(ev event) string {
+	return e.epoch + "." + strconv.FormatUint(ev.seq, 10)
+}
+
+// UseEvents creates or replaces the trigger that notifies events about changes to the relation,
+// and serves the changes at GET /_events. Only works for tables.
+func (s *CRUDHandler) UseEvents(ctx context.Context, events *Events) error {
+	fn := quoteIdentifier(s.rel.Schema) + "." + quoteIdentifier(notifyTrigger+"_"+s.rel.Name)
+
+	// the etag is read back from the table, so that every strategy gives the same etag as reads
+	qry := fmt.Sprintf(`CREATE OR REPLACE FUNCTION %[1]s()
+		RETURNS TRIGGER
+		LANGUAGE plpgsql
+		AS $dbx$
+		DECLARE
+			_dbx_row record;
+			_dbx_etag text;
+			_dbx_payload text;
+		BEGIN
+			IF TG_OP = 'DELETE' THEN
+				_dbx_row := OLD;
+			ELSE
+				_dbx_row := NEW;
+				SELECT %[2]s INTO _dbx_etag FROM %[3]s AS _dbx WHERE %[9]s;
+			END IF;
+
+			_dbx_payload := json_build_object(
+				'relation', %[4]s, 'op', lower(TG_OP), 'id', %[10]s, 'etag', _dbx_etag,
+				'deleted', %[11]s, 'row', %[5]s
+			)::text;
+
+			IF octet_length(_dbx_payload) > %[6]d THEN
+				_dbx_payload := json_build_object(
+					'relation', %[4]s, 'op', lower(TG_OP), 'id', %[10]s, 'etag', _dbx_etag,
+					'deleted', %[11]s
+				)::text;
+			END IF;
+
+			PERFORM pg_notify(%[7]s, _dbx_payload);
+
+			RETURN NULL;
+		END;
+		$dbx$;
+
+		CREATE OR REPLACE TRIGGER %[8]s AFTER INSERT OR UPDATE OR DELETE ON %[3]s
+		FOR EACH ROW EXECUTE FUNCTION %[1]s();`,
+		fn,
+		s.rel.etagExpr("_dbx"),
+		s.rel.identifier(),
+		quoteLiteral(s.rel.Schema+"."+s.rel.Name),
+		s.rel.rowJSON("_dbx_row"),
+		maxPayloadSize,
+		quoteLiteral(events.channel),
+		quoteIdentifier(notifyTrigger),
+		s.rel.keyEquals("_dbx", "NEW"),
+		s.rel.keyText("_dbx_row"),
+		"NOT ("+s.rel.visible("_dbx_row", false)+")",
+	)
+
+	_, err := s.db.Exec(ctx, qry)
+	if err != nil {
+		return fmt.Errorf("could not create notify trigger: %w", err)
+	}
+
+	s.events = events
+
+	return nil
+}
+
+// matches returns true if the row of ev matches the filters of q.
+// The row is populated to the row type of the relation, so that filters behave as in lists.
+// Events without a row always match, since they cannot be checked.
+func (s *CRUDHandler) matches(ctx context.Context, ev event, q Query) (bool, error) {
+	if len(q.Filters) == 0 || ev.Row == nil {
+		return true, nil
+	}
+
+	args := []any{string(ev.Row)}
+
+	where, err := q.where("_dbx", &args)
+	if err != nil {
+		return false, err
+	}
+
+	var match bool
+
+	err = s.db.QueryRow(ctx, fmt.Sprintf(`SELECT EXISTS (
+			SELECT FROM json_populate_record(NULL::%s, $1::json) AS _dbx WHERE %s
+		)`, s.rel.identifier(), where), args...).Scan(&match)
+	if err != nil {
+		return false, fmt.Errorf("could not filter event: %w", err)
+	}
+
+	return match, nil
+}
+
+// streamEvents writes the events of sub that match q to w, until the subscriber or ctx is done.
+func (s *CRUDHandler) streamEvents(ctx context.Context, w http.ResponseWriter, sub *subscriber, q Query) error {
+	rc := http.NewResponseController(w)
+
+	w.Header().Set(header.NameContentType, mediaTypeEventStream.String())
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, ": connected\n\n") //nolint:errcheck,gosec
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		err := rc.Flush()
+		if err != nil {
+			return fmt.Errorf("could not flush events: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+		case ev, ok := <-sub.events:
+			if !ok {
+				return nil
+			}
+
+			err = s.writeEvent(ctx, w, ev, q)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// hideDeleted returns ev as seen by subscribers that cannot see soft-deleted rows.
+// A soft delete is a delete to them, and other changes to soft-deleted rows are left out.
+// Returns false if ev is left out.
+func hideDeleted(ev event) (event, bool) {
+	if !ev.Deleted {
+		return ev, true
+	}
+
+	if ev.Op != writeUpdate {
+		return event{}, false
+	}
+
+	ev.name, ev.Op, ev.ETag, ev.Row, ev.Deleted = writeDelete, writeDelete, "", nil, false
+
+	return ev, true
+}
+
+// writeEvent writes ev to w, if it matches q.
+// Soft-deleted rows are hidden unless q includes them.
+func (s *CRUDHandler) writeEvent(ctx context.Context, w io.Writer, ev event, q Query) error {
+	data := []byte("{}")
+
+	if ev.name != resetEvent {
+		// filters see the row as it was written, before it is hidden
+		match, err := s.matches(ctx, ev, q)
+		if err != nil || !match {
+			return err
+		}
+
+		if !q.IncludeDeleted {
+			var ok bool
+
+			ev, ok = hideDeleted(ev)
+			if !ok {
+				return nil
+			}
+		}
+
+		if ev.ETag != "" {
+			ev.ETag = header.NewETag(false, ev.ETag).String()
+		}
+
+		data, err = json.Marshal(ev)
+		if err != nil {
+			return fmt.Errorf("could not marshal event: %w", err)
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", s.events.eventID(ev), ev.name, data)
+	if err != nil {
+		return fmt.Errorf("could not write event: %w", err)
+	}
+
+	return nil
+}
+
+// serveEvents serves the event stream of the relation.
+func (s *CRUDHandler) serveEvents(w http.ResponseWriter, req *http.Request) error {
+	if s.events == nil {
+		return ErrNotFound
+	}
+
+	prefs := newPreferences(req, header.PreferHandling)
+
+	q, err := s.rel.parseQuery(req.URL.Query(), prefs.handling)
+	if err != nil {
+		return err
+	}
+
+	err = s.rel.checkIncludeDeleted(req.Context(), q.IncludeDeleted)
+	if err != nil {
+		return err
+	}
+
+	prefs.setApplied(w)
+
+	sub := s.events.subscribe(s.rel.Schema+"."+s.rel.Name, req.Header.Get("Last-Event-ID"))
+	defer s.events.unsubscribe(sub)
+
+	err = s.streamEvents(req.Context(), w, sub, q)
+	if err != nil && req.Context().Err() == nil {
+		slog.ErrorContext(req.Context(), "stopped event stream", "error", err)
+	}
+
+	return nil
+}
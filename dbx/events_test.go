@@ -0,0 +1,166 @@
+package dbx
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func newTestEvents(replay, buffer int) *Events {
+	return &Events{ //nolint:exhaustruct
+		channel:     "test",
+		buffer:      buffer,
+		epoch:       "epoch",
+		replaySize:  replay,
+		subscribers: map[*subscriber]struct{}{},
+	}
+}
+
+func received(sub *subscriber) []string {
+	var names []string
+
+	for {
+		select {
+		case ev, ok := <-sub.events:
+			if !ok {
+				return append(names, "closed")
+			}
+
+			names = append(names, ev.name+":"+ev.ID)
+		default:
+			return names
+		}
+	}
+}
+
+func TestEventsSubscribe(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		lastEventID string
+		want        []string
+	}{
+		{
+			name:        "new subscribers only get new events",
+			lastEventID: "",
+			want:        []string{"update:4"},
+		},
+		{
+			name:        "resume replays the events after the last one",
+			lastEventID: "epoch.2",
+			want:        []string{"update:3", "update:4"},
+		},
+		{
+			name:        "resume from the last event",
+			lastEventID: "epoch.3",
+			want:        []string{"update:4"},
+		},
+		{
+			name:        "resume from an event that is no longer kept",
+			lastEventID: "epoch.1",
+			want:        []string{"reset:", "update:4"},
+		},
+		{
+			name:        "resume from another process",
+			lastEventID: "other.3",
+			want:        []string{"reset:", "update:4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			e := newTestEvents(2, 10)
+
+			for _, id := range []string{"1", "2", "3"} {
+				e.publish(event{name: "update", Relation: "s.n", Op: "update", ID: id}) //nolint:exhaustruct
+			}
+
+			// events of other relations are not sent
+			e.publish(event{name: "update", Relation: "s.other", Op: "update", ID: "x"}) //nolint:exhaustruct
+
+			sub := e.subscribe("s.n", tt.lastEventID)
+			e.publish(event{name: "update", Relation: "s.n", Op: "update", ID: "4"}) //nolint:exhaustruct
+
+			got := received(sub)
+			if len(got) != len(tt.want) {
+				t.Fatalf("received %v, want %v", got, tt.want)
+			}
+
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("received %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEventsDisconnectsSlowSubscribers(t *testing.T) {
+	t.Parallel()
+
+	e := newTestEvents(10, 1)
+	sub := e.subscribe("s.n", "")
+
+	e.publish(event{name: "insert", Relation: "s.n", Op: "insert", ID: "1"}) //nolint:exhaustruct
+	e.publish(event{name: "insert", Relation: "s.n", Op: "insert", ID: "2"}) //nolint:exhaustruct
+
+	got := received(sub)
+	if len(got) != 2 || got[0] != "insert:1" || got[1] != "closed" {
+		t.Errorf("received %v, want [insert:1 closed]", got)
+	}
+
+	// unsubscribing a disconnected subscriber is fine
+	e.unsubscribe(sub)
+}
+
+func TestHideDeleted(t *testing.T) {
+	t.Parallel()
+
+	row := json.RawMessage(`{"id":1,"deleted_at":"2026-01-01T00:00:00Z"}`)
+
+	tests := []struct {
+		name   string
+		ev     event
+		want   event
+		wantOK bool
+	}{
+		{
+			name:   "live row",
+			ev:     event{name: "update", Op: "update", ID: "1", ETag: "x", Row: json.RawMessage(`{"id":1}`)}, //nolint:exhaustruct
+			want:   event{name: "update", Op: "update", ID: "1", ETag: "x", Row: json.RawMessage(`{"id":1}`)}, //nolint:exhaustruct
+			wantOK: true,
+		},
+		{
+			name:   "soft delete",
+			ev:     event{name: "update", Op: "update", ID: "1", ETag: "x", Row: row, Deleted: true}, //nolint:exhaustruct
+			want:   event{name: "delete", Op: "delete", ID: "1"},                                     //nolint:exhaustruct
+			wantOK: true,
+		},
+		{
+			name: "inserted deleted",
+			ev:   event{name: "insert", Op: "insert", ID: "1", ETag: "x", Row: row, Deleted: true}, //nolint:exhaustruct
+		},
+		{
+			name: "purged",
+			ev:   event{name: "delete", Op: "delete", ID: "1", Row: row, Deleted: true}, //nolint:exhaustruct
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok := hideDeleted(tt.ev)
+			if ok != tt.wantOK {
+				t.Fatalf("got ok %v, want %v", ok, tt.wantOK)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package dbx
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// Exports
+//
+// GET /_export writes the rows matching the query with COPY TO, straight from the database to the client.
+
+// formatParam is the query parameter choosing the format of an export.
+const formatParam = "format"
+
+// exportFormat is a format of exports.
+type exportFormat struct {
+	// contentType is the Content-Type of the export
+	contentType string
+
+	// extension is the file name extension of the export
+	extension string
+
+	// options are the COPY options
+	options string
+
+	// json makes every row a JSON object
+	json bool
+}
+
+// exportFormats are the formats of exports, by the value of formatParam.
+//
+// JSON exports are NDJSON, with one object per line. COPY has no JSON format, and the text format escapes backslashes,
+// so each object is written as a single CSV field with quote and delimiter characters that JSON always escapes.
+func exportFormats() map[string]exportFormat {
+	return map[string]exportFormat{
+		"csv": {
+			contentType: "text/csv; charset=utf-8; header=present",
+			extension:   "csv",
+			options:     "FORMAT csv, HEADER true",
+			json:        false,
+		},
+		"binary": {
+			contentType: "application/octet-stream",
+			extension:   "bin",
+			options:     "FORMAT binary",
+			json:        false,
+		},
+		"json": {
+			contentType: mediaTypeNDJSON.String(),
+			extension:   "ndjson",
+			options:     `FORMAT csv, QUOTE E'\x01', DELIMITER E'\x02'`,
+			json:        true,
+		},
+	}
+}
+
+// parseExport parses the query parameters of an export.
+// The format defaults to CSV, and the other parameters are the same as for lists.
+func (r Relation) parseExport(values url.Values, handling string) (exportFormat, Query, error) {
+	values = maps.Clone(values)
+	name := values.Get(formatParam)
+	values.Del(formatParam)
+
+	if name == "" {
+		name = "csv"
+	}
+
+	format, ok := exportFormats()[name]
+	if !ok {
+		return exportFormat{}, Query{}, fmt.Errorf("%w: %s must be csv, binary or json", //nolint:exhaustruct
+			ErrInvalidQuery, formatParam)
+	}
+
+	q, err := r.parseQuery(values, handling)
+	if err != nil {
+		return exportFormat{}, Query{}, err //nolint:exhaustruct
+	}
+
+	return format, q, nil
+}
+
+// exportWriter writes an export to a response, compressed with gzip if compress is set.
+// Headers are written with the first bytes, so that errors before them still give a proper response.
+type exportWriter struct {
+	w        http.ResponseWriter
+	format   exportFormat
+	filename string
+	compress bool
+	out      io.Writer
+	gz       *gzip.Writer
+}
+
+// start writes the headers.
+func (ew *exportWriter) start() {
+	ew.w.Header().Set(header.NameContentType, ew.format.contentType)
+	ew.w.Header().Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": ew.filename + "." + ew.format.extension}))
+
+	ew.out = ew.w
+
+	if ew.compress {
+		ew.w.Header().Set(header.NameContentEncoding, "gzip")
+		ew.gz = gzip.NewWriter(ew.w)
+		ew.out = ew.gz
+	}
+}
+
+// Write implements io.Writer.
+func (ew *exportWriter) Write(p []byte) (int, error) {
+	if ew.out == nil {
+		ew.start()
+	}
+
+	n, err := ew.out.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("could not write export: %w", err)
+	}
+
+	return n, nil
+}
+
+// close ends the export. Empty exports still get headers.
+func (ew *exportWriter) close() {
+	if ew.out == nil {
+		ew.start()
+	}
+
+	if ew.gz != nil {
+		ew.gz.Close() //nolint:errcheck,gosec
+	}
+}
+
+// export writes the rows matching q in format to w with COPY TO.
+// The export runs in a REPEATABLE READ, read-only transaction, so that every row comes from the same snapshot.
+func (s *CRUDHandler) export(ctx context.Context, w io.Writer, format exportFormat, q Query) error {
+	where, err := q.whereLiterals("_dbx")
+	if err != nil {
+		return err
+	}
+
+	sel := strings.Join(prependIdentifier("_dbx", q.Select), ", ")
+
+	if format.json {
+		sel = fmt.Sprintf(`( SELECT row_to_json(_obj) FROM ( SELECT %s ) AS _obj )::text`, sel)
+	}
+
+	qry := fmt.Sprintf(`COPY ( SELECT %[1]s FROM %[2]s AS _dbx WHERE %[3]s ORDER BY %[4]s%[5]s ) TO STDOUT WITH ( %[6]s )`,
+		sel,
+		s.rel.identifier(),
+		where+" AND "+s.rel.visible("_dbx", q.IncludeDeleted),
+		q.orderBy("_dbx", s.rel.keyNames()...),
+		q.limitOffset(),
+		format.options,
+	)
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{ //nolint:exhaustruct
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Conn().PgConn().CopyTo(ctx, w, qry)
+	if err != nil {
+		return fmt.Errorf("could not export: %w", err)
+	}
+
+	return nil
+}
+
+// abort returns err if nothing has been written yet.
+// Otherwise, the status is already sent, so err is logged and the response is aborted.
+func (ew *exportWriter) abort(ctx context.Context, err error) error {
+	if ew.out == nil {
+		return err
+	}
+
+	slog.ErrorContext(ctx, "aborting response", "error", err)
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,103 @@
+package dbx
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseExport(t *testing.T) {
+	t.Parallel()
+
+	rel := Relation{Schema: "s", Name: "n", Columns: []string{"id", "rkey"}} //nolint:exhaustruct
+
+	tests := []struct {
+		name            string
+		query           string
+		wantContentType string
+		wantFilters     int
+		wantErr         bool
+	}{
+		{name: "csv by default", query: "", wantContentType: "text/csv; charset=utf-8; header=present"},
+		{name: "json with filter", query: "format=json&rkey=eq.a", wantContentType: "application/x-ndjson", wantFilters: 1},
+		{name: "binary", query: "format=binary", wantContentType: "application/octet-stream"},
+		{name: "unknown format", query: "format=xml", wantErr: true},
+		{name: "unknown column", query: "format=csv&nope=eq.1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			values, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			format, q, err := rel.parseExport(values, "")
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidQuery) {
+					t.Errorf("parseExport() error = %v, want %v", err, ErrInvalidQuery)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseExport() error = %v", err)
+			}
+
+			if format.contentType != tt.wantContentType {
+				t.Errorf("parseExport() content type = %v, want %v", format.contentType, tt.wantContentType)
+			}
+
+			if len(q.Filters) != tt.wantFilters {
+				t.Errorf("parseExport() filters = %v, want %d", q.Filters, tt.wantFilters)
+			}
+		})
+	}
+}
+
+func TestExportWriterCompresses(t *testing.T) {
+	t.Parallel()
+
+	rec := httptest.NewRecorder()
+	ew := &exportWriter{ //nolint:exhaustruct
+		w:        rec,
+		format:   exportFormats()["csv"],
+		filename: "resource",
+		compress: true,
+	}
+
+	_, err := io.WriteString(ew, "id\r\n1\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ew.close()
+
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding = %v, want gzip", got)
+	}
+
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename=resource.csv` {
+		t.Errorf("Content-Disposition = %v", got)
+	}
+
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(body) != "id\r\n1\r\n" {
+		t.Errorf("body = %q", body)
+	}
+}
@@ -0,0 +1,251 @@
+package dbx
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// History
+//
+// Relations with a history table keep every version of their rows, valid from one write to the next.
+// GET /{id}?as_of= reads the version valid at a time, and GET /{id}/_versions lists the versions.
+
+const (
+	// historyTrigger is the name of the trigger that keeps the history table.
+	historyTrigger = "dbx_history"
+
+	// asOfParam is the query parameter reading the version of a resource valid at a time.
+	asOfParam = "as_of"
+
+	// sinceParam is the query parameter listing versions from the one with an entity tag.
+	sinceParam = "since"
+)
+
+// version is a version of a resource.
+type version struct {
+	ETag      string            `json:"etag"`
+	ValidFrom time.Time         `json:"valid_from"`
+	ValidTo   *time.Time        `json:"valid_to"`
+	Row       json.RawMessage   `json:"row"`
+	Changes   map[string]change `json:"changes"`
+}
+
+// historyIdentifier returns the quoted, schema qualified identifier of the history table.
+func (r Relation) historyIdentifier() string {
+	return quoteIdentifier(r.Schema) + "." + quoteIdentifier(r.HistoryTable)
+}
+
+// UseHistory creates the history table of the relation if it does not exist,
+// and creates or replaces the trigger that keeps it. Only works for tables.
+//
+// Each version has the row, its entity tag and the time range it was valid.
+// The current version is valid to infinity, and rows that exist when history is first used are valid from then.
+func (s *CRUDHandler) UseHistory(ctx context.Context) error {
+	if s.rel.HistoryTable == "" {
+		return fmt.Errorf("%w: %s has no history table", ErrUnprocessable, s.rel.Name)
+	}
+
+	table := s.rel.historyIdentifier()
+	fn := quoteIdentifier(s.rel.Schema) + "." + quoteIdentifier(historyTrigger+"_"+s.rel.Name)
+
+	// the etag is read back from the table, so that every strategy gives the same etag as reads
+	qry := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s (
+			version BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+			valid_from TIMESTAMPTZ NOT NULL,
+			valid_to TIMESTAMPTZ NOT NULL DEFAULT 'infinity',
+			etag TEXT NOT NULL,
+			data %[2]s NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS %[3]s ON %[1]s (%[7]s, valid_from);
+
+		CREATE OR REPLACE FUNCTION %[4]s()
+		RETURNS TRIGGER
+		LANGUAGE plpgsql
+		AS $dbx$
+		BEGIN
+			IF TG_OP IN ('UPDATE', 'DELETE') THEN
+				UPDATE %[1]s SET valid_to = now() WHERE %[8]s AND valid_to = 'infinity';
+			END IF;
+
+			IF TG_OP IN ('INSERT', 'UPDATE') THEN
+				INSERT INTO %[1]s (valid_from, etag, data)
+				SELECT now(), %[5]s, _dbx FROM %[2]s AS _dbx WHERE %[9]s;
+			END IF;
+
+			RETURN NULL;
+		END;
+		$dbx$;
+
+		CREATE OR REPLACE TRIGGER %[6]s AFTER INSERT OR UPDATE OR DELETE ON %[2]s
+		FOR EACH ROW EXECUTE FUNCTION %[4]s();
+
+		INSERT INTO %[1]s (valid_from, etag, data)
+		SELECT now(), %[5]s, _dbx FROM %[2]s AS _dbx
+		WHERE NOT EXISTS (SELECT FROM %[1]s AS _dbx_version WHERE %[10]s);`,
+		table,
+		s.rel.identifier(),
+		quoteIdentifier(s.rel.HistoryTable+"_id"),
+		fn,
+		s.rel.etagExpr("_dbx"),
+		quoteIdentifier(historyTrigger),
+		"(("+strings.Join(prependIdentifier("(data)", s.rel.keyNames()), "), (")+"))",
+		s.rel.keyEquals("(data)", "OLD"),
+		s.rel.keyEquals("_dbx", "NEW"),
+		s.rel.keyEquals("(_dbx_version.data)", "_dbx"),
+	)
+
+	_, err := s.db.Exec(ctx, qry)
+	if err != nil {
+		return fmt.Errorf("could not create history: %w", err)
+	}
+
+	return nil
+}
+
+// parseAsOf returns the time of the as_of query parameter, or nil if there is none.
+func (r Relation) parseAsOf(values url.Values) (*time.Time, error) {
+	if !values.Has(asOfParam) {
+		return nil, nil //nolint:nilnil
+	}
+
+	if r.HistoryTable == "" {
+		return nil, fmt.Errorf("%w: %s needs a relation with history", ErrInvalidQuery, asOfParam)
+	}
+
+	asOf, err := time.Parse(time.RFC3339Nano, values.Get(asOfParam))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s must be an RFC 3339 timestamp", ErrInvalidQuery, asOfParam)
+	}
+
+	return &asOf, nil
+}
+
+// getVersion returns the version of a resource valid at asOf.
+// The entity tag is the one the resource had then.
+// Error is ErrNotFound if the resource did not exist at asOf, or was soft-deleted then, unless includeDeleted.
+func (s *CRUDHandler) getVersion(
+	ctx context.Context, tx pgx.Tx, fields []string, key keyValue, asOf time.Time, includeDeleted bool,
+	opts responseOptions,
+) (resource, error) {
+	args := []any{asOf}
+
+	qry := fmt.Sprintf(`WITH %[1]s AS (
+			SELECT (_dbx_version.data).*, _dbx_version.etag AS %[2]s
+			FROM %[3]s AS _dbx_version
+			WHERE %[5]s AND %[6]s AND _dbx_version.valid_from <= $1 AND $1 < _dbx_version.valid_to
+			LIMIT 1
+		)
+		SELECT %[4]s FROM %[1]s`,
+		rowsAlias,
+		etagAlias,
+		s.rel.historyIdentifier(),
+		s.rel.responseSelect(fields, opts),
+		s.rel.keyWhere("(_dbx_version.data)", key, &args),
+		s.rel.visible("(_dbx_version.data)", includeDeleted),
+	)
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	var res resource
+
+	switch err := tx.QueryRow(ctx, qry, args...).Scan(&res.response, &res.etag, &res.lastModified, &res.id); {
+	case errors.Is(err, sql.ErrNoRows):
+		return resource{}, ErrNotFound
+	case err == nil:
+		return res, nil
+	default:
+		return resource{}, fmt.Errorf("could not get version: %w", err)
+	}
+}
+
+// versions returns the versions of the resource with key, oldest first, with the columns that changed in each.
+// With since, the versions start at the one with that entity tag, so that a client can see what changed after it.
+// Error is ErrNotFound if the resource never existed, or if no version has the entity tag.
+func (s *CRUDHandler) versions(ctx context.Context, key keyValue, values url.Values) ([]version, error) {
+	if s.rel.HistoryTable == "" {
+		return nil, ErrNotFound
+	}
+
+	var args []any
+
+	qry := fmt.Sprintf(`SELECT etag, valid_from, NULLIF(valid_to, 'infinity'), %s
+		FROM %s AS _dbx_version
+		WHERE %s AND valid_from < valid_to
+		ORDER BY valid_from, version`,
+		s.rel.rowJSON("_dbx_version.data"),
+		s.rel.historyIdentifier(),
+		s.rel.keyWhere("(_dbx_version.data)", key, &args),
+	)
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	rows, err := s.db.Query(ctx, qry, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not list versions: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []version
+
+	for rows.Next() {
+		var v version
+
+		err = rows.Scan(&v.ETag, &v.ValidFrom, &v.ValidTo, &v.Row)
+		if err != nil {
+			return nil, fmt.Errorf("could not list versions: %w", err)
+		}
+
+		versions = append(versions, v)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not list versions: %w", err)
+	}
+
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return withChanges(versions, values.Get(sinceParam))
+}
+
+// withChanges sets the changes of each version from the one before it, and quotes the entity tags.
+// With since, the versions start at the one with that entity tag.
+func withChanges(versions []version, since string) ([]version, error) {
+	var prev json.RawMessage
+
+	for i := range versions {
+		changes, err := diffRows(prev, versions[i].Row)
+		if err != nil {
+			return nil, err
+		}
+
+		prev = versions[i].Row
+		versions[i].Changes = changes
+		versions[i].ETag = header.NewETag(false, versions[i].ETag).String()
+	}
+
+	if since == "" {
+		return versions, nil
+	}
+
+	for i, v := range versions {
+		if v.ETag == since {
+			return versions[i:], nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: no version has the entity tag %s", ErrNotFound, since)
+}
@@ -0,0 +1,64 @@
+package dbx
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestWithChanges(t *testing.T) {
+	t.Parallel()
+
+	newVersions := func() []version {
+		return []version{
+			{ETag: "a", Row: json.RawMessage(`{"id": 1, "name": "x"}`)},         //nolint:exhaustruct
+			{ETag: "b", Row: json.RawMessage(`{"id": 1, "name": "y"}`)},         //nolint:exhaustruct
+			{ETag: "c", Row: json.RawMessage(`{"id": 1, "name": "y", "n": 2}`)}, //nolint:exhaustruct
+		}
+	}
+
+	tests := []struct {
+		name      string
+		since     string
+		wantETags []string
+		wantErr   error
+	}{
+		{name: "all versions", since: "", wantETags: []string{`"a"`, `"b"`, `"c"`}, wantErr: nil},
+		{name: "since a version", since: `"b"`, wantETags: []string{`"b"`, `"c"`}, wantErr: nil},
+		{name: "since an unknown version", since: `"d"`, wantETags: nil, wantErr: ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := withChanges(newVersions(), tt.since)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if len(got) != len(tt.wantETags) {
+				t.Fatalf("got %d versions, want %d", len(got), len(tt.wantETags))
+			}
+
+			for i, v := range got {
+				if v.ETag != tt.wantETags[i] {
+					t.Errorf("version %d has etag %s, want %s", i, v.ETag, tt.wantETags[i])
+				}
+			}
+		})
+	}
+
+	got, _ := withChanges(newVersions(), "")
+
+	for i, want := range []string{
+		`{"id":{"old":null,"new":1},"name":{"old":null,"new":"x"}}`,
+		`{"name":{"old":"x","new":"y"}}`,
+		`{"n":{"old":null,"new":2}}`,
+	} {
+		changes, _ := json.Marshal(got[i].Changes)
+		if string(changes) != want {
+			t.Errorf("version %d has changes %s, want %s", i, changes, want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package dbx
+
+import (
+	"context"
+	"fmt"
+)
+
+// identityKey is the context key for the identity of the requester.
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx that carries the identity of the requester.
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFrom returns the identity of the requester carried by ctx, if any.
+func IdentityFrom(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(identityKey{}).(string)
+
+	return identity, ok && identity != ""
+}
+
+// verifiedKey is the context key for whether the identity of the requester was authenticated.
+type verifiedKey struct{}
+
+// WithVerifiedIdentity returns a copy of ctx that carries the identity of the requester,
+// marked as authenticated by the server rather than claimed by the client.
+func WithVerifiedIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(WithIdentity(ctx, identity), verifiedKey{}, true)
+}
+
+// IdentityVerified returns true if the identity carried by ctx was authenticated.
+func IdentityVerified(ctx context.Context) bool {
+	verified, _ := ctx.Value(verifiedKey{}).(bool)
+
+	return verified
+}
+
+// AssignIdentity is an AssignFunc that assigns the identity of the requester.
+// Errors with ErrForbidden if the request carries no identity.
+func AssignIdentity(ctx context.Context) (any, error) {
+	identity, ok := IdentityFrom(ctx)
+	if !ok {
+		return nil, fmt.Errorf("%w: no identity", ErrForbidden)
+	}
+
+	return identity, nil
+}
+
+// requestIDKey is the context key for the id of the request.
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx that carries the id of the request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFrom returns the id of the request carried by ctx, if any.
+func RequestIDFrom(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+
+	return id, ok && id != ""
+}
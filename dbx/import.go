@@ -0,0 +1,692 @@
+package dbx
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// Imports
+//
+// POST /_import loads a CSV or NDJSON body with COPY. Rows are copied to a temporary staging table
+// with text columns, checked against the types of the relation, and then inserted in a single statement.
+
+const (
+	// stagingTable is the temporary table that imports are copied to.
+	stagingTable = "_dbx_import"
+	// lineColumn is the column of stagingTable with the line number of the row in the body.
+	lineColumn = "_dbx_line"
+	// unknownColumn is the column of stagingTable with unknown fields of the row, if any.
+	unknownColumn = "_dbx_unknown"
+
+	// onConflictParam decides what happens to rows that conflict with existing rows.
+	onConflictParam = "on_conflict"
+	// conflictTargetParam are the columns of the unique constraint that rows conflict on.
+	conflictTargetParam = "conflict_target"
+
+	// importErrorLimit is the maximum number of errors reported for an import.
+	importErrorLimit = 20
+	// maxLineSize is the maximum size of a single NDJSON line.
+	maxLineSize = 16 << 20
+)
+
+// Values of onConflictParam.
+const (
+	onConflictIgnore = "ignore"
+	onConflictUpdate = "update"
+)
+
+// importSource is a pgx.CopyFromSource with the rows of an import body.
+// Each row starts with the line number and the unknown fields, followed by the values of the columns.
+type importSource interface {
+	pgx.CopyFromSource
+
+	// columns returns the columns of the relation in the body
+	columns() []string
+}
+
+// importResult is the response to a successful import.
+type importResult struct {
+	// Rows is the number of rows in the body
+	Rows int64 `json:"rows"`
+
+	// Imported is the number of rows inserted or updated
+	Imported int64 `json:"imported"`
+
+	// Errors are the first errors of an import that failed, in asynchronous operations
+	Errors FieldErrors `json:"errors,omitempty"`
+}
+
+// importOptions are the options of an import, from the query parameters.
+type importOptions struct {
+	onConflict     string
+	conflictTarget []string
+}
+
+// parseImportOptions parses the query parameters of an import.
+func (r Relation) parseImportOptions(values url.Values) (importOptions, error) {
+	opts := importOptions{onConflict: values.Get(onConflictParam), conflictTarget: nil}
+
+	switch opts.onConflict {
+	case "", onConflictIgnore, onConflictUpdate:
+	default:
+		return importOptions{}, fmt.Errorf("%w: %s must be ignore or update", ErrInvalidQuery, onConflictParam) //nolint:exhaustruct
+	}
+
+	if target := values.Get(conflictTargetParam); target != "" {
+		opts.conflictTarget = strings.Split(target, ",")
+	}
+
+	for _, col := range opts.conflictTarget {
+		if !slices.Contains(r.Columns, col) {
+			return importOptions{}, fmt.Errorf("%w: unknown column %s", ErrInvalidQuery, col) //nolint:exhaustruct
+		}
+	}
+
+	if opts.onConflict == onConflictUpdate && len(opts.conflictTarget) == 0 {
+		return importOptions{}, fmt.Errorf("%w: %s=update needs %s", //nolint:exhaustruct
+			ErrInvalidQuery, onConflictParam, conflictTargetParam)
+	}
+
+	return opts, nil
+}
+
+// importMediaType returns the media type of an import body with contentType, and the CSV delimiter.
+// Error is ErrUnsupportedMediaType if the body is neither CSV nor NDJSON.
+func importMediaType(contentType string) (header.MediaType, rune, error) {
+	mediaType, err := header.ParseMediaType(contentType)
+	if err != nil {
+		return header.MediaType{}, 0, fmt.Errorf("%w: %w", ErrUnsupportedMediaType, err) //nolint:exhaustruct
+	}
+
+	switch mediaType.Essence() {
+	case mediaTypeCSV.Essence():
+		opts, err := responseOptions{}.withMediaType(mediaType) //nolint:exhaustruct
+		if err != nil {
+			return header.MediaType{}, 0, fmt.Errorf("%w: %w", ErrUnsupportedMediaType, err) //nolint:exhaustruct
+		}
+
+		return mediaType, rune(opts.delimiter[0]), nil
+	case mediaTypeNDJSON.Essence():
+		return mediaType, 0, nil
+	default:
+		return header.MediaType{}, 0, fmt.Errorf("%w: %s", ErrUnsupportedMediaType, mediaType.Essence()) //nolint:exhaustruct
+	}
+}
+
+// newImportSource returns the importSource for body, based on its contentType.
+// Error is ErrUnsupportedMediaType if the body is neither CSV nor NDJSON.
+func newImportSource(contentType string, body io.Reader) (importSource, error) {
+	mediaType, delimiter, err := importMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if mediaType.Essence() == mediaTypeCSV.Essence() {
+		return newCSVSource(body, delimiter)
+	}
+
+	return newNDJSONSource(body)
+}
+
+// csvSource reads rows from a CSV body, with a header row naming the columns.
+// Empty fields are NULL.
+type csvSource struct {
+	reader *csv.Reader
+	cols   []string
+	record []string
+	err    error
+}
+
+// newCSVSource returns a csvSource, reading the header row from body.
+func newCSVSource(body io.Reader, delimiter rune) (*csvSource, error) {
+	reader := csv.NewReader(body)
+	reader.Comma = delimiter
+	reader.ReuseRecord = true
+
+	cols, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: could not read header row: %w", ErrInvalidBody, err)
+	}
+
+	return &csvSource{reader: reader, cols: slices.Clone(cols), record: nil, err: nil}, nil
+}
+
+func (s *csvSource) columns() []string {
+	return s.cols
+}
+
+// Next implements pgx.CopyFromSource.
+func (s *csvSource) Next() bool {
+	s.record, s.err = s.reader.Read()
+	if errors.Is(s.err, io.EOF) {
+		s.err = nil
+		return false
+	}
+
+	return s.err == nil
+}
+
+// Values implements pgx.CopyFromSource.
+func (s *csvSource) Values() ([]any, error) {
+	line, _ := s.reader.FieldPos(0)
+
+	values := make([]any, 0, len(s.record)+2) //nolint:mnd
+	values = append(values, int64(line), nil)
+
+	for _, field := range s.record {
+		if field == "" {
+			values = append(values, nil)
+			continue
+		}
+
+		values = append(values, field)
+	}
+
+	return values, nil
+}
+
+// Err implements pgx.CopyFromSource.
+func (s *csvSource) Err() error {
+	if s.err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidBody, s.err)
+	}
+
+	return nil
+}
+
+// ndjsonSource reads rows from a NDJSON body, with one object per line.
+// The columns are the fields of the first object. Missing fields are NULL.
+type ndjsonSource struct {
+	scanner *bufio.Scanner
+	cols    []string
+	line    int64
+	object  map[string]json.RawMessage
+	pending bool
+	err     error
+}
+
+// newNDJSONSource returns a ndjsonSource, reading the first object from body.
+func newNDJSONSource(body io.Reader) (*ndjsonSource, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, maxLineSize)
+
+	s := &ndjsonSource{scanner: scanner, cols: nil, line: 0, object: nil, pending: false, err: nil}
+	if !s.scan() {
+		if s.err != nil {
+			return nil, s.err
+		}
+
+		return nil, fmt.Errorf("%w: no objects", ErrInvalidBody)
+	}
+
+	s.cols = slices.Sorted(maps.Keys(s.object))
+	s.pending = true
+
+	return s, nil
+}
+
+// scan reads the next object, skipping empty lines.
+func (s *ndjsonSource) scan() bool {
+	for s.scanner.Scan() {
+		s.line++
+
+		if strings.TrimSpace(s.scanner.Text()) == "" {
+			continue
+		}
+
+		s.object = nil
+
+		err := json.Unmarshal(s.scanner.Bytes(), &s.object)
+		if err != nil || s.object == nil {
+			s.err = fmt.Errorf("%w: line %d is not an object", ErrInvalidBody, s.line)
+			return false
+		}
+
+		return true
+	}
+
+	if err := s.scanner.Err(); err != nil {
+		s.err = fmt.Errorf("%w: %w", ErrInvalidBody, err)
+	}
+
+	return false
+}
+
+func (s *ndjsonSource) columns() []string {
+	return s.cols
+}
+
+// Next implements pgx.CopyFromSource.
+func (s *ndjsonSource) Next() bool {
+	if s.pending {
+		s.pending = false
+		return true
+	}
+
+	return s.scan()
+}
+
+// Values implements pgx.CopyFromSource.
+// Strings are unquoted, and other values are kept as JSON text.
+func (s *ndjsonSource) Values() ([]any, error) {
+	values := make([]any, 0, len(s.cols)+2) //nolint:mnd
+	values = append(values, s.line, nil)
+
+	var unknown []string
+
+	for field := range s.object {
+		if !slices.Contains(s.cols, field) {
+			unknown = append(unknown, field)
+		}
+	}
+
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		values[1] = strings.Join(unknown, ",")
+	}
+
+	for _, col := range s.cols {
+		raw, ok := s.object[col]
+		if !ok || databaseType(raw) == "null" {
+			values = append(values, nil)
+			continue
+		}
+
+		var str string
+		if json.Unmarshal(raw, &str) == nil {
+			values = append(values, str)
+			continue
+		}
+
+		values = append(values, string(raw))
+	}
+
+	return values, nil
+}
+
+// Err implements pgx.CopyFromSource.
+func (s *ndjsonSource) Err() error {
+	return s.err
+}
+
+// importAll imports the rows of src in a transaction, which is finished as preferred.
+func (s *CRUDHandler) importAll(
+	ctx context.Context, src importSource, opts importOptions, prefs preferences,
+) (importResult, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return importResult{}, fmt.Errorf("could not begin transaction: %w", err) //nolint:exhaustruct
+	}
+	defer tx.Rollback(ctx)
+
+	res, err := s.importRows(ctx, tx, src, opts)
+	if err != nil {
+		return res, err
+	}
+
+	err = prefs.finish(ctx, tx)
+	if err != nil {
+		return importResult{}, err //nolint:exhaustruct
+	}
+
+	return res, nil
+}
+
+// importRows copies the rows of src to the relation.
+// The rows are checked before anything is inserted, and the first importErrorLimit errors
+// are returned as FieldErrors with line numbers.
+//
+//nolint:funlen,cyclop
+func (s *CRUDHandler) importRows(
+	ctx context.Context, tx pgx.Tx, src importSource, opts importOptions,
+) (importResult, error) {
+	cols := src.columns()
+
+	err := s.rel.checkFields(opCreate, cols)
+	if err != nil {
+		return importResult{}, err //nolint:exhaustruct
+	}
+
+	for i, col := range cols {
+		if slices.Contains(cols[:i], col) {
+			return importResult{}, FieldErrors{{Field: col, Reason: "duplicate field", Line: 0}}
+		}
+	}
+
+	types, err := s.columnTypes(ctx, tx)
+	if err != nil {
+		return importResult{}, err //nolint:exhaustruct
+	}
+
+	staged := make([]string, len(cols))
+	for i, col := range cols {
+		staged[i] = quoteIdentifier(col) + " text"
+	}
+
+	_, err = tx.Exec(ctx, fmt.Sprintf(`CREATE TEMPORARY TABLE %s ( %s bigint, %s text, %s ) ON COMMIT DROP`,
+		stagingTable, lineColumn, unknownColumn, strings.Join(staged, ", ")))
+	if err != nil {
+		return importResult{}, fmt.Errorf("could not create staging table: %w", err) //nolint:exhaustruct
+	}
+
+	rows, err := tx.CopyFrom(ctx, pgx.Identifier{stagingTable}, append([]string{lineColumn, unknownColumn}, cols...), src)
+	if err != nil {
+		if errors.Is(err, ErrInvalidBody) {
+			return importResult{}, err //nolint:exhaustruct
+		}
+
+		return importResult{}, fmt.Errorf("could not copy rows: %w", err) //nolint:exhaustruct
+	}
+
+	fieldErrs, err := s.checkStaged(ctx, tx, cols, types)
+	if err != nil {
+		return importResult{}, err //nolint:exhaustruct
+	}
+
+	// the values are cast to compare them, which only works once they are known to be valid
+	if len(fieldErrs) == 0 && opts.onConflict == onConflictUpdate {
+		fieldErrs, err = s.checkDuplicates(ctx, tx, cols, types, opts.conflictTarget)
+		if err != nil {
+			return importResult{}, err //nolint:exhaustruct
+		}
+	}
+
+	if len(fieldErrs) > 0 {
+		return importResult{Rows: rows, Imported: 0, Errors: nil}, fieldErrs
+	}
+
+	fields := slices.Clone(cols)
+	values := make([]string, len(cols))
+
+	for i, col := range cols {
+		values[i] = quoteIdentifier(col) + "::" + types[col]
+	}
+
+	assignedFields, args, err := s.rel.assign(ctx, opCreate)
+	if err != nil {
+		return importResult{}, err //nolint:exhaustruct
+	}
+
+	for i, field := range assignedFields {
+		fields = append(fields, field)
+		values = append(values, fmt.Sprintf("$%d", i+1))
+	}
+
+	onConflict, conflictArgs, err := s.onConflict(ctx, cols, opts, len(args))
+	if err != nil {
+		return importResult{}, err //nolint:exhaustruct
+	}
+
+	args = append(args, conflictArgs...)
+
+	// the written rows are recorded in the same statement
+	records := ""
+
+	if outbox := s.outboxImported(rowsAlias, &args); outbox != "" {
+		records += ",\n" + outbox
+	}
+
+	if audit := s.auditImported(ctx, rowsAlias, &args); audit != "" {
+		records += ",\n" + audit
+	}
+
+	qry := fmt.Sprintf(`WITH %[1]s AS (
+		INSERT INTO %[2]s AS _dbx ( %[3]s )
+		SELECT %[4]s FROM %[5]s ORDER BY %[6]s
+		%[7]s
+		RETURNING %[8]s
+		)%[9]s
+		SELECT count(*) FROM %[1]s`,
+		rowsAlias,
+		s.rel.identifier(),
+		strings.Join(quoteIdentifiers(fields), ", "),
+		strings.Join(values, ", "),
+		stagingTable,
+		lineColumn,
+		onConflict,
+		s.importReturning(),
+		records,
+	)
+
+	slog.InfoContext(ctx, "ready to query db", "query", qry)
+
+	var imported int64
+
+	err = tx.QueryRow(ctx, qry, args...).Scan(&imported)
+	if err != nil {
+		return importResult{Rows: rows, Imported: 0, Errors: nil}, mergeError(err)
+	}
+
+	return importResult{Rows: rows, Imported: imported, Errors: nil}, nil
+}
+
+// importReturning returns the RETURNING list of the rows written by an import:
+// the id and whether the row was inserted, the row after the write for the outbox and audit log,
+// and the row before the write for the audit log.
+// The row before an update is the one locked by the update, so no other write comes in between.
+func (s *CRUDHandler) importReturning() string {
+	items := []string{s.rel.keyText("_dbx") + " AS id", "(_dbx.xmax = 0) AS inserted"}
+
+	if s.outbox != nil || s.rel.AuditTable != "" {
+		items = append(items, s.rel.rowJSON("_dbx")+" AS new")
+	}
+
+	if s.rel.AuditTable == "" {
+		return strings.Join(items, ", ")
+	}
+
+	items = append(items, "CASE WHEN _dbx.xmax = 0 THEN NULL ELSE "+s.rel.rowJSON("_dbx_old")+" END AS old")
+
+	return "WITH (OLD AS _dbx_old) " + strings.Join(items, ", ")
+}
+
+// columnTypes returns the sql types of the columns of the relation.
+func (s *CRUDHandler) columnTypes(ctx context.Context, tx pgx.Tx) (map[string]string, error) {
+	rows, err := tx.Query(ctx, `SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+		FROM pg_attribute AS a
+		WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped`, s.rel.identifier())
+	if err != nil {
+		return nil, fmt.Errorf("could not read column types: %w", err)
+	}
+
+	types := map[string]string{}
+
+	for rows.Next() {
+		var name, typ string
+
+		err = rows.Scan(&name, &typ)
+		if err != nil {
+			return nil, fmt.Errorf("could not read column types: %w", err)
+		}
+
+		types[name] = typ
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("could not read column types: %w", rows.Err())
+	}
+
+	return types, nil
+}
+
+// checkStaged returns the first importErrorLimit errors in the staging table,
+// from unknown fields and from values that are not valid for the type of their column.
+func (s *CRUDHandler) checkStaged(
+	ctx context.Context, tx pgx.Tx, cols []string, types map[string]string,
+) (FieldErrors, error) {
+	checks := []string{fmt.Sprintf(`SELECT %[1]s, %[2]s AS field, 'unknown field' AS reason
+		FROM %[3]s WHERE %[2]s IS NOT NULL`, lineColumn, unknownColumn, stagingTable)}
+
+	for _, col := range cols {
+		checks = append(checks, fmt.Sprintf(`SELECT %[1]s, %[2]s, (pg_input_error_info(%[3]s, %[4]s)).message
+			FROM %[5]s WHERE %[3]s IS NOT NULL AND NOT pg_input_is_valid(%[3]s, %[4]s)`,
+			lineColumn, quoteLiteral(col), quoteIdentifier(col), quoteLiteral(types[col]), stagingTable))
+	}
+
+	qry := fmt.Sprintf(`SELECT %[1]s, field, reason FROM ( %[2]s ) AS _dbx_errors ORDER BY %[1]s, field LIMIT %[3]d`,
+		lineColumn, strings.Join(checks, " UNION ALL "), importErrorLimit)
+
+	rows, err := tx.Query(ctx, qry)
+	if err != nil {
+		return nil, fmt.Errorf("could not check rows: %w", err)
+	}
+
+	var errs FieldErrors
+
+	for rows.Next() {
+		var fieldErr FieldError
+
+		err = rows.Scan(&fieldErr.Line, &fieldErr.Field, &fieldErr.Reason)
+		if err != nil {
+			return nil, fmt.Errorf("could not check rows: %w", err)
+		}
+
+		errs = append(errs, fieldErr)
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("could not check rows: %w", rows.Err())
+	}
+
+	return errs, nil
+}
+
+// checkDuplicates returns the first importErrorLimit rows in the staging table
+// with the same values in the target columns as a row on an earlier line.
+// Postgres cannot update a row twice in one statement, so updates on conflict fail on them.
+// Rows with nulls never conflict, and neither do rows where a column of target is not in cols.
+func (s *CRUDHandler) checkDuplicates(
+	ctx context.Context, tx pgx.Tx, cols []string, types map[string]string, target []string,
+) (FieldErrors, error) {
+	values := make([]string, len(target))
+	nonNull := make([]string, len(target))
+
+	for i, col := range target {
+		if !slices.Contains(cols, col) {
+			return nil, nil
+		}
+
+		values[i] = quoteIdentifier(col) + "::" + types[col]
+		nonNull[i] = quoteIdentifier(col) + " IS NOT NULL"
+	}
+
+	qry := fmt.Sprintf(`SELECT _dbx_duplicate.line, _dbx_duplicates.first
+		FROM (
+			SELECT (array_agg(%[1]s ORDER BY %[1]s))[2:] AS lines, min(%[1]s) AS first
+			FROM %[2]s WHERE %[3]s GROUP BY %[4]s HAVING count(*) > 1
+		) AS _dbx_duplicates, unnest(_dbx_duplicates.lines) AS _dbx_duplicate(line)
+		ORDER BY _dbx_duplicate.line LIMIT %[5]d`,
+		lineColumn, stagingTable, strings.Join(nonNull, " AND "), strings.Join(values, ", "), importErrorLimit)
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	rows, err := tx.Query(ctx, qry)
+	if err != nil {
+		return nil, fmt.Errorf("could not check rows: %w", err)
+	}
+
+	var errs FieldErrors
+
+	for rows.Next() {
+		var line, first int64
+
+		err = rows.Scan(&line, &first)
+		if err != nil {
+			return nil, fmt.Errorf("could not check rows: %w", err)
+		}
+
+		errs = append(errs, FieldError{
+			Field:  strings.Join(target, ","),
+			Reason: fmt.Sprintf("same value as line %d", first),
+			Line:   line,
+		})
+	}
+
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("could not check rows: %w", rows.Err())
+	}
+
+	return errs, nil
+}
+
+// mergeError returns the error of inserting the staged rows.
+// Integrity constraint violations, such as unique, not null, foreign key and check constraints,
+// and rows that update the same row twice, are errors in the body, so they are FieldErrors.
+// Postgres reports the first one only, without its line.
+func mergeError(err error) error {
+	var pgErr *pgconn.PgError
+
+	// class 23 is integrity constraint violations, and 21000 is a row updated twice
+	if !errors.As(err, &pgErr) || (!strings.HasPrefix(pgErr.Code, "23") && pgErr.Code != "21000") {
+		return fmt.Errorf("could not import rows: %w", err)
+	}
+
+	field := pgErr.ColumnName
+	if field == "" {
+		field = pgErr.ConstraintName
+	}
+
+	return FieldErrors{{Field: field, Reason: pgErr.Message, Line: 0}}
+}
+
+// onConflict returns the ON CONFLICT clause of an import, and its arguments.
+// Updates only set the columns that can be updated, and server-assigned columns for updates.
+// Soft-deleted rows are not updated, as with PATCH.
+// argOffset is the number of arguments before the ones of the clause.
+func (s *CRUDHandler) onConflict(
+	ctx context.Context, cols []string, opts importOptions, argOffset int,
+) (string, []any, error) {
+	target := ""
+	if len(opts.conflictTarget) > 0 {
+		target = "( " + strings.Join(quoteIdentifiers(opts.conflictTarget), ", ") + " ) "
+	}
+
+	switch opts.onConflict {
+	case "":
+		return "", nil, nil
+	case onConflictIgnore:
+		return "ON CONFLICT " + target + "DO NOTHING", nil, nil
+	}
+
+	var set []string
+
+	for _, col := range cols {
+		if s.rel.fieldViolation(opUpdate, col) == "" && !slices.Contains(opts.conflictTarget, col) {
+			set = append(set, fmt.Sprintf("%[1]s = EXCLUDED.%[1]s", quoteIdentifier(col)))
+		}
+	}
+
+	assignedFields, args, err := s.rel.assign(ctx, opUpdate)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for i, field := range assignedFields {
+		set = append(set, fmt.Sprintf("%s = $%d", quoteIdentifier(field), argOffset+i+1))
+	}
+
+	if len(set) == 0 {
+		return "ON CONFLICT " + target + "DO NOTHING", nil, nil
+	}
+
+	clause := "ON CONFLICT " + target + "DO UPDATE SET " + strings.Join(set, ", ")
+	if s.rel.SoftDelete.Column != "" {
+		clause += " WHERE " + s.rel.visible("_dbx", false)
+	}
+
+	return clause, args, nil
+}
@@ -0,0 +1,158 @@
+package dbx
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestImportSource(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantColumns []string
+		wantValues  [][]any
+		wantErr     error
+	}{
+		{
+			name:        "csv",
+			contentType: "text/csv",
+			body:        "rkey,my_int\r\nRSK-1,1\n\"a,\"\"b\"\"\",\n",
+			wantColumns: []string{"rkey", "my_int"},
+			wantValues: [][]any{
+				{int64(2), nil, "RSK-1", "1"},
+				{int64(3), nil, `a,"b"`, nil},
+			},
+		},
+		{
+			name:        "csv delimiter",
+			contentType: `text/csv; delimiter=";"`,
+			body:        "rkey;my_int\nRSK-1;1\n",
+			wantColumns: []string{"rkey", "my_int"},
+			wantValues:  [][]any{{int64(2), nil, "RSK-1", "1"}},
+		},
+		{
+			name:        "csv with wrong number of fields",
+			contentType: "text/csv",
+			body:        "rkey,my_int\nRSK-1\n",
+			wantColumns: []string{"rkey", "my_int"},
+			wantErr:     ErrInvalidBody,
+		},
+		{
+			name:        "ndjson",
+			contentType: "application/x-ndjson",
+			body:        "{\"rkey\":\"RSK-1\",\"my_int\":1}\n\n{\"rkey\":null,\"is_fun\":true}\n",
+			wantColumns: []string{"my_int", "rkey"},
+			wantValues: [][]any{
+				{int64(1), nil, "1", "RSK-1"},
+				{int64(3), "is_fun", nil, nil},
+			},
+		},
+		{
+			name:        "ndjson with something else than objects",
+			contentType: "application/x-ndjson",
+			body:        "{\"rkey\":\"RSK-1\"}\n[1]\n",
+			wantColumns: []string{"rkey"},
+			wantValues:  [][]any{{int64(1), nil, "RSK-1"}},
+			wantErr:     ErrInvalidBody,
+		},
+		{
+			name:        "unsupported media type",
+			contentType: "application/json",
+			body:        "[]",
+			wantErr:     ErrUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			src, err := newImportSource(tt.contentType, strings.NewReader(tt.body))
+			if err != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("newImportSource() error = %v, wantErr %v", err, tt.wantErr)
+				}
+
+				return
+			}
+
+			if !reflect.DeepEqual(src.columns(), tt.wantColumns) {
+				t.Errorf("columns() = %v, want %v", src.columns(), tt.wantColumns)
+			}
+
+			var values [][]any
+
+			for src.Next() {
+				row, err := src.Values()
+				if err != nil {
+					t.Fatalf("Values() error = %v", err)
+				}
+
+				values = append(values, slices.Clone(row))
+			}
+
+			if !errors.Is(src.Err(), tt.wantErr) {
+				t.Errorf("Err() = %v, wantErr %v", src.Err(), tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(values, tt.wantValues) {
+				t.Errorf("values = %v, want %v", values, tt.wantValues)
+			}
+		})
+	}
+}
+
+func TestMergeError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		err       error
+		wantField string
+		wantUnpr  bool
+	}{
+		{
+			name:      "unique",
+			err:       &pgconn.PgError{Code: "23505", Message: "duplicate key", ConstraintName: "resource_rkey_key"}, //nolint:exhaustruct
+			wantField: "resource_rkey_key",
+			wantUnpr:  true,
+		},
+		{
+			name:      "not null",
+			err:       &pgconn.PgError{Code: "23502", Message: "null value", ColumnName: "rkey"}, //nolint:exhaustruct
+			wantField: "rkey",
+			wantUnpr:  true,
+		},
+		{
+			name:     "updated twice",
+			err:      &pgconn.PgError{Code: "21000", Message: "cannot affect row a second time"}, //nolint:exhaustruct
+			wantUnpr: true,
+		},
+		{name: "other", err: &pgconn.PgError{Code: "53100"}}, //nolint:exhaustruct
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := mergeError(fmt.Errorf("wrapped: %w", tt.err))
+			if got := errors.Is(err, ErrUnprocessable); got != tt.wantUnpr {
+				t.Fatalf("got %v, want unprocessable %v", err, tt.wantUnpr)
+			}
+
+			var fieldErrs FieldErrors
+			if errors.As(err, &fieldErrs) && fieldErrs[0].Field != tt.wantField {
+				t.Errorf("got field %q, want %q", fieldErrs[0].Field, tt.wantField)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package dbx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// Introspection
+//
+// A relation can be a table or a view, and views take only some writes, or none.
+// Introspect finds the writes a relation takes, and the handler responds 405 Method Not Allowed to the others.
+
+// Bits of pg_relation_is_updatable, which are 1 << the CmdType of each write.
+const (
+	updatableUpdate = 1 << 2
+	updatableInsert = 1 << 3
+	updatableDelete = 1 << 4
+)
+
+// writes are the writes that a relation takes.
+type writes struct {
+	insert bool
+	update bool
+	delete bool
+}
+
+// allWrites are the writes of tables, which are assumed until a relation is introspected.
+var allWrites = writes{insert: true, update: true, delete: true} //nolint:gochecknoglobals
+
+// Introspect finds the writes that the relation takes and the unique columns it can be looked up by,
+// and checks that it has the key columns.
+// Tables take every write, auto-updatable views take the writes Postgres can pass on to the table,
+// views with INSTEAD OF triggers take the writes they have triggers for, and other views are read-only.
+// Error is ErrNotFound if the relation does not exist, and ErrUnprocessable if it lacks a key column.
+func (s *CRUDHandler) Introspect(ctx context.Context) error {
+	qry := `SELECT c.oid, c.relkind::text, pg_relation_is_updatable(c.oid, false), pg_relation_is_updatable(c.oid, true),
+			(
+				SELECT count(*) FROM pg_catalog.pg_attribute AS a
+				WHERE a.attrelid = c.oid AND a.attname = ANY($3) AND a.attnum > 0 AND NOT a.attisdropped
+			) = cardinality($3::text[])
+		FROM pg_catalog.pg_class AS c
+		JOIN pg_catalog.pg_namespace AS n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relname = $2`
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	var (
+		oid                     uint32
+		kind                    string
+		automatic, withTriggers int
+		hasKey                  bool
+	)
+
+	err := s.db.QueryRow(ctx, qry, s.rel.Schema, s.rel.Name, s.rel.keyNames()).Scan(&oid, &kind, &automatic, &withTriggers, &hasKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: relation %s.%s does not exist", ErrNotFound, s.rel.Schema, s.rel.Name)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not introspect %s: %w", s.rel.Name, err)
+	}
+
+	if !hasKey {
+		return fmt.Errorf("%w: %s lacks a key column of %s, declare the Key of the relation",
+			ErrUnprocessable, s.rel.Name, strings.Join(s.rel.keyNames(), ", "))
+	}
+
+	s.view = kind == "v"
+	s.writes = writes{
+		insert: withTriggers&updatableInsert != 0,
+		update: withTriggers&updatableUpdate != 0,
+		delete: withTriggers&updatableDelete != 0,
+	}
+
+	err = s.introspectLookups(ctx, oid)
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "introspected relation",
+		"relation", s.rel.Name,
+		"kind", relationKind(kind, automatic, withTriggers),
+		"insert", s.writes.insert,
+		"update", s.writes.update,
+		"delete", s.writes.delete,
+		"lookups", len(s.lookups))
+
+	return nil
+}
+
+// relationKind describes a relation from its pg_class.relkind,
+// and what pg_relation_is_updatable returns without and with triggers.
+func relationKind(relkind string, automatic, withTriggers int) string {
+	switch {
+	case relkind != "v":
+		return "table"
+	case automatic != 0:
+		return "auto-updatable view"
+	case withTriggers != 0:
+		return "view with INSTEAD OF triggers"
+	default:
+		return "read-only view"
+	}
+}
+
+// takes returns true if the relation takes the write.
+func (s *CRUDHandler) takes(write string) bool {
+	switch write {
+	case writeInsert:
+		return s.writes.insert
+	case writeUpdate:
+		return s.writes.update
+	case writeDelete:
+		return s.writes.delete
+	default:
+		return false
+	}
+}
+
+// deleteWrite returns the write that deletes resources, which is an update with soft delete.
+func (s *CRUDHandler) deleteWrite() string {
+	if s.rel.SoftDelete.Column != "" {
+		return writeUpdate
+	}
+
+	return writeDelete
+}
+
+// collectionMethods returns the methods allowed on the collection.
+func (s *CRUDHandler) collectionMethods() []string {
+	methods := []string{http.MethodGet, http.MethodHead}
+	if s.takes(writeInsert) {
+		methods = append(methods, http.MethodPost)
+	}
+
+	return methods
+}
+
+// itemMethods returns the methods allowed on a resource.
+func (s *CRUDHandler) itemMethods() []string {
+	methods := []string{http.MethodGet, http.MethodHead}
+	if s.takes(writeUpdate) {
+		methods = append(methods, http.MethodPatch)
+	}
+
+	if s.takes(s.deleteWrite()) {
+		methods = append(methods, http.MethodDelete)
+	}
+
+	return methods
+}
+
+// noMethods returns no methods, for paths that only take a write.
+func noMethods() []string {
+	return nil
+}
+
+// requires returns a handler that calls next if the relation takes the write.
+// Otherwise, it responds 405 Method Not Allowed, with the methods that allow returns.
+func (s *CRUDHandler) requires(write string, allow func() []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !s.takes(write) {
+			w.Header().Set(header.NameAllow, strings.Join(allow(), ", "))
+			writeProblem(w, Problem{ //nolint:exhaustruct
+				Status: http.StatusMethodNotAllowed,
+				Detail: fmt.Sprintf("%s does not take %ss", s.rel.Name, write),
+			})
+
+			return
+		}
+
+		next(w, req)
+	}
+}
@@ -0,0 +1,84 @@
+package dbx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+func TestRequires(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		writes     writes
+		softDelete bool
+		method     string
+		path       string
+		wantStatus int
+		wantAllow  string
+	}{
+		{
+			name:       "table",
+			writes:     allWrites,
+			method:     http.MethodDelete,
+			path:       "/1",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "read-only view",
+			writes:     writes{insert: false, update: false, delete: false},
+			method:     http.MethodPost,
+			path:       "/",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantAllow:  "GET, HEAD",
+		},
+		{
+			name:       "view without delete",
+			writes:     writes{insert: true, update: true, delete: false},
+			method:     http.MethodDelete,
+			path:       "/1",
+			wantStatus: http.StatusMethodNotAllowed,
+			wantAllow:  "GET, HEAD, PATCH",
+		},
+		{
+			name:       "soft delete is an update",
+			writes:     writes{insert: false, update: true, delete: false},
+			softDelete: true,
+			method:     http.MethodDelete,
+			path:       "/1",
+			wantStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rel := Relation{Schema: "s", Name: "n"} //nolint:exhaustruct
+			if tt.softDelete {
+				rel.SoftDelete.Column = "deleted_at"
+			}
+
+			s := &CRUDHandler{rel: rel, writes: tt.writes} //nolint:exhaustruct
+
+			mux := http.NewServeMux()
+			ok := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) }
+			mux.HandleFunc("POST /", s.requires(writeInsert, s.collectionMethods, ok))
+			mux.HandleFunc("DELETE /{id}", s.requires(s.deleteWrite(), s.itemMethods, ok))
+
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			if got := rec.Header().Get(header.NameAllow); got != tt.wantAllow {
+				t.Errorf("got Allow %q, want %q", got, tt.wantAllow)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package dbx
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Keys
+//
+// Resources are identified by the key columns of their relation, which are the {id} of paths.
+// Composite keys are the values in key column order separated by commas, as in /resource/1,abc,
+// or matrix parameters in any order, as in /resource/;a=1;b=abc.
+
+// KeyType is the type of a key column, which decides what valid keys look like.
+type KeyType string
+
+const (
+	// KeyInt is an integer key, such as a bigint identity.
+	KeyInt KeyType = "int"
+	// KeyUUID is a uuid key, in the 8-4-4-4-12 hex format.
+	KeyUUID KeyType = "uuid"
+	// KeyText is a text key. Text in composite keys cannot have commas or semicolons.
+	KeyText KeyType = "text"
+)
+
+// ErrInvalidKey is returned when the key in a path does not fit the key columns of the relation - HTTP 400.
+var ErrInvalidKey = errors.New("invalid key")
+
+// uuidPattern matches uuids in the 8-4-4-4-12 hex format, in any case.
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// KeyColumn is a column of the key of a relation.
+type KeyColumn struct {
+	// Name is the name of the column
+	Name string
+
+	// Type is the type of the column
+	Type KeyType
+}
+
+// defaultKey is the key of relations that do not declare one.
+//
+//nolint:gochecknoglobals
+var defaultKey = []KeyColumn{{Name: "id", Type: KeyInt}}
+
+// keyValue is the key of a resource, with a value for each key column, in order.
+type keyValue []string
+
+// String returns the key as it is in paths, before escaping.
+// It identifies the resource in the outbox, the audit log and events.
+func (k keyValue) String() string {
+	return strings.Join(k, ",")
+}
+
+// path returns the key as a path segment.
+func (k keyValue) path() string {
+	escaped := make([]string, len(k))
+	for i, v := range k {
+		escaped[i] = url.PathEscape(v)
+	}
+
+	return strings.Join(escaped, ",")
+}
+
+// parse returns value in the canonical format of the column type.
+// Error is ErrInvalidKey if value does not fit the type.
+func (c KeyColumn) parse(value string) (string, error) {
+	switch c.Type {
+	case KeyInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s must be an integer", ErrInvalidKey, c.Name)
+		}
+
+		return strconv.FormatInt(n, 10), nil
+	case KeyUUID:
+		if !uuidPattern.MatchString(value) {
+			return "", fmt.Errorf("%w: %s must be a uuid", ErrInvalidKey, c.Name)
+		}
+
+		return strings.ToLower(value), nil
+	case KeyText:
+		if value == "" {
+			return "", fmt.Errorf("%w: %s must not be empty", ErrInvalidKey, c.Name)
+		}
+
+		return value, nil
+	default:
+		return "", fmt.Errorf("%w: %s has the unknown key type %s", ErrInvalidKey, c.Name, c.Type)
+	}
+}
+
+// keyColumns returns the key columns of the relation.
+func (r Relation) keyColumns() []KeyColumn {
+	if len(r.Key) == 0 {
+		return defaultKey
+	}
+
+	return r.Key
+}
+
+// keyNames returns the names of the key columns of the relation.
+func (r Relation) keyNames() []string {
+	cols := r.keyColumns()
+
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.Name
+	}
+
+	return names
+}
+
+// parseKey returns the key in a path segment, which is the values of the key columns separated by commas,
+// or matrix parameters starting with a semicolon.
+// Error is ErrInvalidKey if the segment does not fit the key columns.
+func (r Relation) parseKey(segment string) (keyValue, error) {
+	cols := r.keyColumns()
+
+	var values []string
+
+	switch {
+	case strings.HasPrefix(segment, ";"):
+		params := map[string]string{}
+
+		for param := range strings.SplitSeq(segment[1:], ";") {
+			name, value, ok := strings.Cut(param, "=")
+			if !ok {
+				return nil, fmt.Errorf("%w: matrix parameter %s has no value", ErrInvalidKey, param)
+			}
+
+			params[name] = value
+		}
+
+		for _, col := range cols {
+			value, ok := params[col.Name]
+			if !ok {
+				return nil, fmt.Errorf("%w: missing %s", ErrInvalidKey, col.Name)
+			}
+
+			values = append(values, value)
+			delete(params, col.Name)
+		}
+
+		for name := range params {
+			return nil, fmt.Errorf("%w: %s is not a key column", ErrInvalidKey, name)
+		}
+	case len(cols) == 1:
+		values = []string{segment}
+	default:
+		values = strings.Split(segment, ",")
+		if len(values) != len(cols) {
+			return nil, fmt.Errorf("%w: want %d values separated by commas, for %s",
+				ErrInvalidKey, len(cols), strings.Join(r.keyNames(), ", "))
+		}
+	}
+
+	key := make(keyValue, len(cols))
+
+	for i, col := range cols {
+		value, err := col.parse(values[i])
+		if err != nil {
+			return nil, err
+		}
+
+		key[i] = value
+	}
+
+	return key, nil
+}
+
+// keyWhere returns the condition for the row alias having key, and appends the values to args.
+func (r Relation) keyWhere(alias string, key keyValue, args *[]any) string {
+	conds := make([]string, len(key))
+
+	for i, name := range r.keyNames() {
+		*args = append(*args, key[i])
+		conds[i] = alias + "." + quoteIdentifier(name) + " = $" + strconv.Itoa(len(*args))
+	}
+
+	return strings.Join(conds, " AND ")
+}
+
+// keyEquals returns the condition for the row aliases left and right having the same key.
+func (r Relation) keyEquals(left, right string) string {
+	names := r.keyNames()
+
+	conds := make([]string, len(names))
+	for i, name := range names {
+		conds[i] = left + "." + quoteIdentifier(name) + " = " + right + "." + quoteIdentifier(name)
+	}
+
+	return strings.Join(conds, " AND ")
+}
+
+// keyText returns the sql expression for the key of the row alias as text, as keyValue.String.
+func (r Relation) keyText(alias string) string {
+	return "concat_ws(',', " + strings.Join(r.keyItems(alias), ", ") + ")"
+}
+
+// keyArray returns the sql expression for the key of the row alias as a text array, which scans into keyValue.
+func (r Relation) keyArray(alias string) string {
+	return "ARRAY[" + strings.Join(r.keyItems(alias), ", ") + "]::text[]"
+}
+
+// keyItems returns the key columns of the row alias as text.
+func (r Relation) keyItems(alias string) []string {
+	names := r.keyNames()
+
+	items := make([]string, len(names))
+	for i, name := range names {
+		items[i] = alias + "." + quoteIdentifier(name) + "::text"
+	}
+
+	return items
+}
@@ -0,0 +1,94 @@
+package dbx
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	t.Parallel()
+
+	composite := []KeyColumn{{Name: "team_id", Type: KeyUUID}, {Name: "username", Type: KeyText}}
+
+	tests := []struct {
+		name    string
+		key     []KeyColumn
+		segment string
+		want    keyValue
+		wantErr error
+	}{
+		{name: "default", key: nil, segment: "42", want: keyValue{"42"}},
+		{name: "not an integer", key: nil, segment: "abc", wantErr: ErrInvalidKey},
+		{
+			name:    "uuid in upper case",
+			key:     []KeyColumn{{Name: "id", Type: KeyUUID}},
+			segment: "0190F2A4-7C1E-7D3A-9B1E-2F3C4D5E6F70",
+			want:    keyValue{"0190f2a4-7c1e-7d3a-9b1e-2f3c4d5e6f70"},
+		},
+		{name: "not a uuid", key: []KeyColumn{{Name: "id", Type: KeyUUID}}, segment: "123", wantErr: ErrInvalidKey},
+		{name: "text with comma", key: []KeyColumn{{Name: "name", Type: KeyText}}, segment: "a,b", want: keyValue{"a,b"}},
+		{
+			name:    "composite",
+			key:     composite,
+			segment: "0190f2a4-7c1e-7d3a-9b1e-2f3c4d5e6f70,alice",
+			want:    keyValue{"0190f2a4-7c1e-7d3a-9b1e-2f3c4d5e6f70", "alice"},
+		},
+		{name: "composite with too few values", key: composite, segment: "alice", wantErr: ErrInvalidKey},
+		{
+			name:    "matrix parameters",
+			key:     composite,
+			segment: ";username=alice;team_id=0190f2a4-7c1e-7d3a-9b1e-2f3c4d5e6f70",
+			want:    keyValue{"0190f2a4-7c1e-7d3a-9b1e-2f3c4d5e6f70", "alice"},
+		},
+		{name: "missing matrix parameter", key: composite, segment: ";username=alice", wantErr: ErrInvalidKey},
+		{
+			name:    "unknown matrix parameter",
+			key:     composite,
+			segment: ";username=alice;team_id=0190f2a4-7c1e-7d3a-9b1e-2f3c4d5e6f70;role=admin",
+			wantErr: ErrInvalidKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rel := Relation{Schema: "s", Name: "n", Key: tt.key} //nolint:exhaustruct
+
+			got, err := rel.parseKey(tt.segment)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyWhere(t *testing.T) {
+	t.Parallel()
+
+	rel := Relation{ //nolint:exhaustruct
+		Schema: "s",
+		Name:   "n",
+		Key:    []KeyColumn{{Name: "a", Type: KeyInt}, {Name: "b", Type: KeyText}},
+	}
+
+	args := []any{"first"}
+
+	got := rel.keyWhere("_dbx", keyValue{"1", "x"}, &args)
+	if want := `_dbx."a" = $2 AND _dbx."b" = $3`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if !slices.Equal(args, []any{"first", "1", "x"}) {
+		t.Errorf("got args %v", args)
+	}
+
+	if got, want := (keyValue{"1", "a/b"}).path(), "1,a%2Fb"; got != want {
+		t.Errorf("got path %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,223 @@
+package dbx
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// cursorBatchSize is the number of rows fetched at a time from list cursors.
+const cursorBatchSize = 1000
+
+// cursorName is the name of the server-side cursor used for lists.
+// Cursors live until the end of the transaction, and lists use a transaction each.
+const cursorName = "_dbx_cursor"
+
+// listRows returns the common table expression with the rows matching q,
+// and the arguments it needs.
+// Each row has the metadata columns and its position in the list as _dbx_ord.
+func (s *CRUDHandler) listRows(q Query) (string, []any, error) {
+	args := []any{}
+
+	where, err := q.where("_dbx", &args)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cte := fmt.Sprintf(`WITH %[1]s AS (
+			SELECT _dbx.*, %[2]s, row_number() OVER (ORDER BY %[5]s) AS _dbx_ord
+			FROM %[3]s AS _dbx
+			WHERE %[4]s
+			ORDER BY %[5]s%[6]s
+		)`,
+		rowsAlias,
+		s.rel.metaSelect("_dbx"),
+		s.rel.identifier(),
+		where+" AND "+s.rel.visible("_dbx", q.IncludeDeleted),
+		q.orderBy("_dbx", s.rel.keyNames()...),
+		q.limitOffset(),
+	)
+
+	return cte, args, nil
+}
+
+// cursored returns true if the list of resources matching q is read through a cursor,
+// since it can be longer than cursorBatchSize.
+func cursored(q Query) bool {
+	return q.Limit <= 0 || q.Limit > cursorBatchSize
+}
+
+// representationKey returns what the representation of a list depends on besides its rows,
+// which is the query, the metadata object and the media type.
+func representationKey(q Query, opts responseOptions) string {
+	return q.String() + "&" + metaQueryParam + "=" + strconv.FormatBool(opts.meta) + "#" + opts.contentType()
+}
+
+// collectionETag returns the entity tag of the list of resources matching q, or "" if the list has none.
+// It is a digest of the ordered entity tags of the members and the query itself,
+// so it changes when a member changes, or when members are added, removed or reordered.
+// Cursored lists would be read twice that way, so they use cursoredETag instead.
+// Collection etags are weak, since they are not computed from the representation.
+func (s *CRUDHandler) collectionETag(ctx context.Context, tx pgx.Tx, q Query, opts responseOptions) (string, error) {
+	if cursored(q) {
+		return s.cursoredETag(ctx, tx, q, opts)
+	}
+
+	cte, args, err := s.listRows(q)
+	if err != nil {
+		return "", err
+	}
+
+	args = append(args, representationKey(q, opts))
+
+	qry := fmt.Sprintf(`%[1]s
+		SELECT md5(coalesce(string_agg(%[2]s.%[3]s, ',' ORDER BY %[2]s._dbx_ord), '') || $%[4]d::text)
+		FROM %[2]s`,
+		cte,
+		rowsAlias,
+		etagAlias,
+		len(args),
+	)
+
+	return s.queryETag(ctx, tx, qry, args)
+}
+
+// cursoredETag returns the entity tag of a cursored list, which is a digest of the count and the newest xmin
+// of the rows matching q, regardless of limit and offset, and the query itself.
+// Writes give rows a newer xmin and deletes change the count, so it changes when the list does, and sometimes when not.
+// Views have no xmin, so their cursored lists have no entity tag.
+func (s *CRUDHandler) cursoredETag(ctx context.Context, tx pgx.Tx, q Query, opts responseOptions) (string, error) {
+	if s.view {
+		return "", nil
+	}
+
+	args := []any{}
+
+	where, err := q.where("_dbx", &args)
+	if err != nil {
+		return "", err
+	}
+
+	args = append(args, representationKey(q, opts))
+
+	qry := fmt.Sprintf(`SELECT md5(count(*)::text || ':' || coalesce(max(_dbx.xmin::text::bigint), 0)::text || $%[3]d::text)
+		FROM %[1]s AS _dbx
+		WHERE %[2]s`,
+		s.rel.identifier(),
+		where+" AND "+s.rel.visible("_dbx", q.IncludeDeleted),
+		len(args),
+	)
+
+	return s.queryETag(ctx, tx, qry, args)
+}
+
+// queryETag runs qry, which returns a collection etag.
+func (s *CRUDHandler) queryETag(ctx context.Context, tx pgx.Tx, qry string, args []any) (string, error) {
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	var etag string
+
+	err := tx.QueryRow(ctx, qry, args...).Scan(&etag)
+	if err != nil {
+		return "", fmt.Errorf("could not compute collection etag: %w", err)
+	}
+
+	return etag, nil
+}
+
+// list writes the resources matching q to rw as rows arrive, so that memory stays bounded.
+// Lists that can be longer than cursorBatchSize are read through a server-side cursor,
+// fetching cursorBatchSize rows at a time.
+// Errors after the first row has been written abort the response, since the status is already sent.
+func (s *CRUDHandler) list(ctx context.Context, tx pgx.Tx, rw *representationWriter, q Query) error {
+	cte, args, err := s.listRows(q)
+	if err != nil {
+		return err
+	}
+
+	qry := fmt.Sprintf(`%[1]s
+		SELECT _dbx_list._response
+		FROM ( SELECT %[3]s, %[2]s._dbx_ord FROM %[2]s ) AS _dbx_list
+		ORDER BY _dbx_list._dbx_ord`,
+		cte,
+		rowsAlias,
+		s.rel.responseSelect(q.Select, rw.opts),
+	)
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	err = streamRows(ctx, tx, rw, cursored(q), qry, args...)
+	if err != nil {
+		return err
+	}
+
+	rw.finish()
+
+	return nil
+}
+
+// streamRows runs qry and writes the representation in each row to rw, without finishing it.
+// With cursor, the rows are fetched cursorBatchSize at a time through a server-side cursor,
+// and the response is flushed after each batch.
+func streamRows(ctx context.Context, tx pgx.Tx, rw *representationWriter, cursor bool, qry string, args ...any) error {
+	if !cursor {
+		_, err := writeRows(ctx, tx, rw, qry, args...)
+
+		return err
+	}
+
+	_, err := tx.Exec(ctx, "DECLARE "+cursorName+" NO SCROLL CURSOR FOR "+qry, args...)
+	if err != nil {
+		return rw.abort(ctx, fmt.Errorf("could not declare cursor: %w", err))
+	}
+
+	fetch := fmt.Sprintf("FETCH FORWARD %d FROM %s", cursorBatchSize, cursorName)
+
+	for {
+		n, err := writeRows(ctx, tx, rw, fetch)
+		if err != nil {
+			return err
+		}
+
+		if n < cursorBatchSize {
+			return nil
+		}
+
+		rw.flush()
+	}
+}
+
+// writeRows runs qry and writes the representation in each row to rw.
+// Returns the number of rows written.
+func writeRows(ctx context.Context, tx pgx.Tx, rw *representationWriter, qry string, args ...any) (int, error) {
+	rows, err := tx.Query(ctx, qry, args...)
+	if err != nil {
+		return 0, rw.abort(ctx, fmt.Errorf("could not list resources: %w", err))
+	}
+	defer rows.Close()
+
+	n := 0
+
+	for rows.Next() {
+		var representation string
+
+		err = rows.Scan(&representation)
+		if err != nil {
+			return n, rw.abort(ctx, fmt.Errorf("could not list resources: %w", err))
+		}
+
+		rw.write(representation)
+		n++
+	}
+
+	// a client disconnect cancels the context, which cancels the query
+	err = rows.Err()
+	if err != nil {
+		return n, rw.abort(ctx, fmt.Errorf("could not list resources: %w", err))
+	}
+
+	return n, nil
+}
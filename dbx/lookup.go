@@ -0,0 +1,348 @@
+package dbx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// Lookups
+//
+// Resources can also be found by the value of a column with a single-column unique constraint,
+// as in /resource/by/rkey/RSK-1. Introspect finds the columns, so relations that are not introspected have none.
+// A lookup resolves to the key of the resource, and the request continues as if it was made with the key.
+
+// introspectLookups finds the readable columns of the relation oid
+// that have a single-column unique or primary key constraint.
+// Constraints cover neither partial nor expression indexes, so those do not qualify.
+func (s *CRUDHandler) introspectLookups(ctx context.Context, oid uint32) error {
+	qry := `SELECT a.attname::text, format_type(a.atttypid, NULL)
+		FROM pg_catalog.pg_constraint AS c
+		JOIN pg_catalog.pg_attribute AS a ON a.attrelid = c.conrelid AND a.attnum = c.conkey[1]
+		WHERE c.conrelid = $1 AND c.contype IN ('p', 'u') AND cardinality(c.conkey) = 1
+		ORDER BY a.attnum`
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	rows, err := s.db.Query(ctx, qry, oid)
+	if err != nil {
+		return fmt.Errorf("could not introspect unique columns of %s: %w", s.rel.Name, err)
+	}
+
+	cols, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (KeyColumn, error) {
+		var name, typ string
+
+		err := row.Scan(&name, &typ)
+
+		return KeyColumn{Name: name, Type: lookupType(typ)}, err //nolint:wrapcheck
+	})
+	if err != nil {
+		return fmt.Errorf("could not introspect unique columns of %s: %w", s.rel.Name, err)
+	}
+
+	readable := s.rel.readable()
+
+	s.lookups = slices.DeleteFunc(cols, func(col KeyColumn) bool {
+		return !slices.Contains(readable, col.Name)
+	})
+
+	return nil
+}
+
+// lookupType returns the key type that values of the Postgres type are checked as.
+func lookupType(typ string) KeyType {
+	switch typ {
+	case "smallint", "integer", "bigint":
+		return KeyInt
+	case "uuid":
+		return KeyUUID
+	default:
+		return KeyText
+	}
+}
+
+// lookupMethods returns the methods allowed on a resource found by a unique column.
+func (s *CRUDHandler) lookupMethods() []string {
+	methods := s.itemMethods()
+	if s.takes(writeInsert) && s.takes(writeUpdate) {
+		methods = append(methods, http.MethodPut)
+	}
+
+	return methods
+}
+
+// lookup returns the unique column and the value in the path of req.
+// Error is ErrNotFound if the column is not unique, and ErrInvalidKey if the value does not fit it.
+func (s *CRUDHandler) lookup(req *http.Request) (KeyColumn, string, error) {
+	name := req.PathValue("column")
+
+	idx := slices.IndexFunc(s.lookups, func(col KeyColumn) bool { return col.Name == name })
+	if idx < 0 {
+		return KeyColumn{}, "", fmt.Errorf("%w: %s cannot be looked up by %s", ErrNotFound, s.rel.Name, name)
+	}
+
+	col := s.lookups[idx]
+
+	value, err := col.parse(req.PathValue("value"))
+	if err != nil {
+		return KeyColumn{}, "", err
+	}
+
+	return col, value, nil
+}
+
+// locate returns the key of the resource in the path of req, from the key or by a unique column.
+// Error is ErrNotFound if no resource has the value of the unique column.
+func (s *CRUDHandler) locate(req *http.Request) (keyValue, error) {
+	if req.PathValue("column") == "" {
+		return s.rel.parseKey(req.PathValue("id"))
+	}
+
+	col, value, err := s.lookup(req)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, err := s.resolve(req.Context(), s.db, col, value, false)
+
+	return key, err
+}
+
+// rowQuerier is a pool or a transaction.
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// resolve returns the key of the row where col has value, and whether the row is soft-deleted.
+// With lock, the row is locked until the end of the transaction of db.
+// Error is ErrNotFound if there is no such row.
+func (s *CRUDHandler) resolve(
+	ctx context.Context, db rowQuerier, col KeyColumn, value string, lock bool,
+) (keyValue, bool, error) {
+	qry := fmt.Sprintf(`SELECT %[1]s, NOT (%[2]s) FROM %[3]s AS _dbx WHERE _dbx.%[4]s = $1`,
+		s.rel.keyArray("_dbx"),
+		s.rel.visible("_dbx", false),
+		s.rel.identifier(),
+		quoteIdentifier(col.Name),
+	)
+
+	if lock {
+		qry += " FOR UPDATE"
+	}
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	var (
+		key     keyValue
+		deleted bool
+	)
+
+	err := db.QueryRow(ctx, qry, value).Scan(&key, &deleted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, fmt.Errorf("%w: no %s with %s %s", ErrNotFound, s.rel.Name, col.Name, value)
+	}
+
+	if err != nil {
+		return nil, false, fmt.Errorf("could not look up %s: %w", s.rel.Name, err)
+	}
+
+	return key, deleted, nil
+}
+
+// put creates or updates the resource where col has value, with the fields of rawJSON,
+// in a single INSERT ... ON CONFLICT, so concurrent puts of a new value create it once.
+// Fields that rawJSON lacks are left as they are on update, as with PATCH, and so are fields that cannot be updated.
+// Returns true if the resource was created.
+// Error is ErrUnprocessable if rawJSON has another value for col, and ErrForbidden if the resource is soft-deleted.
+//
+//nolint:funlen,cyclop
+func (s *CRUDHandler) put(
+	col KeyColumn, value string, req *http.Request, rawJSON *RawJSONObject, prefs preferences, opts responseOptions,
+) (resource, bool, error) {
+	ctx := req.Context()
+
+	if !bodyAgrees(rawJSON, col, value) {
+		return resource{}, false, fmt.Errorf("%w: %s in the body must be %s, as in the path",
+			ErrUnprocessable, col.Name, value)
+	}
+
+	rawJSON.set(col.Name, json.RawMessage(value))
+
+	fields, args, err := s.writeFields(ctx, opCreate, rawJSON, prefs.handling)
+	if err != nil {
+		return resource{}, false, err
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return resource{}, false, fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// an existing row is locked, so it is the row that the preconditions and the audit log see
+	key, deleted, err := s.resolve(ctx, tx, col, value, true)
+	exists := err == nil
+
+	switch {
+	case exists && deleted:
+		return resource{}, false, fmt.Errorf("%w: %s %s is deleted, restore it first", ErrForbidden, col.Name, value)
+	case err != nil && !errors.Is(err, ErrNotFound):
+		return resource{}, false, err
+	}
+
+	conflict := importOptions{onConflict: onConflictUpdate, conflictTarget: []string{col.Name}}
+
+	var oldRow json.RawMessage
+
+	if exists {
+		_, err = s.checkPreconditions(ctx, tx, key, req, false)
+		if err != nil {
+			return resource{}, false, err
+		}
+
+		oldRow, err = s.auditRow(ctx, tx, key)
+		if err != nil {
+			return resource{}, false, err
+		}
+	} else {
+		reqHeaders, err := header.ParseRequest(req.Header)
+		if err != nil {
+			return resource{}, false, err
+		}
+
+		if header.EvaluatePreconditions(reqHeaders, req.Method, nil, nil, false).Status() != 0 {
+			return resource{}, false, fmt.Errorf("%w: conditional headers do not match current resource", ErrPreconditionFailed)
+		}
+
+		// the preconditions held for no resource, so a resource created meanwhile must not be updated
+		if reqHeaders.Conditional() {
+			conflict.onConflict = onConflictIgnore
+		}
+	}
+
+	clause, conflictArgs, err := s.onConflict(ctx, fields, conflict, len(args))
+	if err != nil {
+		return resource{}, false, err
+	}
+
+	args = append(args, conflictArgs...)
+
+	argNums := make([]string, len(fields))
+	for idx := range fields {
+		argNums[idx] = fmt.Sprintf("$%d", idx+1)
+	}
+
+	qry := fmt.Sprintf(`WITH %[1]s AS (
+		INSERT INTO %[2]s AS _dbx ( %[4]s )
+		VALUES ( %[5]s )
+		%[6]s
+		RETURNING _dbx.*, %[3]s, (_dbx.xmax = 0) AS _dbx_inserted
+		)
+		SELECT %[7]s, %[1]s._dbx_inserted FROM %[1]s`,
+		rowsAlias,
+		s.rel.identifier(),
+		s.rel.metaSelect("_dbx"),
+		strings.Join(quoteIdentifiers(fields), ", "),
+		strings.Join(argNums, ", "),
+		clause,
+		s.rel.responseSelect(s.rel.readable(), opts),
+	)
+
+	slog.InfoContext(ctx, "ready to query db", "query", qry)
+
+	var (
+		res      resource
+		inserted bool
+	)
+
+	err = tx.QueryRow(ctx, qry, args...).Scan(&res.response, &res.etag, &res.lastModified, &res.id, &inserted)
+
+	switch {
+	case errors.Is(err, pgx.ErrNoRows) && conflict.onConflict == onConflictIgnore:
+		return resource{}, false, fmt.Errorf("%w: %s %s was created meanwhile", ErrPreconditionFailed, col.Name, value)
+	case errors.Is(err, pgx.ErrNoRows):
+		// nothing could be updated, or the conflicting row is soft-deleted
+		return s.unchanged(ctx, tx, col, value, prefs, opts)
+	case err != nil:
+		return resource{}, false, fmt.Errorf("could not put resource: %w", err)
+	}
+
+	op := writeUpdate
+	if inserted {
+		op, oldRow = writeInsert, nil
+	}
+
+	err = s.recordOutbox(ctx, tx, op, res.id)
+	if err != nil {
+		return resource{}, false, err
+	}
+
+	newRow, err := s.auditRow(ctx, tx, res.id)
+	if err != nil {
+		return resource{}, false, err
+	}
+
+	err = s.recordAudit(ctx, tx, op, res.id, oldRow, newRow)
+	if err != nil {
+		return resource{}, false, err
+	}
+
+	err = prefs.finish(ctx, tx)
+	if err != nil {
+		return resource{}, false, err
+	}
+
+	return res, inserted, nil
+}
+
+// unchanged returns the resource where col has value, after a put that did not write it.
+// Error is ErrForbidden if the resource is soft-deleted.
+func (s *CRUDHandler) unchanged(
+	ctx context.Context, tx pgx.Tx, col KeyColumn, value string, prefs preferences, opts responseOptions,
+) (resource, bool, error) {
+	key, deleted, err := s.resolve(ctx, tx, col, value, false)
+	if err != nil {
+		return resource{}, false, err
+	}
+
+	if deleted {
+		return resource{}, false, fmt.Errorf("%w: %s %s is deleted, restore it first", ErrForbidden, col.Name, value)
+	}
+
+	res, err := s.getOne(ctx, tx, s.rel.readable(), key, false, opts)
+	if err != nil {
+		return resource{}, false, err
+	}
+
+	err = prefs.finish(ctx, tx)
+	if err != nil {
+		return resource{}, false, err
+	}
+
+	return res, false, nil
+}
+
+// bodyAgrees returns true if rawJSON lacks col, or has value for it.
+func bodyAgrees(rawJSON *RawJSONObject, col KeyColumn, value string) bool {
+	v, ok := rawJSON.value(col.Name)
+	if !ok {
+		return true
+	}
+
+	raw, ok := v.(json.RawMessage)
+	if !ok {
+		return false
+	}
+
+	got, err := col.parse(string(raw))
+
+	return err == nil && got == value
+}
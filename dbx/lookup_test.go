@@ -0,0 +1,91 @@
+package dbx
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	t.Parallel()
+
+	srv := CRUDHandler{ //nolint:exhaustruct
+		rel:     Relation{Name: "resource"}, //nolint:exhaustruct
+		lookups: []KeyColumn{{Name: "rkey", Type: KeyText}, {Name: "ref", Type: KeyUUID}},
+	}
+
+	tests := []struct {
+		name    string
+		column  string
+		value   string
+		want    KeyColumn
+		wantVal string
+		wantErr error
+	}{
+		{name: "text", column: "rkey", value: "RSK-1", want: srv.lookups[0], wantVal: "RSK-1"},
+		{
+			name:    "uuid in upper case",
+			column:  "ref",
+			value:   "0190F2A4-7C1E-7D3A-9B1E-2F3C4D5E6F70",
+			want:    srv.lookups[1],
+			wantVal: "0190f2a4-7c1e-7d3a-9b1e-2f3c4d5e6f70",
+		},
+		{name: "not a uuid", column: "ref", value: "RSK-1", wantErr: ErrInvalidKey},
+		{name: "not unique", column: "description", value: "High risk", wantErr: ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest("GET", "/by/x/y", nil)
+			req.SetPathValue("column", tt.column)
+			req.SetPathValue("value", tt.value)
+
+			col, value, err := srv.lookup(req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if col != tt.want || value != tt.wantVal {
+				t.Errorf("got %v %q, want %v %q", col, value, tt.want, tt.wantVal)
+			}
+		})
+	}
+}
+
+func TestBodyAgrees(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		body  string
+		col   KeyColumn
+		value string
+		want  bool
+	}{
+		{name: "absent", body: `{"description":"x"}`, col: KeyColumn{Name: "rkey", Type: KeyText}, value: "RSK-1", want: true},
+		{name: "same", body: `{"rkey":"RSK-1"}`, col: KeyColumn{Name: "rkey", Type: KeyText}, value: "RSK-1", want: true},
+		{name: "other", body: `{"rkey":"RSK-2"}`, col: KeyColumn{Name: "rkey", Type: KeyText}, value: "RSK-1", want: false},
+		{name: "null", body: `{"rkey":null}`, col: KeyColumn{Name: "rkey", Type: KeyText}, value: "RSK-1", want: false},
+		{name: "number", body: `{"code":7}`, col: KeyColumn{Name: "code", Type: KeyInt}, value: "7", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rawJSON := new(RawJSONObject)
+
+			err := json.Unmarshal([]byte(tt.body), rawJSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := bodyAgrees(rawJSON, tt.col, tt.value); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
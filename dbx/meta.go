@@ -0,0 +1,204 @@
+package dbx
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// Reserved fields
+//
+// Field and column names starting with "_" are reserved for system metadata.
+// Clients can never write them, and responses use them for the metadata envelope.
+
+// reservedPrefix is the prefix of reserved field and column names.
+const reservedPrefix = "_"
+
+// metaField is the name of the metadata object in responses.
+const metaField = "_meta"
+
+// metaQueryParam is the query parameter that includes the metadata object in responses.
+const metaQueryParam = "_meta"
+
+// metaPreference is the Prefer token that includes the metadata object in responses.
+const metaPreference = "include-meta"
+
+// defaultETagColumn is the column holding the entity tag if nothing else is specified.
+const defaultETagColumn = "_etag"
+
+// rowsAlias is the alias of the common table expression holding the rows of an operation.
+const rowsAlias = "_dbx_rows"
+
+// etagAlias is the alias of the entity tag in rowsAlias.
+const etagAlias = "_dbx_etag"
+
+// lastModifiedAlias is the alias of the last modification time in responses.
+const lastModifiedAlias = "_dbx_last_modified"
+
+// idAlias is the alias of the key in responses.
+const idAlias = "_dbx_id"
+
+// Metadata maps system metadata to columns of a relation.
+// Empty values mean that the relation does not have the metadata.
+type Metadata struct {
+	// ETag is the strategy for computing the entity tag.
+	// Defaults to the "_etag" column.
+	ETag ETagStrategy
+
+	// Version is the column holding the version of the row
+	Version string
+
+	// CreatedAt is the column holding the creation timestamp
+	CreatedAt string
+
+	// UpdatedAt is the column holding the timestamp of the last update.
+	// Responses carry it in the Last-Modified header.
+	UpdatedAt string
+}
+
+// resource is a single resource as returned by the database.
+type resource struct {
+	// response is the JSON representation
+	response string
+
+	// etag is the opaque entity tag
+	etag string
+
+	// lastModified is the time of the last update, if the relation has it
+	lastModified *time.Time
+
+	// id is the key of the resource, used in the Location header
+	id keyValue
+}
+
+// ETag returns the strong entity tag of the resource.
+func (r resource) ETag() header.ETag {
+	return header.NewETag(false, r.etag)
+}
+
+// setValidators sets the ETag and Last-Modified headers of the resource.
+func (r resource) setValidators(w http.ResponseWriter) {
+	w.Header().Set(header.NameEtag, r.ETag().String())
+
+	if r.lastModified != nil {
+		w.Header().Set(header.NameLastModified, header.FormatDate(*r.lastModified))
+	}
+}
+
+// isReserved returns true if name is reserved for system metadata.
+func isReserved(name string) bool {
+	return strings.HasPrefix(name, reservedPrefix)
+}
+
+// responseOptions controls how response objects are serialized.
+type responseOptions struct {
+	// meta includes the metadata object
+	meta bool
+
+	// base is the path of the collection, used for self links
+	base string
+
+	// mediaType is the negotiated media type
+	mediaType header.MediaType
+
+	// delimiter separates the fields of CSV responses
+	delimiter string
+}
+
+// newResponseOptions returns the response options requested by req, with a JSON media type.
+// The metadata object is included with the _meta query parameter or the include-meta preference.
+func newResponseOptions(req *http.Request) responseOptions {
+	opts := responseOptions{meta: false, base: basePath(req), mediaType: mediaTypeJSON, delimiter: ","}
+
+	if values, ok := req.URL.Query()[metaQueryParam]; ok {
+		opts.meta = len(values) == 0 || values[0] == "" || values[0] == "true"
+	}
+
+	if header.ParsePrefer(req.Header.Values(header.NamePrefer)).Has(metaPreference) {
+		opts.meta = true
+	}
+
+	return opts
+}
+
+// basePath returns the path that the handler is mounted on.
+// The handler is usually mounted with [http.StripPrefix], leaving the prefix only in the request URI.
+func basePath(req *http.Request) string {
+	path, _, _ := strings.Cut(req.RequestURI, "?")
+	if path == "" {
+		return ""
+	}
+
+	// the request URI is escaped, so the escaped path is trimmed
+	return strings.TrimSuffix(strings.TrimSuffix(path, req.URL.EscapedPath()), "/")
+}
+
+// etagExpr returns the sql expression for the entity tag of the row alias.
+func (r Relation) etagExpr(alias string) string {
+	strategy := r.Meta.ETag
+	if strategy == nil {
+		strategy = ETagColumn(defaultETagColumn)
+	}
+
+	return strategy.Expression(alias)
+}
+
+// metaSelect returns the select items with system metadata for the row alias.
+// They are appended to the columns of the relation in rowsAlias.
+func (r Relation) metaSelect(alias string) string {
+	return r.etagExpr(alias) + " AS " + etagAlias
+}
+
+// metaObject returns the sql expression for the metadata object of a row in rowsAlias.
+func (r Relation) metaObject(opts responseOptions) string {
+	pairs := []string{
+		`'etag', '"' || ` + rowsAlias + `.` + etagAlias + ` || '"'`,
+	}
+
+	optional := []struct {
+		key string
+		col string
+	}{
+		{"version", r.Meta.Version},
+		{"created_at", r.Meta.CreatedAt},
+		{"updated_at", r.Meta.UpdatedAt},
+	}
+
+	for _, o := range optional {
+		if o.col != "" {
+			pairs = append(pairs, fmt.Sprintf(`'%s', %s.%s`, o.key, rowsAlias, quoteIdentifier(o.col)))
+		}
+	}
+
+	pairs = append(pairs, fmt.Sprintf(`'self', %s || %s`,
+		quoteLiteral(opts.base+"/"), r.keyText(rowsAlias)))
+
+	return "json_build_object(" + strings.Join(pairs, ", ") + ")"
+}
+
+// lastModifiedExpr returns the sql expression for the last modification time of a row in rowsAlias.
+func (r Relation) lastModifiedExpr() string {
+	if r.Meta.UpdatedAt == "" {
+		return "NULL::timestamptz"
+	}
+
+	return rowsAlias + "." + quoteIdentifier(r.Meta.UpdatedAt) + "::timestamptz"
+}
+
+// responseSelect returns the select list producing the representation,
+// the entity tag, the last modification time and the key for each row in rowsAlias.
+func (r Relation) responseSelect(fields []string, opts responseOptions) string {
+	return fmt.Sprintf(`%[1]s AS _response, `+
+		`%[2]s.%[3]s, %[4]s AS %[5]s, %[7]s AS %[6]s`,
+		r.representation(fields, opts),
+		rowsAlias,
+		etagAlias,
+		r.lastModifiedExpr(),
+		lastModifiedAlias,
+		idAlias,
+		r.keyArray(rowsAlias),
+	)
+}
@@ -0,0 +1,40 @@
+package dbx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasePath(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{name: "collection", target: "/resource/", want: "/resource"},
+		{name: "resource", target: "/resource/7?_select=id", want: "/resource"},
+		{name: "escaped value", target: "/resource/by/rkey/RSK%201", want: "/resource"},
+		{name: "escaped slash", target: "/resource/by/rkey/a%2Fb", want: "/resource"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var got string
+
+			handler := http.StripPrefix("/resource", http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+				got = basePath(req)
+			}))
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package dbx
+
+import (
+	"net/http"
+
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// negotiate picks the media type of the response from offered, based on the Accept header of req.
+// Responses depend on Accept, so Vary is set as well.
+// If nothing offered is acceptable, a 406 problem listing the offered media types is written,
+// and false is returned.
+func negotiate(w http.ResponseWriter, req *http.Request, offered ...header.MediaType) (header.MediaType, bool) {
+	w.Header().Add(header.NameVary, header.NameAccept)
+
+	mediaType, ok := header.ParseAccept(req.Header.Values(header.NameAccept)).Negotiate(offered)
+	if !ok {
+		available := make([]string, len(offered))
+		for i, o := range offered {
+			available[i] = o.String()
+		}
+
+		writeProblem(w, Problem{ //nolint:exhaustruct
+			Status:    http.StatusNotAcceptable,
+			Detail:    "none of the available media types are acceptable",
+			Available: available,
+		})
+
+		return header.MediaType{}, false //nolint:exhaustruct
+	}
+
+	return mediaType, true
+}
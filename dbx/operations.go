@@ -0,0 +1,569 @@
+package dbx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// Operations
+//
+// Bulk requests with Prefer: respond-async run as operations. They get 202 Accepted right away,
+// with a Location pointing to a status resource that can be polled, canceled and downloaded.
+
+// Statuses of operations.
+const (
+	statusPending   = "pending"
+	statusRunning   = "running"
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+	statusCanceled  = "canceled"
+)
+
+// operationsPath is the path of operations, below the path of the relation.
+const operationsPath = "/_operations/"
+
+// bodyPattern is the file name pattern of spooled request bodies.
+const bodyPattern = "body-*"
+
+// operationWhere is the condition for an operation of a relation that the requester can see.
+// The arguments are the id, the relation and the identity.
+const operationWhere = `id::text = $1 AND relation = $2 AND created_by IS NOT DISTINCT FROM NULLIF($3, '')`
+
+// progressInterval is how often the progress of a running operation is recorded.
+const progressInterval = time.Second
+
+// OperationsConfig configures Operations.
+type OperationsConfig struct {
+	// Schema is the schema of the operations table
+	Schema string
+
+	// Table is the name of the operations table, see db/api.sql
+	Table string
+
+	// Dir is the directory for request bodies and results of operations
+	Dir string
+
+	// Workers is the number of operations that run at the same time
+	Workers int
+
+	// Queue is the number of operations that can wait for a worker.
+	// Requests are rejected with 503 Service Unavailable when the queue is full.
+	Queue int
+}
+
+// Operations runs long-running operations on a bounded pool of workers,
+// recording their status, progress, result and error in a table.
+type Operations struct {
+	db    *pgxpool.Pool
+	table string
+	dir   string
+	jobs  chan job
+	stop  context.CancelFunc
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+// task is the work of an operation.
+// It reports progress to rec, and the result it returns is recorded as JSON, also when it fails.
+type task func(ctx context.Context, rec *recorder) (any, error)
+
+// job is an operation waiting for a worker.
+type job struct {
+	id       string
+	identity string
+	verified bool
+	task     task
+
+	// requestID is the id of the request that started the operation, for the audit log
+	requestID string
+
+	// cleanup removes what the task needs, such as a spooled body, whether the task runs or not
+	cleanup func()
+}
+
+// NewOperations returns Operations with cfg.Workers workers running until ctx is done or Close is called.
+// Operations left pending or running by a previous process are marked failed,
+// so a single process should own the operations table.
+func NewOperations(ctx context.Context, db *pgxpool.Pool, cfg OperationsConfig) (*Operations, error) {
+	err := os.MkdirAll(cfg.Dir, 0o700) //nolint:mnd
+	if err != nil {
+		return nil, fmt.Errorf("could not create operations directory: %w", err)
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+
+	ops := &Operations{ //nolint:exhaustruct
+		db:      db,
+		table:   quoteIdentifier(cfg.Schema) + "." + quoteIdentifier(cfg.Table),
+		dir:     cfg.Dir,
+		jobs:    make(chan job, cfg.Queue),
+		stop:    stop,
+		cancels: map[string]context.CancelFunc{},
+	}
+
+	rows, err := db.Query(ctx, fmt.Sprintf(`UPDATE %s
+		SET status = '%s', error = 'the server stopped before the operation finished',
+			updated_at = now(), finished_at = now()
+		WHERE status IN ('%s', '%s')
+		RETURNING id::text`, ops.table, statusFailed, statusPending, statusRunning))
+
+	var unfinished []string
+	if err == nil {
+		unfinished, err = pgx.CollectRows(rows, pgx.RowTo[string])
+	}
+
+	if err != nil {
+		stop()
+
+		return nil, fmt.Errorf("could not fail unfinished operations: %w", err)
+	}
+
+	// partial results of operations that were running
+	for _, id := range unfinished {
+		os.Remove(ops.resultPath(id)) //nolint:errcheck,gosec
+	}
+
+	// bodies of operations that never ran
+	bodies, _ := filepath.Glob(filepath.Join(cfg.Dir, bodyPattern))
+	for _, body := range bodies {
+		os.Remove(body) //nolint:errcheck,gosec
+	}
+
+	for range cfg.Workers {
+		ops.wg.Go(func() {
+			ops.work(ctx)
+		})
+	}
+
+	return ops, nil
+}
+
+// Close cancels running operations and waits for the workers to stop.
+func (o *Operations) Close() {
+	o.stop()
+	o.wg.Wait()
+}
+
+// work runs jobs until ctx is done.
+func (o *Operations) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-o.jobs:
+			o.run(ctx, j)
+		}
+	}
+}
+
+// submit records a pending operation of kind on relation, and queues t.
+// cleanup is called once the operation is done, canceled or rejected, and can be nil.
+// Returns the id of the operation. Error is ErrUnavailable if the queue is full.
+func (o *Operations) submit(
+	ctx context.Context, relation Relation, kind string, t task, cleanup func(),
+) (string, error) {
+	if cleanup == nil {
+		cleanup = func() {}
+	}
+
+	identity, _ := IdentityFrom(ctx)
+	requestID, _ := RequestIDFrom(ctx)
+
+	var id string
+
+	err := o.db.QueryRow(ctx, fmt.Sprintf(`INSERT INTO %s (relation, kind, created_by)
+		VALUES ($1, $2, NULLIF($3, '')) RETURNING id::text`, o.table),
+		relation.Schema+"."+relation.Name, kind, identity).Scan(&id)
+	if err != nil {
+		cleanup()
+
+		return "", fmt.Errorf("could not record operation: %w", err)
+	}
+
+	select {
+	case o.jobs <- job{
+		id: id, identity: identity, verified: IdentityVerified(ctx), task: t, requestID: requestID, cleanup: cleanup,
+	}:
+		return id, nil
+	default:
+		cleanup()
+
+		_, err = o.db.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = $1`, o.table), id)
+		if err != nil {
+			slog.ErrorContext(ctx, "could not delete rejected operation", "id", id, "error", err)
+		}
+
+		return "", fmt.Errorf("%w: too many operations", ErrUnavailable)
+	}
+}
+
+// run runs a job, unless it was canceled while it was queued, and cleans up after it either way.
+func (o *Operations) run(ctx context.Context, j job) {
+	defer j.cleanup()
+
+	if j.verified {
+		ctx = WithVerifiedIdentity(ctx, j.identity)
+	} else {
+		ctx = WithIdentity(ctx, j.identity)
+	}
+
+	if j.requestID != "" {
+		ctx = WithRequestID(ctx, j.requestID)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	o.mu.Lock()
+	o.cancels[j.id] = cancel
+	o.mu.Unlock()
+
+	defer func() {
+		o.mu.Lock()
+		delete(o.cancels, j.id)
+		o.mu.Unlock()
+	}()
+
+	tag, err := o.db.Exec(ctx, fmt.Sprintf(`UPDATE %s SET status = '%s', updated_at = now()
+		WHERE id = $1 AND status = '%s'`, o.table, statusRunning, statusPending), j.id)
+	if err != nil || tag.RowsAffected() == 0 {
+		return
+	}
+
+	rec := &recorder{ops: o, id: j.id, progress: 0, reported: time.Now(), resultType: ""}
+
+	result, err := j.task(ctx, rec)
+
+	status, errText := statusSucceeded, ""
+
+	switch {
+	case ctx.Err() != nil:
+		status, errText = statusCanceled, "the operation was canceled"
+	case err != nil:
+		status, errText = statusFailed, err.Error()
+	}
+
+	var resultJSON any
+
+	if result != nil {
+		b, err := json.Marshal(result)
+		if err == nil {
+			resultJSON = string(b)
+		}
+	}
+
+	// the operation context may be canceled, but the outcome must still be recorded
+	_, err = o.db.Exec(context.WithoutCancel(ctx), fmt.Sprintf(`UPDATE %s
+		SET status = $2, progress = $3, result = $4::jsonb, result_type = NULLIF($5, ''), error = NULLIF($6, ''),
+			updated_at = now(), finished_at = now()
+		WHERE id = $1 AND status = '%s'`, o.table, statusRunning),
+		j.id, status, rec.progress, resultJSON, rec.resultType, errText)
+	if err != nil {
+		slog.ErrorContext(ctx, "could not record operation", "id", j.id, "error", err)
+	}
+
+	if status != statusSucceeded || rec.resultType == "" {
+		os.Remove(o.resultPath(j.id)) //nolint:errcheck,gosec
+	}
+}
+
+// spool writes body to a file, so that it can be read after the request has ended.
+// The caller must remove the file.
+func (o *Operations) spool(body io.Reader) (string, error) {
+	f, err := os.CreateTemp(o.dir, bodyPattern)
+	if err != nil {
+		return "", fmt.Errorf("could not spool body: %w", err)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, body)
+	if err != nil {
+		os.Remove(f.Name()) //nolint:errcheck,gosec
+
+		return "", fmt.Errorf("%w: could not read body: %w", ErrInvalidBody, err)
+	}
+
+	return f.Name(), nil
+}
+
+// resultPath returns the path of the downloadable result of an operation.
+func (o *Operations) resultPath(id string) string {
+	return filepath.Join(o.dir, "result-"+id)
+}
+
+// get returns the operation with id as JSON, and its status.
+// base is the path of the relation, used for links. Error is ErrNotFound if there is no such operation.
+func (o *Operations) get(ctx context.Context, relation Relation, id, base string) (string, string, error) {
+	identity, _ := IdentityFrom(ctx)
+
+	var operation, status string
+
+	err := o.db.QueryRow(ctx, fmt.Sprintf(`SELECT json_build_object(
+			'id', id,
+			'kind', kind,
+			'status', status,
+			'progress', progress,
+			'result', result,
+			'error', error,
+			'created_at', created_at,
+			'updated_at', updated_at,
+			'finished_at', finished_at,
+			'self', $4 || id::text,
+			'download', CASE WHEN status = '%s' AND result_type IS NOT NULL THEN $4 || id::text || '/result' END
+		)::text, status
+		FROM %s WHERE %s`, statusSucceeded, o.table, operationWhere),
+		id, relation.Schema+"."+relation.Name, identity, base+operationsPath).Scan(&operation, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", ErrNotFound
+	}
+
+	if err != nil {
+		return "", "", fmt.Errorf("could not get operation: %w", err)
+	}
+
+	return operation, status, nil
+}
+
+// cancel cancels the operation with id if it is unfinished, or deletes it and its result if it is finished.
+// Error is ErrNotFound if there is no such operation.
+func (o *Operations) cancel(ctx context.Context, relation Relation, id string) error {
+	identity, _ := IdentityFrom(ctx)
+	args := []any{id, relation.Schema + "." + relation.Name, identity}
+
+	tag, err := o.db.Exec(ctx, fmt.Sprintf(`UPDATE %s
+		SET status = '%s', error = 'the operation was canceled', updated_at = now(), finished_at = now()
+		WHERE %s AND status IN ('%s', '%s')`, o.table, statusCanceled, operationWhere, statusPending, statusRunning), args...)
+	if err != nil {
+		return fmt.Errorf("could not cancel operation: %w", err)
+	}
+
+	if tag.RowsAffected() > 0 {
+		o.mu.Lock()
+		if cancel, ok := o.cancels[id]; ok {
+			cancel()
+		}
+		o.mu.Unlock()
+
+		return nil
+	}
+
+	tag, err = o.db.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE %s`, o.table, operationWhere), args...)
+	if err != nil {
+		return fmt.Errorf("could not delete operation: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	os.Remove(o.resultPath(id)) //nolint:errcheck,gosec
+
+	return nil
+}
+
+// serveResult writes the downloadable result of the operation with id.
+// Error is ErrNotFound if there is no such operation, or if it has no downloadable result.
+func (o *Operations) serveResult(w http.ResponseWriter, req *http.Request, relation Relation, id string) error {
+	identity, _ := IdentityFrom(req.Context())
+
+	var (
+		resultType string
+		finishedAt time.Time
+	)
+
+	err := o.db.QueryRow(req.Context(), fmt.Sprintf(`SELECT result_type, finished_at
+		FROM %s WHERE %s AND status = '%s' AND result_type IS NOT NULL`, o.table, operationWhere, statusSucceeded),
+		id, relation.Schema+"."+relation.Name, identity).Scan(&resultType, &finishedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not get operation: %w", err)
+	}
+
+	f, err := os.Open(o.resultPath(id))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	defer f.Close()
+
+	w.Header().Set(header.NameContentType, resultType)
+	http.ServeContent(w, req, "", finishedAt, f)
+
+	return nil
+}
+
+// recorder records the progress and result of a running operation.
+type recorder struct {
+	ops        *Operations
+	id         string
+	progress   int64
+	reported   time.Time
+	resultType string
+}
+
+// add adds n to the progress. The progress is recorded at most once every progressInterval.
+func (r *recorder) add(ctx context.Context, n int64) {
+	r.progress += n
+
+	if time.Since(r.reported) < progressInterval {
+		return
+	}
+
+	r.reported = time.Now()
+
+	_, err := r.ops.db.Exec(ctx, fmt.Sprintf(`UPDATE %s SET progress = $2, updated_at = now() WHERE id = $1`,
+		r.ops.table), r.id, r.progress)
+	if err != nil {
+		slog.WarnContext(ctx, "could not record progress", "id", r.id, "error", err)
+	}
+}
+
+// create creates the downloadable result of the operation, with contentType.
+// The caller must close the file.
+func (r *recorder) create(contentType string) (*os.File, error) {
+	f, err := os.Create(r.ops.resultPath(r.id))
+	if err != nil {
+		return nil, fmt.Errorf("could not create result: %w", err)
+	}
+
+	r.resultType = contentType
+
+	return f, nil
+}
+
+// progressWriter is an io.Writer that records the number of bytes written as progress.
+type progressWriter struct {
+	ctx context.Context //nolint:containedctx
+	w   io.Writer
+	rec *recorder
+}
+
+// Write implements io.Writer.
+func (pw progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.rec.add(pw.ctx, int64(n))
+
+	if err != nil {
+		return n, fmt.Errorf("could not write result: %w", err)
+	}
+
+	return n, nil
+}
+
+// progressSource is an importSource that records the number of rows read as progress.
+type progressSource struct {
+	importSource
+
+	ctx context.Context //nolint:containedctx
+	rec *recorder
+}
+
+// Next implements pgx.CopyFromSource.
+func (ps progressSource) Next() bool {
+	if !ps.importSource.Next() {
+		return false
+	}
+
+	ps.rec.add(ps.ctx, 1)
+
+	return true
+}
+
+// UseOperations makes bulk requests with Prefer: respond-async run as operations in ops.
+func (s *CRUDHandler) UseOperations(ops *Operations) {
+	s.ops = ops
+}
+
+// preferAsync returns the preference names of bulk routes, including respond-async if operations are used.
+func (s *CRUDHandler) preferAsync(supported ...string) []string {
+	if s.ops == nil {
+		return supported
+	}
+
+	return append(supported, header.PreferRespondAsync)
+}
+
+// writeAccepted writes 202 Accepted for the operation with id, with its status resource.
+func (s *CRUDHandler) writeAccepted(w http.ResponseWriter, req *http.Request, prefs preferences, id string) {
+	operation, _, err := s.ops.get(req.Context(), s.rel, id, basePath(req))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	prefs.setApplied(w)
+	w.Header().Set("Location", basePath(req)+operationsPath+id)
+	w.Header().Set(header.NameContentType, mediaTypeJSON.String())
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, operation) //nolint:errcheck,gosec
+}
+
+// importAsync runs an import as an operation.
+// The body is spooled to a file first, since it cannot be read after the request has ended.
+func (s *CRUDHandler) importAsync(req *http.Request, opts importOptions, prefs preferences) (string, error) {
+	contentType := req.Header.Get(header.NameContentType)
+
+	_, _, err := importMediaType(contentType)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := s.ops.spool(req.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return s.ops.submit(req.Context(), s.rel, "import", func(ctx context.Context, rec *recorder) (any, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not open body: %w", err)
+		}
+		defer f.Close()
+
+		src, err := newImportSource(contentType, f)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := s.importAll(ctx, progressSource{importSource: src, ctx: ctx, rec: rec}, opts, prefs)
+
+		var fieldErrs FieldErrors
+		if errors.As(err, &fieldErrs) {
+			res.Errors = fieldErrs
+		}
+
+		return res, err
+	}, func() {
+		os.Remove(path) //nolint:errcheck,gosec
+	})
+}
+
+// exportAsync runs an export as an operation, with the export as downloadable result.
+func (s *CRUDHandler) exportAsync(ctx context.Context, format exportFormat, q Query) (string, error) {
+	return s.ops.submit(ctx, s.rel, "export", func(ctx context.Context, rec *recorder) (any, error) {
+		f, err := rec.create(format.contentType)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return nil, s.export(ctx, progressWriter{ctx: ctx, w: f, rec: rec}, format, q)
+	}, nil)
+}
@@ -0,0 +1,435 @@
+package dbx
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// Outbox
+//
+// Writes insert a row into the outbox table for each enabled webhook, in the same transaction as the write.
+// A dispatcher posts the rows to the webhooks, so downstream services hear about every committed write, and only those.
+
+// Statuses of outbox rows.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+)
+
+// maxBackoff is the longest wait between attempts to deliver a row.
+const maxBackoff = time.Hour
+
+// errPrivateTarget is the error of posting to a webhook at an address that is not public.
+var errPrivateTarget = errors.New("webhook target is not a public address")
+
+// sharedAddressSpace is the carrier-grade NAT range, which net/netip does not count as private.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10") //nolint:gochecknoglobals
+
+// OutboxConfig configures Outbox.
+type OutboxConfig struct {
+	// Schema is the schema of the outbox and webhooks tables
+	Schema string
+
+	// Table is the name of the outbox table, see db/api.sql
+	Table string
+
+	// Webhooks is the name of the webhooks table, see db/api.sql
+	Webhooks string
+
+	// Batch is the number of rows claimed at a time
+	Batch int
+
+	// PollInterval is the wait between looking for rows when there are none
+	PollInterval time.Duration
+
+	// MaxAttempts is the number of attempts before a row is dead-lettered
+	MaxAttempts int
+
+	// Lease is how long claimed rows are left to the dispatcher that claimed them,
+	// after which another dispatcher can claim them again
+	Lease time.Duration
+
+	// Client posts to the webhooks. Its timeout should be shorter than Lease, or rows can be delivered twice.
+	Client *http.Client
+
+	// AllowPrivateTargets lets webhooks post to loopback, private and link-local addresses.
+	// Otherwise, such targets are dead-lettered, so webhooks cannot reach internal services.
+	AllowPrivateTargets bool
+}
+
+// Outbox records writes and delivers them to webhooks.
+type Outbox struct {
+	db          *pgxpool.Pool
+	table       string
+	webhooks    string
+	batch       int
+	poll        time.Duration
+	maxAttempts int
+	lease       time.Duration
+	client      *http.Client
+	stop        context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// delivery is a claimed outbox row, with the webhook it goes to.
+type delivery struct {
+	event    outboxEvent
+	attempts int
+	url      string
+	secret   string
+}
+
+// outboxEvent is the body posted to webhooks.
+type outboxEvent struct {
+	ID         int64           `json:"id"`
+	Relation   string          `json:"relation"`
+	Op         string          `json:"op"`
+	ResourceID string          `json:"resource_id"`
+	Row        json.RawMessage `json:"row"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// NewOutbox returns an Outbox with a dispatcher running until ctx is done or Close is called.
+// Rows are claimed with FOR UPDATE SKIP LOCKED and leased, so several processes can dispatch the same outbox.
+func NewOutbox(ctx context.Context, db *pgxpool.Pool, cfg OutboxConfig) *Outbox {
+	ctx, stop := context.WithCancel(ctx)
+
+	o := &Outbox{ //nolint:exhaustruct
+		db:          db,
+		table:       quoteIdentifier(cfg.Schema) + "." + quoteIdentifier(cfg.Table),
+		webhooks:    quoteIdentifier(cfg.Schema) + "." + quoteIdentifier(cfg.Webhooks),
+		batch:       cfg.Batch,
+		poll:        cfg.PollInterval,
+		maxAttempts: cfg.MaxAttempts,
+		lease:       cfg.Lease,
+		client:      cfg.Client,
+		stop:        stop,
+	}
+
+	if !cfg.AllowPrivateTargets {
+		o.client = publicOnly(cfg.Client)
+	}
+
+	o.wg.Go(func() {
+		o.dispatch(ctx)
+	})
+
+	return o
+}
+
+// Close stops the dispatcher, and waits for the batch being delivered.
+func (o *Outbox) Close() {
+	o.stop()
+	o.wg.Wait()
+}
+
+// UseOutbox records creates, updates and deletes of the relation in outbox.
+func (s *CRUDHandler) UseOutbox(outbox *Outbox) {
+	s.outbox = outbox
+}
+
+// recordOutbox records op on the resource with key in tx, for each enabled webhook of the relation.
+// The row is read from the relation, so deletes are recorded before the row is deleted.
+func (s *CRUDHandler) recordOutbox(ctx context.Context, tx pgx.Tx, op string, key keyValue) error {
+	if s.outbox == nil {
+		return nil
+	}
+
+	args := []any{s.rel.Schema + "." + s.rel.Name, op, key.String()}
+
+	qry := fmt.Sprintf(`INSERT INTO %[1]s (webhook_id, relation, op, resource_id, payload)
+		SELECT _dbx_webhook.id, $1, $2, $3, ( SELECT %[3]s FROM %[4]s AS _dbx WHERE %[5]s )
+		FROM %[2]s AS _dbx_webhook
+		WHERE _dbx_webhook.enabled AND (_dbx_webhook.relation IS NULL OR _dbx_webhook.relation = $1)`,
+		s.outbox.table,
+		s.outbox.webhooks,
+		s.rel.rowJSON("_dbx"),
+		s.rel.identifier(),
+		s.rel.keyWhere("_dbx", key, &args),
+	)
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	_, err := tx.Exec(ctx, qry, args...)
+	if err != nil {
+		return fmt.Errorf("could not record outbox: %w", err)
+	}
+
+	return nil
+}
+
+// outboxImported returns a data-modifying WITH query that records the rows of the query rows in outbox,
+// for each enabled webhook of the relation, or "" if the relation has no outbox.
+// rows has the columns id, inserted and new, as from importReturning.
+func (s *CRUDHandler) outboxImported(rows string, args *[]any) string {
+	if s.outbox == nil {
+		return ""
+	}
+
+	*args = append(*args, s.rel.Schema+"."+s.rel.Name)
+
+	return fmt.Sprintf(`_dbx_outbox AS (
+		INSERT INTO %[1]s (webhook_id, relation, op, resource_id, payload)
+		SELECT _dbx_webhook.id, $%[4]d, CASE WHEN %[3]s.inserted THEN %[5]s ELSE %[6]s END, %[3]s.id, %[3]s.new
+		FROM %[3]s, %[2]s AS _dbx_webhook
+		WHERE _dbx_webhook.enabled AND (_dbx_webhook.relation IS NULL OR _dbx_webhook.relation = $%[4]d)
+		)`,
+		s.outbox.table,
+		s.outbox.webhooks,
+		rows,
+		len(*args),
+		quoteLiteral(writeInsert),
+		quoteLiteral(writeUpdate),
+	)
+}
+
+// dispatch delivers batches until ctx is done, waiting for the poll interval when there is nothing to deliver.
+func (o *Outbox) dispatch(ctx context.Context) {
+	for ctx.Err() == nil {
+		n, err := o.dispatchBatch(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "could not dispatch outbox", "error", err)
+		}
+
+		if n < o.batch {
+			select {
+			case <-ctx.Done():
+			case <-time.After(o.poll):
+			}
+		}
+	}
+}
+
+// dispatchBatch claims a batch of due rows, delivers them concurrently, and records each outcome.
+// No transaction is open during delivery, so a slow webhook holds neither locks nor connections.
+// Returns the number of rows claimed.
+func (o *Outbox) dispatchBatch(ctx context.Context) (int, error) {
+	deliveries, err := o.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+
+	for _, d := range deliveries {
+		wg.Go(func() {
+			err := o.attempt(ctx, d)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		})
+	}
+
+	wg.Wait()
+
+	return len(deliveries), errors.Join(errs...)
+}
+
+// attempt delivers d, and records the outcome.
+func (o *Outbox) attempt(ctx context.Context, d delivery) error {
+	permanent, err := o.deliver(ctx, d)
+
+	status, wait, lastError := deliveryDelivered, time.Duration(0), ""
+
+	if err != nil {
+		lastError = err.Error()
+		status, wait = deliveryPending, backoff(d.attempts+1)
+
+		if permanent || d.attempts+1 >= o.maxAttempts {
+			status = deliveryDead
+		}
+
+		slog.WarnContext(ctx, "could not deliver outbox row",
+			"id", d.event.ID, "attempts", d.attempts+1, "status", status, "error", err)
+	}
+
+	// outcomes are recorded even if ctx is canceled during delivery,
+	// unless the lease ran out and another dispatcher recorded an attempt first
+	_, err = o.db.Exec(context.WithoutCancel(ctx), fmt.Sprintf(`UPDATE %s
+		SET status = $2, attempts = attempts + 1, last_error = NULLIF($3, ''),
+			next_attempt_at = now() + make_interval(secs => $4),
+			delivered_at = CASE WHEN $2 = '%s' THEN now() END
+		WHERE id = $1 AND status = '%s' AND attempts = $5`, o.table, deliveryDelivered, deliveryPending),
+		d.event.ID, status, lastError, wait.Seconds(), d.attempts)
+	if err != nil {
+		return fmt.Errorf("could not record delivery: %w", err)
+	}
+
+	return nil
+}
+
+// claim leases a batch of due rows, skipping rows locked by other dispatchers.
+// Leased rows are not due again until the lease runs out, so the claim commits right away.
+func (o *Outbox) claim(ctx context.Context) ([]delivery, error) {
+	rows, err := o.db.Query(ctx, fmt.Sprintf(`WITH _dbx_claimed AS (
+			SELECT id FROM %[1]s
+			WHERE status = '%[3]s' AND next_attempt_at <= now()
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE %[1]s AS _dbx_outbox
+		SET next_attempt_at = now() + make_interval(secs => $2)
+		FROM _dbx_claimed, %[2]s AS _dbx_webhook
+		WHERE _dbx_outbox.id = _dbx_claimed.id AND _dbx_webhook.id = _dbx_outbox.webhook_id
+		RETURNING _dbx_outbox.id, _dbx_outbox.relation, _dbx_outbox.op,
+			_dbx_outbox.resource_id, _dbx_outbox.payload, _dbx_outbox.created_at, _dbx_outbox.attempts,
+			_dbx_webhook.url, _dbx_webhook.secret`, o.table, o.webhooks, deliveryPending), o.batch, o.lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("could not claim outbox rows: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []delivery
+
+	for rows.Next() {
+		var d delivery
+
+		err = rows.Scan(&d.event.ID, &d.event.Relation, &d.event.Op, &d.event.ResourceID, &d.event.Row,
+			&d.event.CreatedAt, &d.attempts, &d.url, &d.secret)
+		if err != nil {
+			return nil, fmt.Errorf("could not claim outbox rows: %w", err)
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not claim outbox rows: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+// deliver posts d to its webhook, signed with the secret of the webhook.
+// Returns true if the error is permanent, which is a 4xx status other than 408 Request Timeout and 429 Too Many Requests.
+func (o *Outbox) deliver(ctx context.Context, d delivery) (bool, error) {
+	body, err := json.Marshal(d.event)
+	if err != nil {
+		return true, fmt.Errorf("could not marshal outbox row: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return true, fmt.Errorf("could not create webhook request: %w", err)
+	}
+
+	id := strconv.FormatInt(d.event.ID, 10)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set(header.NameContentType, mediaTypeJSON.String())
+	req.Header.Set("Webhook-Id", id)
+	req.Header.Set("Webhook-Timestamp", timestamp)
+	req.Header.Set("Webhook-Signature", sign(d.secret, id, timestamp, body))
+
+	res, err := o.client.Do(req)
+	if err != nil {
+		return errors.Is(err, errPrivateTarget), fmt.Errorf("could not post to webhook: %w", err)
+	}
+	defer res.Body.Close()
+
+	io.Copy(io.Discard, res.Body) //nolint:errcheck,gosec
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode <= 299:
+		return false, nil
+	case res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests:
+		return false, fmt.Errorf("webhook responded %s", res.Status) //nolint:err113
+	default:
+		return res.StatusCode < 500, fmt.Errorf("webhook responded %s", res.Status) //nolint:err113,mnd
+	}
+}
+
+// publicOnly returns a copy of client that only connects to public addresses.
+// Addresses are checked when connecting, after name resolution, so names that resolve to internal addresses are caught.
+// Proxies from the environment are not used, since the check would apply to the proxy.
+// Clients with a Transport other than *http.Transport are returned as they are, and must check targets themselves.
+func publicOnly(client *http.Client) *http.Client {
+	transport, ok := client.Transport.(*http.Transport)
+	if client.Transport == nil {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+
+	if !ok {
+		return client
+	}
+
+	dialer := &net.Dialer{ //nolint:exhaustruct
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: %s", errPrivateTarget, address)
+			}
+
+			addr, err := netip.ParseAddr(host)
+			if err != nil || !publicAddress(addr) {
+				return fmt.Errorf("%w: %s", errPrivateTarget, address)
+			}
+
+			return nil
+		},
+	}
+
+	transport = transport.Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	guarded := *client
+	guarded.Transport = transport
+
+	return &guarded
+}
+
+// publicAddress returns true if addr is a public unicast address.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// sign returns the signature of a webhook request, following Standard Webhooks:
+// the base64 HMAC-SHA256 of the id, timestamp and body, joined by dots.
+func sign(secret, id, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id + "." + timestamp + ".")) //nolint:errcheck,gosec
+	mac.Write(body)                               //nolint:errcheck,gosec
+
+	return "v1," + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns the wait before the next attempt after attempts failed attempts.
+// The wait doubles from a second, up to maxBackoff.
+func backoff(attempts int) time.Duration {
+	if attempts > 12 { //nolint:mnd
+		return maxBackoff
+	}
+
+	return min(time.Second<<max(attempts-1, 0), maxBackoff)
+}
@@ -0,0 +1,170 @@
+package dbx
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	t.Parallel()
+
+	got := sign("0123456789abcdef", "7", "1700000000", []byte(`{"id":7}`))
+
+	want := "v1,VYIXVwUsRjZHzxftP9BrTqzOsz8BXIP77p3hPZToCxs="
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: time.Second},
+		{attempts: 2, want: 2 * time.Second},
+		{attempts: 5, want: 16 * time.Second},
+		{attempts: 13, want: maxBackoff},
+		{attempts: 100, want: maxBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		status        int
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{name: "delivered", status: http.StatusNoContent, wantErr: false, wantPermanent: false},
+		{name: "server error is retried", status: http.StatusServiceUnavailable, wantErr: true, wantPermanent: false},
+		{name: "too many requests is retried", status: http.StatusTooManyRequests, wantErr: true, wantPermanent: false},
+		{name: "gone is permanent", status: http.StatusGone, wantErr: true, wantPermanent: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Webhook-Id") != "7" || r.Header.Get("Webhook-Signature") == "" {
+					t.Errorf("got headers %v", r.Header)
+				}
+
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			o := &Outbox{client: server.Client()} //nolint:exhaustruct
+
+			permanent, err := o.deliver(t.Context(), delivery{
+				event:    outboxEvent{ID: 7, Op: writeInsert}, //nolint:exhaustruct
+				attempts: 0,
+				url:      server.URL,
+				secret:   "0123456789abcdef",
+			})
+			if (err != nil) != tt.wantErr || permanent != tt.wantPermanent {
+				t.Errorf("got %t, %v, want permanent %t and error %t", permanent, err, tt.wantPermanent, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "93.184.215.14", want: true},
+		{addr: "2606:2800:21f:cb07:6820:80da:af6b:8b2c", want: true},
+		{addr: "127.0.0.1", want: false},
+		{addr: "::1", want: false},
+		{addr: "10.1.2.3", want: false},
+		{addr: "192.168.0.1", want: false},
+		{addr: "169.254.169.254", want: false},
+		{addr: "100.64.0.1", want: false},
+		{addr: "0.0.0.0", want: false},
+		{addr: "::ffff:127.0.0.1", want: false},
+		{addr: "fd00::1", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			t.Parallel()
+
+			if got := publicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeliverPrivateTarget(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		t.Error("posted to a loopback address")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	o := &Outbox{client: publicOnly(server.Client())} //nolint:exhaustruct
+
+	permanent, err := o.deliver(t.Context(), delivery{
+		event:    outboxEvent{ID: 7, Op: writeInsert}, //nolint:exhaustruct
+		attempts: 0,
+		url:      server.URL,
+		secret:   "0123456789abcdef",
+	})
+	if !errors.Is(err, errPrivateTarget) || !permanent {
+		t.Errorf("got %t, %v, want a permanent %v", permanent, err, errPrivateTarget)
+	}
+}
+
+func TestOutboxImported(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		outbox   *Outbox
+		wantArgs int
+	}{
+		{name: "no outbox", outbox: nil, wantArgs: 1},
+		{name: "outbox", outbox: &Outbox{table: `"s"."outbox"`, webhooks: `"s"."webhooks"`}, wantArgs: 2}, //nolint:exhaustruct
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := CRUDHandler{rel: Relation{Schema: "s", Name: "n"}, outbox: tt.outbox} //nolint:exhaustruct
+			args := []any{"assigned"}
+
+			qry := srv.outboxImported(rowsAlias, &args)
+			if (qry != "") != (tt.outbox != nil) || len(args) != tt.wantArgs {
+				t.Fatalf("got %q with %d args, want %d args", qry, len(args), tt.wantArgs)
+			}
+
+			if tt.outbox != nil && !strings.Contains(qry, "$2") {
+				t.Errorf("got %q, want the relation as $2", qry)
+			}
+		})
+	}
+}
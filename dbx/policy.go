@@ -0,0 +1,160 @@
+package dbx
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// operation is a write operation on a relation.
+type operation int
+
+const (
+	opCreate operation = iota
+	opUpdate
+)
+
+// AssignFunc returns the value of a server-assigned column.
+type AssignFunc func(ctx context.Context) (any, error)
+
+// Assigned is a column that is filled in by the server.
+// Clients are never allowed to write server-assigned columns.
+type Assigned struct {
+	// Column is the name of the column
+	Column string
+
+	// OnCreate assigns the column when a resource is created
+	OnCreate bool
+
+	// OnUpdate assigns the column when a resource is updated
+	OnUpdate bool
+
+	// Value returns the value to assign
+	Value AssignFunc
+}
+
+// FieldError describes why a single field in a request object was rejected.
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+	// Line is the line of the field in imports, or zero
+	Line int64 `json:"line,omitempty"`
+}
+
+// FieldErrors is returned when one or more fields in a request object are rejected.
+// It wraps ErrUnprocessable.
+type FieldErrors []FieldError
+
+// Error implements error.
+func (fe FieldErrors) Error() string {
+	msgs := make([]string, len(fe))
+	for i, e := range fe {
+		msgs[i] = e.Field + ": " + e.Reason
+		if e.Line > 0 {
+			msgs[i] = fmt.Sprintf("line %d: %s", e.Line, msgs[i])
+		}
+	}
+
+	return ErrUnprocessable.Error() + ": " + strings.Join(msgs, ", ")
+}
+
+// Unwrap makes FieldErrors match ErrUnprocessable with errors.Is.
+func (fe FieldErrors) Unwrap() error {
+	return ErrUnprocessable
+}
+
+// readable returns the columns that are serialized in responses.
+func (r Relation) readable() []string {
+	cols := make([]string, 0, len(r.Columns))
+
+	for _, col := range r.Columns {
+		if !slices.Contains(r.Hidden, col) {
+			cols = append(cols, col)
+		}
+	}
+
+	return cols
+}
+
+// assigned returns the server-assigned column with the given name.
+func (r Relation) assigned(col string) (Assigned, bool) {
+	for _, a := range r.Assigned {
+		if a.Column == col {
+			return a, true
+		}
+	}
+
+	return Assigned{}, false //nolint:exhaustruct
+}
+
+// known returns true if field is a column of the relation, whether it can be written or not.
+func (r Relation) known(field string) bool {
+	_, assigned := r.assigned(field)
+
+	return assigned || slices.Contains(r.Columns, field) || slices.Contains(r.Hidden, field) ||
+		slices.Contains(r.ReadOnly, field) || slices.Contains(r.InsertOnly, field)
+}
+
+// checkFields checks that the client is allowed to write all fields in op.
+// Returns FieldErrors listing every offending field.
+func (r Relation) checkFields(op operation, fields []string) error {
+	var errs FieldErrors
+
+	for _, field := range fields {
+		if reason := r.fieldViolation(op, field); reason != "" {
+			errs = append(errs, FieldError{Field: field, Reason: reason, Line: 0})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// fieldViolation returns the reason the client cannot write field in op,
+// or an empty string if the write is allowed.
+func (r Relation) fieldViolation(op operation, field string) string {
+	switch {
+	case isReserved(field):
+		return "reserved field"
+	case slices.Contains(r.ReadOnly, field):
+		return "read-only field"
+	case op == opUpdate && slices.Contains(r.InsertOnly, field):
+		return "insert-only field"
+	}
+
+	if _, ok := r.assigned(field); ok {
+		return "server-assigned field"
+	}
+
+	if !r.known(field) {
+		return "unknown field"
+	}
+
+	return ""
+}
+
+// assign returns the server-assigned fields and their values for op.
+func (r Relation) assign(ctx context.Context, op operation) ([]string, []any, error) {
+	fields := make([]string, 0, len(r.Assigned))
+	values := make([]any, 0, len(r.Assigned))
+
+	for _, a := range r.Assigned {
+		if (op == opCreate && !a.OnCreate) || (op == opUpdate && !a.OnUpdate) {
+			continue
+		}
+
+		value, err := a.Value(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not assign %s: %w", a.Column, err)
+		}
+
+		fields = append(fields, a.Column)
+		values = append(values, value)
+	}
+
+	return fields, values, nil
+}
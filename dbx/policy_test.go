@@ -0,0 +1,76 @@
+package dbx
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckFields(t *testing.T) {
+	t.Parallel()
+
+	rel := Relation{
+		Schema:     "s",
+		Name:       "n",
+		Columns:    []string{"id", "rkey", "description", "created_by"},
+		ReadOnly:   []string{"id", "_etag"},
+		InsertOnly: []string{"rkey"},
+		Hidden:     []string{"password_hash"},
+		Assigned:   []Assigned{{Column: "created_by", OnCreate: true, OnUpdate: false, Value: AssignIdentity}},
+	}
+
+	tests := []struct {
+		name      string
+		op        operation
+		fields    []string
+		offending []string
+	}{
+		{
+			name:      "allowed on create",
+			op:        opCreate,
+			fields:    []string{"rkey", "description", "password_hash"},
+			offending: nil,
+		},
+		{
+			name:      "insert-only on update",
+			op:        opUpdate,
+			fields:    []string{"rkey", "description"},
+			offending: []string{"rkey"},
+		},
+		{
+			name:      "every offending field is listed",
+			op:        opCreate,
+			fields:    []string{"id", "_etag", "created_by", "doesnotexist", "description"},
+			offending: []string{"id", "_etag", "created_by", "doesnotexist"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := rel.checkFields(tt.op, tt.fields)
+			if len(tt.offending) == 0 {
+				if err != nil {
+					t.Errorf("checkFields() error = %v, want nil", err)
+				}
+
+				return
+			}
+
+			var fieldErrs FieldErrors
+			if !errors.As(err, &fieldErrs) || !errors.Is(err, ErrUnprocessable) {
+				t.Fatalf("checkFields() error = %v, want FieldErrors", err)
+			}
+
+			if len(fieldErrs) != len(tt.offending) {
+				t.Fatalf("checkFields() = %v, want %v", fieldErrs, tt.offending)
+			}
+
+			for i, fe := range fieldErrs {
+				if fe.Field != tt.offending[i] {
+					t.Errorf("checkFields()[%d] = %v, want %v", i, fe.Field, tt.offending[i])
+				}
+			}
+		})
+	}
+}
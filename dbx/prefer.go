@@ -0,0 +1,114 @@
+package dbx
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// preferences are the preferences of a request that dbx honours.
+// See RFC 7240.
+type preferences struct {
+	// ret is the preferred content of responses to writes, such as header.ReturnMinimal.
+	// Defaults to header.ReturnRepresentation.
+	ret string
+
+	// handling is header.HandlingStrict or header.HandlingLenient handling of
+	// unknown query parameters and body fields. Empty is the default handling.
+	handling string
+
+	// rollback rolls back the transaction of writes, making them a dry-run
+	rollback bool
+
+	// async runs the request as an operation
+	async bool
+
+	// applied are the preferences that are honoured
+	applied []header.Preference
+}
+
+// newPreferences returns the preferences of req that are supported by the route.
+// supported are the names of the supported preferences.
+func newPreferences(req *http.Request, supported ...string) preferences {
+	prefs := preferences{ret: header.ReturnRepresentation, handling: "", rollback: false, async: false, applied: nil}
+
+	for _, pref := range header.ParsePrefer(req.Header.Values(header.NamePrefer)).Preferences() {
+		if !slices.Contains(supported, pref.Name) {
+			continue
+		}
+
+		switch {
+		case pref.Name == header.PreferReturn && slices.Contains(
+			[]string{header.ReturnMinimal, header.ReturnHeadersOnly, header.ReturnRepresentation}, pref.Value):
+			prefs.ret = pref.Value
+		case pref.Name == header.PreferHandling && slices.Contains(
+			[]string{header.HandlingStrict, header.HandlingLenient}, pref.Value):
+			prefs.handling = pref.Value
+		case pref.Name == header.PreferTx && slices.Contains(
+			[]string{header.TxCommit, header.TxRollback}, pref.Value):
+			prefs.rollback = pref.Value == header.TxRollback
+		case pref.Name == header.PreferRespondAsync:
+			prefs.async = true
+		case pref.Name == metaPreference:
+		default:
+			// unknown values are ignored, and not applied
+			continue
+		}
+
+		prefs.applied = append(prefs.applied, header.Preference{Name: pref.Name, Value: pref.Value, Params: nil})
+	}
+
+	return prefs
+}
+
+// setApplied sets the Preference-Applied header.
+// Responses depend on Prefer, so Vary is set as well.
+func (p preferences) setApplied(w http.ResponseWriter) {
+	w.Header().Add(header.NameVary, header.NamePrefer)
+
+	if len(p.applied) > 0 {
+		w.Header().Set(header.NamePreferenceApplied, header.FormatPreferenceApplied(p.applied...))
+	}
+}
+
+// finish commits tx, or rolls it back if the client asked for a dry-run with tx=rollback.
+// A dry-run runs the whole operation, including constraints and triggers, before rolling back.
+func (p preferences) finish(ctx context.Context, tx pgx.Tx) error {
+	if p.rollback {
+		err := tx.Rollback(ctx)
+		if err != nil {
+			return fmt.Errorf("could not roll back transaction: %w", err)
+		}
+
+		return nil
+	}
+
+	err := tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("could not commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// writeResource writes the response to a successful write of res, as preferred by the client.
+// return=minimal gives 204 No Content, return=headers-only gives status without content,
+// and return=representation gives status with the representation written by rw.
+func (p preferences) writeResource(w http.ResponseWriter, res resource, rw *representationWriter, status int) {
+	p.setApplied(w)
+	res.setValidators(w)
+
+	switch p.ret {
+	case header.ReturnMinimal:
+		w.WriteHeader(http.StatusNoContent)
+	case header.ReturnHeadersOnly:
+		w.WriteHeader(status)
+	default:
+		rw.status = status
+		rw.write(res.response)
+	}
+}
@@ -0,0 +1,96 @@
+package dbx
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// Problem is a problem details object as described in RFC 9457.
+type Problem struct {
+	// Type is a URI reference that identifies the problem type
+	Type string `json:"type"`
+
+	// Title is a short, human-readable summary of the problem type
+	Title string `json:"title"`
+
+	// Status is the HTTP status code
+	Status int `json:"status"`
+
+	// Detail is a human-readable explanation specific to this occurrence of the problem
+	Detail string `json:"detail,omitempty"`
+
+	// Errors lists the offending fields, if any
+	Errors FieldErrors `json:"errors,omitempty"`
+
+	// Rows is the number of rows in a rejected import
+	Rows int64 `json:"rows,omitempty"`
+
+	// Available lists the media types that can be produced, if none were acceptable
+	Available []string `json:"available,omitempty"`
+}
+
+// writeProblem writes p as an application/problem+json response.
+func writeProblem(w http.ResponseWriter, p Problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+
+	w.Header().Set(header.NameContentType, "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p) //nolint:errcheck,errchkjson
+}
+
+// writeError writes err as a HTTP error response.
+// The status code is derived from the sentinel errors in this package.
+func writeError(w http.ResponseWriter, err error) {
+	var fieldErrs FieldErrors
+	if errors.As(err, &fieldErrs) {
+		writeProblem(w, Problem{ //nolint:exhaustruct
+			Status: http.StatusUnprocessableEntity,
+			Detail: "one or more fields cannot be written",
+			Errors: fieldErrs,
+		})
+
+		return
+	}
+
+	if errors.Is(err, ErrInvalidKey) {
+		writeProblem(w, Problem{ //nolint:exhaustruct
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+
+		return
+	}
+
+	status := http.StatusInternalServerError
+
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrForbidden):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrNotAcceptable):
+		status = http.StatusNotAcceptable
+	case errors.Is(err, ErrUnavailable):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, ErrUnsupportedMediaType):
+		status = http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrPreconditionFailed):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, ErrUnprocessable):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, ErrEmptyObject), errors.Is(err, ErrInvalidFieldIdentifier), errors.Is(err, ErrInvalidBody),
+		errors.Is(err, ErrInvalidQuery), errors.Is(err, header.ErrInvalidMatch):
+		status = http.StatusBadRequest
+	}
+
+	http.Error(w, err.Error(), status)
+}
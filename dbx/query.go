@@ -0,0 +1,328 @@
+package dbx
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// Query parameters
+//
+// List queries follow the postgREST style for filters, and use underscore
+// prefixed parameters for everything else, as in pRESTd:
+//
+//	GET /resource?my_int=gte.2&rkey=like.RSK*&_select=id,rkey&_order=rkey.desc&_limit=10&_offset=20
+//
+// Every parameter without an underscore prefix is a filter on a column.
+// Filters are combined with AND.
+
+const (
+	// selectParam selects the columns to return, separated by comma.
+	selectParam = "_select"
+	// orderParam orders by the columns, separated by comma. Use column.desc for descending order.
+	orderParam = "_order"
+	// limitParam limits the number of rows returned.
+	limitParam = "_limit"
+	// offsetParam skips a number of rows.
+	offsetParam = "_offset"
+)
+
+// filterOperators maps filter operators to sql operators.
+var filterOperators = map[string]string{ //nolint:gochecknoglobals
+	"eq":    "=",
+	"neq":   "<>",
+	"lt":    "<",
+	"lte":   "<=",
+	"gt":    ">",
+	"gte":   ">=",
+	"like":  "LIKE",
+	"ilike": "ILIKE",
+	"is":    "IS",
+	"in":    "IN",
+}
+
+// Filter is a condition on a column.
+type Filter struct {
+	// Column is the column to filter on
+	Column string
+
+	// Operator is the filter operator, such as eq or gte
+	Operator string
+
+	// Value is the unparsed value to compare with
+	Value string
+}
+
+// Order is an ordering on a column.
+type Order struct {
+	// Column is the column to order by
+	Column string
+
+	// Desc is true for descending order
+	Desc bool
+}
+
+// Query is a parsed list query.
+type Query struct {
+	// Select are the columns to return
+	Select []string
+
+	// Filters are the conditions that rows must meet
+	Filters []Filter
+
+	// Order is the ordering of the rows
+	Order []Order
+
+	// Limit is the maximum number of rows returned. Zero means no limit.
+	Limit int
+
+	// Offset is the number of rows to skip
+	Offset int
+
+	// IncludeDeleted includes soft-deleted rows
+	IncludeDeleted bool
+}
+
+// reservedParams are the reserved query parameters that are understood.
+var reservedParams = []string{selectParam, orderParam, limitParam, offsetParam, metaQueryParam} //nolint:gochecknoglobals
+
+// parseQuery parses the query parameters of a list request for the relation.
+// Only readable columns can be selected, filtered and ordered on.
+//
+// handling decides what happens to unknown parameters, see header.PreferHandling.
+// By default, filters on unknown columns are rejected and unknown reserved parameters are ignored.
+// Strict handling rejects both, and lenient handling ignores both.
+//
+//nolint:cyclop,funlen,gocognit
+func (r Relation) parseQuery(values url.Values, handling string) (Query, error) {
+	readable := r.readable()
+
+	q := Query{Select: readable, Filters: nil, Order: nil, Limit: 0, Offset: 0, IncludeDeleted: false}
+
+	checkColumn := func(col string) error {
+		if !slices.Contains(readable, col) {
+			return fmt.Errorf("%w: unknown column %s", ErrInvalidQuery, col)
+		}
+
+		return nil
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	// sorted for a stable query, which is used for collection etags
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		value := values.Get(key)
+
+		switch {
+		case key == selectParam:
+			q.Select = strings.Split(value, ",")
+			for _, col := range q.Select {
+				err := checkColumn(col)
+				if err != nil {
+					return Query{}, err //nolint:exhaustruct
+				}
+			}
+		case key == orderParam:
+			for item := range strings.SplitSeq(value, ",") {
+				col, direction, _ := strings.Cut(item, ".")
+
+				err := checkColumn(col)
+				if err != nil {
+					return Query{}, err //nolint:exhaustruct
+				}
+
+				if direction != "" && direction != "asc" && direction != "desc" {
+					return Query{}, fmt.Errorf("%w: invalid order direction %s", ErrInvalidQuery, direction) //nolint:exhaustruct
+				}
+
+				q.Order = append(q.Order, Order{Column: col, Desc: direction == "desc"})
+			}
+		case key == limitParam, key == offsetParam:
+			num, err := strconv.Atoi(value)
+			if err != nil || num < 0 {
+				return Query{}, fmt.Errorf("%w: %s must be a non-negative integer", ErrInvalidQuery, key) //nolint:exhaustruct
+			}
+
+			if key == limitParam {
+				q.Limit = num
+			} else {
+				q.Offset = num
+			}
+		case key == includeDeletedParam && r.SoftDelete.Column != "":
+			include, err := r.parseIncludeDeleted(values)
+			if err != nil {
+				return Query{}, err //nolint:exhaustruct
+			}
+
+			q.IncludeDeleted = include
+		case isReserved(key):
+			if handling == header.HandlingStrict && !slices.Contains(reservedParams, key) {
+				return Query{}, fmt.Errorf("%w: unknown parameter %s", ErrInvalidQuery, key) //nolint:exhaustruct
+			}
+
+			continue
+		default:
+			err := checkColumn(key)
+			if err != nil && handling == header.HandlingLenient {
+				continue
+			}
+
+			if err != nil {
+				return Query{}, err //nolint:exhaustruct
+			}
+
+			for _, v := range values[key] {
+				operator, operand, ok := strings.Cut(v, ".")
+				if _, known := filterOperators[operator]; !ok || !known {
+					return Query{}, fmt.Errorf("%w: invalid filter %s=%s", ErrInvalidQuery, key, v) //nolint:exhaustruct
+				}
+
+				q.Filters = append(q.Filters, Filter{Column: key, Operator: operator, Value: operand})
+			}
+		}
+	}
+
+	return q, nil
+}
+
+// String returns a canonical string representation of the query.
+func (q Query) String() string {
+	values := url.Values{}
+	values.Set(selectParam, strings.Join(q.Select, ","))
+
+	for _, f := range q.Filters {
+		values.Add(f.Column, f.Operator+"."+f.Value)
+	}
+
+	order := make([]string, len(q.Order))
+	for i, o := range q.Order {
+		order[i] = o.Column
+		if o.Desc {
+			order[i] += ".desc"
+		}
+	}
+
+	if len(order) > 0 {
+		values.Set(orderParam, strings.Join(order, ","))
+	}
+
+	if q.Limit > 0 {
+		values.Set(limitParam, strconv.Itoa(q.Limit))
+	}
+
+	if q.Offset > 0 {
+		values.Set(offsetParam, strconv.Itoa(q.Offset))
+	}
+
+	if q.IncludeDeleted {
+		values.Set(includeDeletedParam, "true")
+	}
+
+	return values.Encode()
+}
+
+// where returns the WHERE condition for the filters on the row alias.
+// Filter values are appended to args as text, and referenced as parameters.
+// Returns "true" if there are no filters.
+func (q Query) where(alias string, args *[]any) (string, error) {
+	return q.conditions(alias, func(value string) string {
+		*args = append(*args, value)
+
+		return "$" + strconv.Itoa(len(*args))
+	})
+}
+
+// whereLiterals returns the WHERE condition for the filters on the row alias, with values as literals.
+// It is for statements that cannot have parameters, such as COPY.
+func (q Query) whereLiterals(alias string) (string, error) {
+	return q.conditions(alias, quoteLiteral)
+}
+
+// conditions returns the WHERE condition for the filters on the row alias.
+// bind returns the sql expression for a filter value.
+func (q Query) conditions(alias string, bind func(value string) string) (string, error) {
+	conds := make([]string, 0, len(q.Filters))
+
+	for _, f := range q.Filters {
+		col := alias + "." + quoteIdentifier(f.Column)
+
+		switch f.Operator {
+		case "is":
+			switch strings.ToLower(f.Value) {
+			case "null", "true", "false", "unknown":
+				conds = append(conds, col+" IS "+strings.ToUpper(f.Value))
+			default:
+				return "", fmt.Errorf("%w: is must be null, true, false or unknown", ErrInvalidQuery)
+			}
+		case "in":
+			items := strings.Split(strings.TrimSuffix(strings.TrimPrefix(f.Value, "("), ")"), ",")
+			params := make([]string, len(items))
+
+			for i, item := range items {
+				params[i] = bind(item)
+			}
+
+			conds = append(conds, col+" IN ("+strings.Join(params, ", ")+")")
+		case "like", "ilike":
+			// * is easier than % in urls
+			conds = append(conds, col+" "+filterOperators[f.Operator]+" "+bind(strings.ReplaceAll(f.Value, "*", "%")))
+		default:
+			conds = append(conds, col+" "+filterOperators[f.Operator]+" "+bind(f.Value))
+		}
+	}
+
+	if len(conds) == 0 {
+		return "true", nil
+	}
+
+	return strings.Join(conds, " AND "), nil
+}
+
+// orderBy returns the ORDER BY list for the row alias.
+// The columns in tiebreakers, such as the key columns, follow the order of q,
+// so that rows that tie are in a stable order for pagination and etags.
+func (q Query) orderBy(alias string, tiebreakers ...string) string {
+	items := make([]string, 0, len(q.Order)+len(tiebreakers))
+	ordered := make([]string, 0, len(q.Order))
+
+	for _, o := range q.Order {
+		item := alias + "." + quoteIdentifier(o.Column)
+		if o.Desc {
+			item += " DESC"
+		}
+
+		items = append(items, item)
+		ordered = append(ordered, o.Column)
+	}
+
+	for _, col := range tiebreakers {
+		if !slices.Contains(ordered, col) {
+			items = append(items, alias+"."+quoteIdentifier(col))
+		}
+	}
+
+	return strings.Join(items, ", ")
+}
+
+// limitOffset returns the LIMIT and OFFSET clauses.
+func (q Query) limitOffset() string {
+	clause := ""
+	if q.Limit > 0 {
+		clause += " LIMIT " + strconv.Itoa(q.Limit)
+	}
+
+	if q.Offset > 0 {
+		clause += " OFFSET " + strconv.Itoa(q.Offset)
+	}
+
+	return clause
+}
@@ -0,0 +1,199 @@
+package dbx
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	t.Parallel()
+
+	rel := Relation{ //nolint:exhaustruct
+		Schema:  "s",
+		Name:    "n",
+		Columns: []string{"id", "rkey", "my_int", "secret"},
+		Hidden:  []string{"secret"},
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		handling  string
+		wantWhere string
+		wantArgs  int
+		wantErr   bool
+	}{
+		{
+			name:      "no filters",
+			query:     "",
+			wantWhere: "true",
+		},
+		{
+			name:      "filters are combined with and",
+			query:     "my_int=gte.2&rkey=like.RSK*",
+			wantWhere: `_dbx."my_int" >= $1 AND _dbx."rkey" LIKE $2`,
+			wantArgs:  2,
+		},
+		{
+			name:      "in and is",
+			query:     "id=in.(1,2,3)&my_int=is.null",
+			wantWhere: `_dbx."id" IN ($1, $2, $3) AND _dbx."my_int" IS NULL`,
+			wantArgs:  3,
+		},
+		{
+			name:      "reserved parameters are not filters",
+			query:     "_select=id,rkey&_order=rkey.desc&_limit=10&_meta",
+			wantWhere: "true",
+		},
+		{
+			name:    "unknown column",
+			query:   "doesnotexist=eq.1",
+			wantErr: true,
+		},
+		{
+			name:    "hidden column",
+			query:   "_select=id,secret",
+			wantErr: true,
+		},
+		{
+			name:    "unknown operator",
+			query:   "id=like1",
+			wantErr: true,
+		},
+		{
+			name:      "unknown reserved parameters are ignored by default",
+			query:     "_doesnotexist=1",
+			wantWhere: "true",
+		},
+		{
+			name:     "unknown reserved parameters are rejected with strict handling",
+			query:    "_doesnotexist=1",
+			handling: "strict",
+			wantErr:  true,
+		},
+		{
+			name:      "unknown columns are ignored with lenient handling",
+			query:     "doesnotexist=eq.1&id=eq.1",
+			handling:  "lenient",
+			wantWhere: `_dbx."id" = $1`,
+			wantArgs:  1,
+		},
+		{
+			name:    "negative limit",
+			query:   "_limit=-1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			values, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q, err := rel.parseQuery(values, tt.handling)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidQuery) {
+					t.Errorf("parseQuery() error = %v, want %v", err, ErrInvalidQuery)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseQuery() error = %v", err)
+			}
+
+			args := []any{}
+
+			where, err := q.where("_dbx", &args)
+			if err != nil {
+				t.Fatalf("where() error = %v", err)
+			}
+
+			if where != tt.wantWhere {
+				t.Errorf("where() = %v, want %v", where, tt.wantWhere)
+			}
+
+			if len(args) != tt.wantArgs {
+				t.Errorf("where() args = %v, want %d", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestQueryStringIsCanonical(t *testing.T) {
+	t.Parallel()
+
+	rel := Relation{Schema: "s", Name: "n", Columns: []string{"id", "rkey"}} //nolint:exhaustruct
+
+	first, _ := url.ParseQuery("rkey=eq.a&id=gt.1&_order=id.desc")
+	other, _ := url.ParseQuery("_order=id.desc&id=gt.1&rkey=eq.a")
+
+	q1, err := rel.parseQuery(first, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q2, err := rel.parseQuery(other, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q1.String() != q2.String() {
+		t.Errorf("String() = %v, want %v", q1.String(), q2.String())
+	}
+}
+
+func TestWhereLiterals(t *testing.T) {
+	t.Parallel()
+
+	q := Query{ //nolint:exhaustruct
+		Filters: []Filter{
+			{Column: "rkey", Operator: "eq", Value: "it's"},
+			{Column: "my_int", Operator: "in", Value: "(1,2)"},
+			{Column: "rkey", Operator: "like", Value: "RSK*"},
+		},
+	}
+
+	want := `_dbx."rkey" = 'it''s' AND _dbx."my_int" IN ('1', '2') AND _dbx."rkey" LIKE 'RSK%'`
+
+	where, err := q.whereLiterals("_dbx")
+	if err != nil {
+		t.Fatalf("whereLiterals() error = %v", err)
+	}
+
+	if where != want {
+		t.Errorf("whereLiterals() = %v, want %v", where, want)
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		order []Order
+		want  string
+	}{
+		{name: "no order", want: `_dbx."id"`},
+		{name: "ties broken by key", order: []Order{{Column: "rkey", Desc: true}}, want: `_dbx."rkey" DESC, _dbx."id"`},
+		{name: "key ordered", order: []Order{{Column: "id", Desc: true}}, want: `_dbx."id" DESC`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			q := Query{Order: tt.order} //nolint:exhaustruct
+
+			if got := q.orderBy("_dbx", "id"); got != tt.want {
+				t.Errorf("orderBy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
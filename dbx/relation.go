@@ -1,6 +1,7 @@
 package dbx
 
 import (
+	"fmt"
 	"strings"
 )
 
@@ -12,8 +13,43 @@ type Relation struct {
 	// Name is the name of the table or view
 	Name string
 
+	// Key are the columns that identify rows, and their types, see KeyColumn. Defaults to an integer id.
+	// Views have no primary key, so views without an id column must declare it.
+	Key []KeyColumn
+
 	// Columns are the column names of the table or view
 	Columns []string
+
+	// ReadOnly are columns that clients can never write,
+	// such as identity columns, generated columns and _etag.
+	ReadOnly []string
+
+	// InsertOnly are columns that clients can write on create, but never change afterwards.
+	InsertOnly []string
+
+	// Hidden are columns that are never serialized in responses, such as password hashes.
+	// Hidden columns can still be written unless they are also read-only.
+	Hidden []string
+
+	// Assigned are columns that are filled in by the server, such as created_by.
+	Assigned []Assigned
+
+	// Meta maps system metadata, such as the entity tag, to columns.
+	Meta Metadata
+
+	// AuditTable is the table in Schema that records every write, see db/api.sql.
+	// Writes are not audited if it is empty.
+	AuditTable string
+
+	// HistoryTable is the table in Schema that keeps the versions of rows, see UseHistory.
+	// Versions cannot be read if it is empty.
+	HistoryTable string
+
+	// SoftDelete makes deletes keep rows, see SoftDelete.
+	SoftDelete SoftDelete
+
+	// Retention expires rows, see RetentionScheduler.
+	Retention RetentionRule
 }
 
 // String returns a string representation of the relation.
@@ -21,14 +57,17 @@ func (r Relation) String() string {
 	return r.Schema + "." + r.Name + " (" + strings.Join(r.Columns, ", ") + ")"
 }
 
-// Returning constructs the string for the RETURNING clause
-// of the sql query.
-// The format is "schema"."name"."column", joined by ", ".
-func (r Relation) returning() string {
-	colRef := make([]string, len(r.Columns))
-	for i, col := range r.Columns {
-		colRef[i] = "\"" + r.Schema + "\"." + "\"" + r.Name + "\"." + "\"" + col + "\""
+// identifier returns the quoted, schema qualified identifier of the relation.
+func (r Relation) identifier() string {
+	return quoteIdentifier(r.Schema) + "." + quoteIdentifier(r.Name)
+}
+
+// rowJSON returns a sql expression with the row alias as jsonb, without the hidden columns.
+func (r Relation) rowJSON(alias string) string {
+	hidden := make([]string, len(r.Hidden))
+	for i, col := range r.Hidden {
+		hidden[i] = quoteLiteral(col)
 	}
 
-	return strings.Join(colRef, ", ")
+	return fmt.Sprintf(`(to_jsonb(%s) - ARRAY[%s]::text[])`, alias, strings.Join(hidden, ", "))
 }
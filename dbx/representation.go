@@ -0,0 +1,210 @@
+package dbx
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// Representations
+//
+// Resources are read as JSON, CSV or NDJSON. The representation of each row is
+// produced in sql, so that lists can be written as rows arrive from the database.
+
+//nolint:gochecknoglobals
+var (
+	// mediaTypeJSON is the media type of JSON representations.
+	mediaTypeJSON = header.NewMediaType("application", "json")
+	// mediaTypeCSV is the media type of CSV representations, as described in RFC 4180.
+	mediaTypeCSV = header.NewMediaType("text", "csv")
+	// mediaTypeNDJSON is the media type of newline delimited JSON, with one object per line.
+	mediaTypeNDJSON = header.NewMediaType("application", "x-ndjson")
+)
+
+// delimiterParam is the media type parameter choosing the CSV delimiter.
+const delimiterParam = "delimiter"
+
+// readMediaTypes returns the media types that resources can be read as, the default first.
+func readMediaTypes() []header.MediaType {
+	return []header.MediaType{mediaTypeJSON, mediaTypeCSV, mediaTypeNDJSON}
+}
+
+// withMediaType returns opts for the negotiated mediaType.
+// Error is ErrNotAcceptable if the media type has parameters that are not supported.
+func (o responseOptions) withMediaType(mediaType header.MediaType) (responseOptions, error) {
+	o.mediaType = mediaType
+	o.delimiter = ","
+
+	if mediaType.Essence() != mediaTypeCSV.Essence() {
+		return o, nil
+	}
+
+	switch delimiter := mediaType.Params[delimiterParam]; delimiter {
+	case "", ",", ";":
+		if delimiter != "" {
+			o.delimiter = delimiter
+		}
+	default:
+		return responseOptions{}, fmt.Errorf("%w: unsupported csv delimiter %s", ErrNotAcceptable, delimiter) //nolint:exhaustruct
+	}
+
+	return o, nil
+}
+
+// isCSV returns true if the response is CSV.
+func (o responseOptions) isCSV() bool {
+	return o.mediaType.Essence() == mediaTypeCSV.Essence()
+}
+
+// contentType returns the Content-Type of the response.
+func (o responseOptions) contentType() string {
+	if !o.isCSV() {
+		return o.mediaType.String()
+	}
+
+	mediaType := header.NewMediaType(mediaTypeCSV.Type, mediaTypeCSV.Subtype)
+	mediaType.Params = map[string]string{"charset": "utf-8", "header": "present", delimiterParam: o.delimiter}
+
+	return mediaType.String()
+}
+
+// terminator returns what ends each representation in the response.
+func (o responseOptions) terminator() string {
+	switch o.mediaType.Essence() {
+	case mediaTypeCSV.Essence():
+		return "\r\n"
+	case mediaTypeNDJSON.Essence():
+		return "\n"
+	default:
+		return ""
+	}
+}
+
+// representation returns the sql expression of type text with the representation of a row in rowsAlias.
+// CSV rows never include the metadata object, since it doesn't fit in a column.
+func (r Relation) representation(fields []string, opts responseOptions) string {
+	items := prependIdentifier(rowsAlias, fields)
+
+	if opts.isCSV() {
+		for i, item := range items {
+			items[i] = csvField(item)
+		}
+
+		return fmt.Sprintf(`concat_ws(%s, %s)`, quoteLiteral(opts.delimiter), strings.Join(items, ", "))
+	}
+
+	if opts.meta {
+		items = append(items, r.metaObject(opts)+" AS "+quoteIdentifier(metaField))
+	}
+
+	return fmt.Sprintf(`( SELECT row_to_json(_obj) FROM ( SELECT %s ) AS _obj )::text`, strings.Join(items, ", "))
+}
+
+// csvField returns the sql expression for expr as a CSV field.
+// Fields with delimiters, quotes or line breaks are quoted, and NULL is an empty field.
+func csvField(expr string) string {
+	return fmt.Sprintf(`coalesce(CASE WHEN (%[1]s)::text ~ '[",;\r\n]' `+
+		`THEN '"' || replace((%[1]s)::text, '"', '""') || '"' ELSE (%[1]s)::text END, '')`, expr)
+}
+
+// representationWriter writes representations of resources to a response, one at a time.
+// Nothing is written until the first representation, so that errors before it still give a proper response.
+type representationWriter struct {
+	w       http.ResponseWriter
+	opts    responseOptions
+	fields  []string
+	status  int
+	list    bool
+	started bool
+	count   int
+}
+
+// newRepresentationWriter returns a representationWriter for a single resource with fields.
+func newRepresentationWriter(w http.ResponseWriter, fields []string, opts responseOptions) *representationWriter {
+	return &representationWriter{
+		w: w, opts: opts, fields: fields, status: http.StatusOK, list: false, started: false, count: 0,
+	}
+}
+
+// newListWriter returns a representationWriter for a list of resources with fields.
+// JSON lists are written as an array.
+func newListWriter(w http.ResponseWriter, fields []string, opts responseOptions) *representationWriter {
+	rw := newRepresentationWriter(w, fields, opts)
+	rw.list = true
+
+	return rw
+}
+
+// isJSONList returns true if representations are elements of a JSON array.
+func (rw *representationWriter) isJSONList() bool {
+	return rw.list && rw.opts.mediaType.Essence() == mediaTypeJSON.Essence()
+}
+
+// start writes the headers, and the header row of CSV responses.
+func (rw *representationWriter) start() {
+	if rw.started {
+		return
+	}
+
+	rw.started = true
+	rw.w.Header().Set(header.NameContentType, rw.opts.contentType())
+	rw.w.WriteHeader(rw.status)
+
+	if rw.isJSONList() {
+		io.WriteString(rw.w, "[") //nolint:errcheck,gosec
+	}
+
+	if !rw.opts.isCSV() {
+		return
+	}
+
+	cw := csv.NewWriter(rw.w)
+	cw.Comma = rune(rw.opts.delimiter[0])
+	cw.UseCRLF = true
+	cw.Write(rw.fields) //nolint:errcheck,gosec
+	cw.Flush()
+}
+
+// write writes a single representation.
+func (rw *representationWriter) write(representation string) {
+	rw.start()
+
+	if rw.isJSONList() && rw.count > 0 {
+		io.WriteString(rw.w, ",") //nolint:errcheck,gosec
+	}
+
+	io.WriteString(rw.w, representation+rw.opts.terminator()) //nolint:errcheck,gosec
+	rw.count++
+}
+
+// finish ends the response. Empty lists still get headers, and JSON arrays are closed.
+func (rw *representationWriter) finish() {
+	rw.start()
+
+	if rw.isJSONList() {
+		io.WriteString(rw.w, "]") //nolint:errcheck,gosec
+	}
+}
+
+// flush sends what has been written so far to the client.
+func (rw *representationWriter) flush() {
+	http.NewResponseController(rw.w).Flush() //nolint:errcheck,gosec
+}
+
+// abort returns err if nothing has been written yet.
+// Otherwise, the status is already sent, so err is logged and the response is aborted,
+// leaving the client with an incomplete response instead of one that looks complete.
+func (rw *representationWriter) abort(ctx context.Context, err error) error {
+	if !rw.started {
+		return err
+	}
+
+	slog.ErrorContext(ctx, "aborting response", "error", err)
+	panic(http.ErrAbortHandler)
+}
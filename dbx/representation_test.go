@@ -0,0 +1,118 @@
+package dbx
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+func TestRepresentationWriter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		accept          string
+		list            bool
+		representations []string
+		wantContentType string
+		wantBody        string
+		wantErr         bool
+	}{
+		{
+			name:            "json",
+			accept:          "application/json",
+			representations: []string{`{"id":1}`},
+			wantContentType: "application/json",
+			wantBody:        `{"id":1}`,
+		},
+		{
+			name:            "json list is an array",
+			accept:          "application/json",
+			list:            true,
+			representations: []string{`{"id":1}`, `{"id":2}`},
+			wantContentType: "application/json",
+			wantBody:        `[{"id":1},{"id":2}]`,
+		},
+		{
+			name:            "empty json list",
+			accept:          "*/*",
+			list:            true,
+			representations: nil,
+			wantContentType: "application/json",
+			wantBody:        `[]`,
+		},
+		{
+			name:            "ndjson has one object per line",
+			list:            true,
+			accept:          "application/x-ndjson",
+			representations: []string{`{"id":1}`, `{"id":2}`},
+			wantContentType: "application/x-ndjson",
+			wantBody:        "{\"id\":1}\n{\"id\":2}\n",
+		},
+		{
+			name:            "csv has a header row",
+			accept:          "text/csv",
+			representations: []string{`1,"a ""b"""`},
+			wantContentType: "text/csv; charset=utf-8; delimiter=\",\"; header=present",
+			wantBody:        "id,rkey\r\n1,\"a \"\"b\"\"\"\r\n",
+		},
+		{
+			name:            "csv delimiter",
+			accept:          `text/csv; delimiter=";"`,
+			representations: nil,
+			wantContentType: "text/csv; charset=utf-8; delimiter=\";\"; header=present",
+			wantBody:        "id;rkey\r\n",
+		},
+		{
+			name:    "unsupported csv delimiter",
+			accept:  `text/csv; delimiter="|"`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mediaType, ok := header.ParseAccept([]string{tt.accept}).Negotiate(readMediaTypes())
+			if !ok {
+				t.Fatalf("Negotiate() found nothing acceptable for %s", tt.accept)
+			}
+
+			opts, err := responseOptions{}.withMediaType(mediaType) //nolint:exhaustruct
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("withMediaType() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				if !errors.Is(err, ErrNotAcceptable) {
+					t.Errorf("withMediaType() error = %v, want ErrNotAcceptable", err)
+				}
+
+				return
+			}
+
+			rec := httptest.NewRecorder()
+			rw := newRepresentationWriter(rec, []string{"id", "rkey"}, opts)
+			if tt.list {
+				rw = newListWriter(rec, []string{"id", "rkey"}, opts)
+			}
+
+			for _, representation := range tt.representations {
+				rw.write(representation)
+			}
+
+			rw.finish()
+
+			if got := rec.Header().Get(header.NameContentType); got != tt.wantContentType {
+				t.Errorf("Content-Type = %v, want %v", got, tt.wantContentType)
+			}
+
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package dbx
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Retention
+//
+// Relations with a retention rule have their expired rows deleted by a RetentionScheduler.
+// The scheduler deletes in small batches, so locks are short, and holds an advisory lock, so one replica runs at a time.
+
+// retentionMetrics are the rows purged and, as of the last dry run, the rows that would be purged, by relation.
+// They are published by expvar at /debug/vars.
+var retentionMetrics = struct {
+	purged  *expvar.Map
+	expired *expvar.Map
+	runs    *expvar.Int
+	skipped *expvar.Int
+}{
+	purged:  expvar.NewMap("dbx_retention_purged_rows"),
+	expired: expvar.NewMap("dbx_retention_expired_rows"),
+	runs:    expvar.NewInt("dbx_retention_runs"),
+	skipped: expvar.NewInt("dbx_retention_skipped_runs"),
+}
+
+// RetentionRule expires the rows of a relation.
+type RetentionRule struct {
+	// Column is the timestamptz column that rows expire by, such as created_at.
+	// Rows do not expire if it is empty.
+	Column string
+
+	// OlderThan is how long rows are kept, counted from Column.
+	OlderThan time.Duration
+
+	// Filter is an optional SQL condition that rows must also match to expire, such as status = 'delivered'.
+	// Columns can be qualified with _dbx. It is trusted, and must never come from clients.
+	Filter string
+}
+
+// expired returns the condition for expired rows of the alias, with the age in seconds as $1.
+func (r Relation) expired(alias string) string {
+	cond := alias + "." + quoteIdentifier(r.Retention.Column) + " < now() - make_interval(secs => $1)"
+
+	if r.Retention.Filter != "" {
+		cond += " AND (" + r.Retention.Filter + ")"
+	}
+
+	return cond
+}
+
+// RetentionConfig configures RetentionScheduler.
+type RetentionConfig struct {
+	// Interval is the wait between runs
+	Interval time.Duration
+
+	// Batch is the number of rows deleted at a time
+	Batch int
+
+	// LockKey is the key of the advisory lock held during a run
+	LockKey int64
+
+	// DryRun counts and logs the expired rows instead of deleting them
+	DryRun bool
+}
+
+// RetentionReport is the outcome of a run for a relation.
+type RetentionReport struct {
+	Relation string
+	Rows     int64
+	DryRun   bool
+}
+
+// RetentionScheduler deletes the expired rows of relations periodically.
+type RetentionScheduler struct {
+	db        *pgxpool.Pool
+	cfg       RetentionConfig
+	relations []Relation
+	stop      context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewRetentionScheduler returns a RetentionScheduler that runs every interval, until ctx is done or Close is called.
+// Relations without a retention rule are ignored.
+func NewRetentionScheduler(
+	ctx context.Context, db *pgxpool.Pool, cfg RetentionConfig, relations ...Relation,
+) *RetentionScheduler {
+	ctx, stop := context.WithCancel(ctx)
+
+	s := &RetentionScheduler{ //nolint:exhaustruct
+		db:   db,
+		cfg:  cfg,
+		stop: stop,
+	}
+
+	for _, rel := range relations {
+		if rel.Retention.Column != "" {
+			s.relations = append(s.relations, rel)
+		}
+	}
+
+	s.wg.Go(func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			_, err := s.Run(ctx)
+			if err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "could not run retention", "error", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+
+	return s
+}
+
+// Close stops the scheduler, and waits for a running batch.
+func (s *RetentionScheduler) Close() {
+	s.stop()
+	s.wg.Wait()
+}
+
+// Run deletes the expired rows of each relation, or counts them in a dry run.
+// Returns nil reports if another replica holds the lock.
+func (s *RetentionScheduler) Run(ctx context.Context) ([]RetentionReport, error) {
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	var locked bool
+
+	err = conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1)`, s.cfg.LockKey).Scan(&locked)
+	if err != nil {
+		return nil, fmt.Errorf("could not take retention lock: %w", err)
+	}
+
+	if !locked {
+		retentionMetrics.skipped.Add(1)
+		slog.DebugContext(ctx, "retention runs elsewhere", "lock", s.cfg.LockKey)
+
+		return nil, nil
+	}
+
+	defer func() {
+		// session locks outlive canceled runs, so unlock even then
+		_, err := conn.Exec(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, s.cfg.LockKey)
+		if err != nil {
+			slog.ErrorContext(ctx, "could not release retention lock", "error", err)
+		}
+	}()
+
+	retentionMetrics.runs.Add(1)
+
+	reports := make([]RetentionReport, 0, len(s.relations))
+
+	for _, rel := range s.relations {
+		var n int64
+
+		if s.cfg.DryRun {
+			n, err = s.count(ctx, conn, rel)
+		} else {
+			n, err = s.purge(ctx, conn, rel)
+		}
+
+		reports = append(reports, RetentionReport{Relation: rel.Schema + "." + rel.Name, Rows: n, DryRun: s.cfg.DryRun})
+
+		if err != nil {
+			return reports, err
+		}
+	}
+
+	return reports, nil
+}
+
+// count counts the expired rows of rel.
+func (s *RetentionScheduler) count(ctx context.Context, conn *pgxpool.Conn, rel Relation) (int64, error) {
+	qry := fmt.Sprintf(`SELECT count(*) FROM %s AS _dbx WHERE %s`, rel.identifier(), rel.expired("_dbx"))
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	var n int64
+
+	err := conn.QueryRow(ctx, qry, rel.Retention.OlderThan.Seconds()).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("could not count expired rows of %s: %w", rel.Name, err)
+	}
+
+	setExpired(rel.Schema+"."+rel.Name, n)
+	slog.InfoContext(ctx, "would purge", "relation", rel.Name, "rows", n)
+
+	return n, nil
+}
+
+// setExpired sets the rows of relation that would be purged now.
+// Unlike Add, the value does not accumulate across runs.
+func setExpired(relation string, n int64) {
+	gauge, ok := retentionMetrics.expired.Get(relation).(*expvar.Int)
+	if !ok {
+		gauge = new(expvar.Int)
+		retentionMetrics.expired.Set(relation, gauge)
+	}
+
+	gauge.Set(n)
+}
+
+// purge deletes the expired rows of rel in batches, until a batch is not full or ctx is done.
+// Each batch commits on its own, so a run that stops midway keeps what it deleted.
+func (s *RetentionScheduler) purge(ctx context.Context, conn *pgxpool.Conn, rel Relation) (int64, error) {
+	qry := fmt.Sprintf(`WITH _dbx_expired AS (
+			SELECT _dbx.ctid FROM %[1]s AS _dbx WHERE %[2]s LIMIT $2
+		)
+		DELETE FROM %[1]s AS _dbx USING _dbx_expired WHERE _dbx.ctid = _dbx_expired.ctid`,
+		rel.identifier(),
+		rel.expired("_dbx"),
+	)
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	var total int64
+
+	for ctx.Err() == nil {
+		tag, err := conn.Exec(ctx, qry, rel.Retention.OlderThan.Seconds(), s.cfg.Batch)
+		if err != nil {
+			return total, fmt.Errorf("could not purge %s: %w", rel.Name, err)
+		}
+
+		n := tag.RowsAffected()
+		total += n
+
+		retentionMetrics.purged.Add(rel.Schema+"."+rel.Name, n)
+
+		if n < int64(s.cfg.Batch) {
+			break
+		}
+	}
+
+	if total > 0 {
+		slog.InfoContext(ctx, "purged", "relation", rel.Name, "rows", total)
+	}
+
+	return total, ctx.Err() //nolint:wrapcheck
+}
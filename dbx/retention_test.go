@@ -0,0 +1,52 @@
+package dbx
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionExpired(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		rule RetentionRule
+		want string
+	}{
+		{
+			name: "column",
+			rule: RetentionRule{Column: "created_at", OlderThan: time.Hour, Filter: ""},
+			want: `_dbx."created_at" < now() - make_interval(secs => $1)`,
+		},
+		{
+			name: "column and filter",
+			rule: RetentionRule{Column: "delivered_at", OlderThan: time.Hour, Filter: "_dbx.status = 'delivered'"},
+			want: `_dbx."delivered_at" < now() - make_interval(secs => $1) AND (_dbx.status = 'delivered')`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rel := Relation{Schema: "s", Name: "n", Retention: tt.rule} //nolint:exhaustruct
+
+			got := rel.expired("_dbx")
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetExpired(t *testing.T) {
+	t.Parallel()
+
+	setExpired("test.set_expired", 5)
+	setExpired("test.set_expired", 3)
+
+	got := retentionMetrics.expired.Get("test.set_expired").String()
+	if got != "3" {
+		t.Errorf("got %s, want 3", got)
+	}
+}
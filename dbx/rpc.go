@@ -0,0 +1,571 @@
+package dbx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+// RPC
+//
+// The functions of a schema are served at POST /{name}, and stable and immutable functions at GET /{name} too.
+// Arguments are named, and bound from the JSON body of POST and the query string of GET.
+// Functions returning sets or rows are filtered, selected and ordered like lists.
+
+// volatileFunction is the volatility of functions that can change data, as in pg_proc.provolatile.
+const volatileFunction = "v"
+
+// ordinalityColumn is the position of a row in the result of a function.
+const ordinalityColumn = "_dbx_ord"
+
+// argument is an input argument of a function.
+type argument struct {
+	name     string
+	typ      string
+	variadic bool
+	optional bool
+}
+
+// function is a function that can be called.
+type function struct {
+	name       string
+	args       []argument
+	volatility string
+	returnsSet bool
+	returnType string
+
+	// columns are the columns of functions returning rows, and nil for functions returning scalars
+	columns []string
+}
+
+// RPCHandler serves the functions of a schema.
+type RPCHandler struct {
+	http.Handler
+
+	db        *pgxpool.Pool
+	schema    string
+	functions map[string]function
+}
+
+// NewRPCHandler returns an RPCHandler for the functions in schema.
+// Functions are introspected once, so functions created or changed later are served after a restart.
+// Overloaded functions, and functions with unnamed arguments, are not served.
+// Functions run with the privileges of the pool, so schema should only have functions meant for clients.
+//
+//nolint:funlen
+func NewRPCHandler(ctx context.Context, db *pgxpool.Pool, schema string) (*RPCHandler, error) {
+	functions, err := introspectFunctions(ctx, db, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &RPCHandler{ //nolint:exhaustruct
+		db:        db,
+		schema:    schema,
+		functions: functions,
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /{name}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fn, ok := srv.functions[req.PathValue("name")]
+		if !ok {
+			writeError(w, ErrNotFound)
+			return
+		}
+
+		values, err := bodyArgs(req.Body)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		srv.call(w, req, fn, values, req.URL.Query(), ErrInvalidBody)
+	}))
+
+	mux.HandleFunc("GET /{name}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fn, ok := srv.functions[req.PathValue("name")]
+		if !ok {
+			writeError(w, ErrNotFound)
+			return
+		}
+
+		// volatile functions can change data, which GET must not
+		if fn.volatility == volatileFunction {
+			w.Header().Set(header.NameAllow, http.MethodPost)
+			writeProblem(w, Problem{ //nolint:exhaustruct
+				Status: http.StatusMethodNotAllowed,
+				Detail: fn.name + " is volatile, and can only be called with POST",
+			})
+
+			return
+		}
+
+		values, rest, err := fn.queryArgs(req.URL.Query())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		srv.call(w, req, fn, values, rest, ErrInvalidQuery)
+	}))
+
+	srv.Handler = mux
+
+	return srv, nil
+}
+
+// introspectFunctions returns the functions in schema that can be called, by name.
+func introspectFunctions(ctx context.Context, db *pgxpool.Pool, schema string) (map[string]function, error) {
+	qry := `SELECT p.proname::text, p.provolatile::text, p.proretset, p.prorettype::regtype::text, p.pronargdefaults,
+			coalesce(p.proargnames, '{}'),
+			coalesce(p.proargmodes::text[], array_fill('i'::text, ARRAY[p.pronargs::int])),
+			coalesce(p.proallargtypes, p.proargtypes::oid[])::regtype[]::text[],
+			coalesce((
+				SELECT array_agg(a.attname::text ORDER BY a.attnum)
+				FROM pg_catalog.pg_attribute AS a
+				WHERE a.attrelid = t.typrelid AND a.attnum > 0 AND NOT a.attisdropped
+			), '{}')
+		FROM pg_catalog.pg_proc AS p
+		JOIN pg_catalog.pg_namespace AS n ON n.oid = p.pronamespace
+		JOIN pg_catalog.pg_type AS t ON t.oid = p.prorettype
+		WHERE n.nspname = $1 AND p.prokind = 'f'
+			AND t.typname NOT IN ('trigger', 'event_trigger', 'internal', 'language_handler', 'fdw_handler')
+		ORDER BY p.proname`
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	rows, err := db.Query(ctx, qry, schema)
+	if err != nil {
+		return nil, fmt.Errorf("could not introspect functions: %w", err)
+	}
+	defer rows.Close()
+
+	functions := map[string]function{}
+	overloaded := map[string]bool{}
+
+	for rows.Next() {
+		var (
+			fn                  function
+			defaults            int
+			names, modes, types []string
+			attributes          []string
+		)
+
+		err = rows.Scan(&fn.name, &fn.volatility, &fn.returnsSet, &fn.returnType, &defaults,
+			&names, &modes, &types, &attributes)
+		if err != nil {
+			return nil, fmt.Errorf("could not introspect functions: %w", err)
+		}
+
+		fn, err = newFunction(fn, defaults, names, modes, types, attributes)
+		if err != nil {
+			slog.WarnContext(ctx, "function is not served", "schema", schema, "function", fn.name, "error", err)
+			continue
+		}
+
+		if _, ok := functions[fn.name]; ok || overloaded[fn.name] {
+			slog.WarnContext(ctx, "overloaded function is not served", "schema", schema, "function", fn.name)
+			delete(functions, fn.name)
+			overloaded[fn.name] = true
+
+			continue
+		}
+
+		functions[fn.name] = fn
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not introspect functions: %w", err)
+	}
+
+	return functions, nil
+}
+
+// newFunction returns fn with the arguments and columns from the catalog.
+// names, modes and types are the names, modes and types of all arguments, as in pg_proc.
+// The last defaults input arguments are optional.
+// attributes are the columns of the composite type that fn returns, if any.
+// Error is ErrUnprocessable if fn cannot be called by name, or returns records without columns.
+func newFunction(fn function, defaults int, names, modes, types, attributes []string) (function, error) {
+	fn.args, fn.columns = nil, nil
+
+	for i, mode := range modes {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		switch mode {
+		case "i", "b", "v":
+			if name == "" {
+				return fn, fmt.Errorf("%w: argument %d has no name", ErrUnprocessable, i+1)
+			}
+
+			fn.args = append(fn.args, argument{name: name, typ: types[i], variadic: mode == "v", optional: false})
+		}
+
+		// out arguments are the columns of functions returning records
+		if mode == "o" || mode == "b" || mode == "t" {
+			fn.columns = append(fn.columns, name)
+		}
+	}
+
+	for i := max(len(fn.args)-defaults, 0); i < len(fn.args); i++ {
+		fn.args[i].optional = true
+	}
+
+	switch {
+	case len(attributes) > 0:
+		fn.columns = attributes
+	case fn.returnType == "record" && len(fn.columns) == 0:
+		return fn, fmt.Errorf("%w: returns records without columns", ErrUnprocessable)
+	case fn.returnType != "record":
+		fn.columns = nil
+	}
+
+	if slices.Contains(fn.columns, "") {
+		return fn, fmt.Errorf("%w: returns a column without a name", ErrUnprocessable)
+	}
+
+	// sets of scalars have a single column, named after the function
+	if fn.columns == nil && fn.returnsSet {
+		fn.columns = []string{fn.name}
+	}
+
+	return fn, nil
+}
+
+// bodyArgs returns the arguments in a JSON object body. An empty body has no arguments.
+func bodyArgs(body io.Reader) (map[string]json.RawMessage, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("no body: %w", err)
+	}
+
+	values := map[string]json.RawMessage{}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return values, nil
+	}
+
+	err = json.Unmarshal(data, &values)
+	if err != nil {
+		return nil, fmt.Errorf("%w: arguments must be a JSON object: %w", ErrInvalidBody, err)
+	}
+
+	return values, nil
+}
+
+// queryArgs splits the query parameters into the arguments of fn, as JSON, and the rest.
+// Values of json and jsonb arguments are JSON, and other values are strings.
+func (fn function) queryArgs(query url.Values) (map[string]json.RawMessage, url.Values, error) {
+	values := map[string]json.RawMessage{}
+	rest := url.Values{}
+
+	for key, vals := range query {
+		idx := slices.IndexFunc(fn.args, func(arg argument) bool { return arg.name == key })
+		if idx < 0 {
+			rest[key] = vals
+			continue
+		}
+
+		value := query.Get(key)
+
+		if isJSONType(fn.args[idx].typ) {
+			if !json.Valid([]byte(value)) {
+				return nil, nil, fmt.Errorf("%w: %s must be JSON", ErrInvalidQuery, key)
+			}
+
+			values[key] = json.RawMessage(value)
+
+			continue
+		}
+
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %w", ErrInvalidQuery, key, err)
+		}
+
+		values[key] = raw
+	}
+
+	return values, rest, nil
+}
+
+// isJSONType returns true for the json and jsonb types.
+func isJSONType(typ string) bool {
+	return typ == "json" || typ == "jsonb"
+}
+
+// callExpr returns the sql expression calling fn with values, in named notation, and appends the values to args.
+// Values are coerced to the types of the arguments: JSON to json and jsonb, arrays to arrays,
+// objects to composite types, and everything else through text.
+// Error wraps invalid if an argument is unknown, or a required argument is missing.
+func (fn function) callExpr(schema string, values map[string]json.RawMessage, args *[]any, invalid error) (string, error) {
+	for name := range values {
+		if !slices.ContainsFunc(fn.args, func(arg argument) bool { return arg.name == name }) {
+			return "", fmt.Errorf("%w: %s has no argument %s", invalid, fn.name, name)
+		}
+	}
+
+	named := make([]string, 0, len(fn.args))
+
+	for _, arg := range fn.args {
+		raw, ok := values[arg.name]
+		if !ok {
+			if arg.optional {
+				continue
+			}
+
+			return "", fmt.Errorf("%w: %s needs the argument %s", invalid, fn.name, arg.name)
+		}
+
+		param := "$" + strconv.Itoa(len(*args)+1)
+		expr := param + "::text::" + arg.typ
+
+		switch {
+		case string(raw) == "null":
+			*args = append(*args, nil)
+		case isJSONType(arg.typ):
+			*args = append(*args, string(raw))
+		case raw[0] == '"':
+			var s string
+
+			err := json.Unmarshal(raw, &s)
+			if err != nil {
+				return "", fmt.Errorf("%w: %s: %w", invalid, arg.name, err)
+			}
+
+			*args = append(*args, s)
+		case raw[0] == '[' && strings.HasSuffix(arg.typ, "[]"):
+			expr = "ARRAY(SELECT jsonb_array_elements_text(" + param + "::jsonb))::" + arg.typ
+			*args = append(*args, string(raw))
+		case raw[0] == '{':
+			expr = "jsonb_populate_record(NULL::" + arg.typ + ", " + param + "::jsonb)"
+			*args = append(*args, string(raw))
+		default:
+			*args = append(*args, string(raw))
+		}
+
+		if arg.variadic {
+			named = append(named, "VARIADIC "+quoteIdentifier(arg.name)+" => "+expr)
+		} else {
+			named = append(named, quoteIdentifier(arg.name)+" => "+expr)
+		}
+	}
+
+	return quoteIdentifier(schema) + "." + quoteIdentifier(fn.name) + "(" + strings.Join(named, ", ") + ")", nil
+}
+
+// txOptions returns the transaction options for calling fn.
+// Stable and immutable functions cannot change data, so they are called in read-only transactions.
+func (fn function) txOptions() pgx.TxOptions {
+	if fn.volatility == volatileFunction {
+		return pgx.TxOptions{} //nolint:exhaustruct
+	}
+
+	return pgx.TxOptions{AccessMode: pgx.ReadOnly} //nolint:exhaustruct
+}
+
+// call calls fn with values, and writes the result.
+// Functions returning void respond 204 No Content, scalars are written as JSON,
+// and rows are written as a list, or as a single resource if fn does not return a set.
+// query selects, filters and orders the rows. Errors in the arguments wrap invalid.
+//
+//nolint:cyclop,funlen
+func (s *RPCHandler) call(
+	w http.ResponseWriter, req *http.Request, fn function, values map[string]json.RawMessage, query url.Values,
+	invalid error,
+) {
+	offered := readMediaTypes()
+	if fn.columns == nil {
+		offered = []header.MediaType{mediaTypeJSON}
+	}
+
+	mediaType, ok := negotiate(w, req, offered...)
+	if !ok {
+		return
+	}
+
+	opts, err := newResponseOptions(req).withMediaType(mediaType)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// the metadata object describes resources of relations, which function results are not
+	opts.meta = false
+
+	prefs := newPreferences(req, header.PreferHandling, header.PreferTx)
+
+	var args []any
+
+	callExpr, err := fn.callExpr(s.schema, values, &args, invalid)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	qry := fmt.Sprintf(`SELECT to_json(%s)::text`, callExpr)
+	fields := []string(nil)
+	cursor := true
+
+	if fn.columns != nil {
+		// function results are queried like a relation with the columns of the function
+		rel := Relation{Schema: s.schema, Name: fn.name, Columns: fn.columns} //nolint:exhaustruct
+
+		q, err := rel.parseQuery(query, prefs.handling)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		qry, err = fn.rowsQuery(rel, callExpr, q, &args, opts)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		fields = q.Select
+		cursor = cursored(q)
+	}
+
+	ctx := req.Context()
+
+	tx, err := s.db.BeginTx(ctx, fn.txOptions())
+	if err != nil {
+		writeError(w, fmt.Errorf("could not begin transaction: %w", err))
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	if fn.returnsSet {
+		// sets are streamed as lists are, and the transaction ends before the list is closed,
+		// so a failed commit aborts the response instead of completing it
+		prefs.setApplied(w)
+
+		rw := newListWriter(w, fields, opts)
+
+		err = streamRows(ctx, tx, rw, cursor, qry, args...)
+		if err != nil {
+			writeError(w, callError(fn, err, invalid))
+			return
+		}
+
+		err = prefs.finish(ctx, tx)
+		if err != nil {
+			writeError(w, rw.abort(ctx, err))
+			return
+		}
+
+		rw.finish()
+
+		return
+	}
+
+	var results []string
+
+	if fn.returnType == "void" {
+		_, err = tx.Exec(ctx, fmt.Sprintf(`SELECT %s`, callExpr), args...)
+	} else {
+		results, err = queryTexts(ctx, tx, qry, args...)
+	}
+
+	if err != nil {
+		writeError(w, callError(fn, err, invalid))
+		return
+	}
+
+	// results are read before the transaction ends, so that what is written has been committed
+	err = prefs.finish(ctx, tx)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	prefs.setApplied(w)
+
+	if fn.returnType == "void" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	rw := newRepresentationWriter(w, fields, opts)
+	for _, result := range results {
+		rw.write(result)
+	}
+
+	rw.finish()
+}
+
+// rowsQuery returns the query for the representations of the rows returned by fn, as selected by q.
+// Rows keep the order they are returned in, after the order of q.
+func (fn function) rowsQuery(rel Relation, callExpr string, q Query, args *[]any, opts responseOptions) (string, error) {
+	where, err := q.where("_dbx", args)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`WITH %[1]s AS (
+			SELECT _dbx.*
+			FROM %[2]s WITH ORDINALITY AS _dbx(%[3]s)
+			WHERE %[4]s
+			ORDER BY %[5]s%[6]s
+		)
+		SELECT %[7]s FROM %[1]s ORDER BY %[8]s`,
+		rowsAlias,
+		callExpr,
+		strings.Join(quoteIdentifiers(append(slices.Clone(fn.columns), ordinalityColumn)), ", "),
+		where,
+		q.orderBy("_dbx", ordinalityColumn),
+		q.limitOffset(),
+		rel.representation(q.Select, opts),
+		q.orderBy(rowsAlias, ordinalityColumn),
+	), nil
+}
+
+// queryTexts runs qry, and returns the text in the first column of each row.
+func queryTexts(ctx context.Context, tx pgx.Tx, qry string, args ...any) ([]string, error) {
+	rows, err := tx.Query(ctx, qry, args...)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	texts, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+
+	return texts, nil
+}
+
+// callError returns the error of calling fn.
+// Arguments that cannot be coerced, and exceptions raised by the function, wrap invalid.
+func callError(fn function, err error, invalid error) error {
+	var pgErr *pgconn.PgError
+
+	// class 22 is data exceptions, such as invalid input syntax, and P0001 is RAISE EXCEPTION
+	if errors.As(err, &pgErr) && (strings.HasPrefix(pgErr.Code, "22") || pgErr.Code == "P0001") {
+		return fmt.Errorf("%w: %s: %s", invalid, fn.name, pgErr.Message)
+	}
+
+	return fmt.Errorf("could not call %s: %w", fn.name, err)
+}
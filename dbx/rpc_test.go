@@ -0,0 +1,208 @@
+package dbx
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestNewFunction(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		fn         function
+		defaults   int
+		names      []string
+		modes      []string
+		types      []string
+		attributes []string
+		wantArgs   []argument
+		wantCols   []string
+		wantErr    error
+	}{
+		{
+			name:     "scalar",
+			fn:       function{name: "add", returnType: "integer"}, //nolint:exhaustruct
+			defaults: 1,
+			names:    []string{"a", "b"},
+			modes:    []string{"i", "i"},
+			types:    []string{"integer", "integer"},
+			wantArgs: []argument{
+				{name: "a", typ: "integer", variadic: false, optional: false},
+				{name: "b", typ: "integer", variadic: false, optional: true},
+			},
+		},
+		{
+			name:     "set of scalars",
+			fn:       function{name: "numbers", returnType: "integer", returnsSet: true}, //nolint:exhaustruct
+			wantCols: []string{"numbers"},
+		},
+		{
+			name:       "set of rows",
+			fn:         function{name: "resources", returnType: "skabelon.resource", returnsSet: true}, //nolint:exhaustruct
+			names:      []string{"fun"},
+			modes:      []string{"i"},
+			types:      []string{"boolean"},
+			attributes: []string{"id", "rkey"},
+			wantArgs:   []argument{{name: "fun", typ: "boolean", variadic: false, optional: false}},
+			wantCols:   []string{"id", "rkey"},
+		},
+		{
+			name:     "returns table",
+			fn:       function{name: "stats", returnType: "record", returnsSet: true}, //nolint:exhaustruct
+			names:    []string{"since", "day", "count"},
+			modes:    []string{"i", "t", "t"},
+			types:    []string{"date", "date", "bigint"},
+			wantArgs: []argument{{name: "since", typ: "date", variadic: false, optional: false}},
+			wantCols: []string{"day", "count"},
+		},
+		{
+			name:    "unnamed argument",
+			fn:      function{name: "f", returnType: "integer"}, //nolint:exhaustruct
+			names:   []string{},
+			modes:   []string{"i"},
+			types:   []string{"integer"},
+			wantErr: ErrUnprocessable,
+		},
+		{
+			name:    "records without columns",
+			fn:      function{name: "f", returnType: "record", returnsSet: true}, //nolint:exhaustruct
+			wantErr: ErrUnprocessable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			fn, err := newFunction(tt.fn, tt.defaults, tt.names, tt.modes, tt.types, tt.attributes)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if !slices.Equal(fn.args, tt.wantArgs) {
+				t.Errorf("got args %v, want %v", fn.args, tt.wantArgs)
+			}
+
+			if !slices.Equal(fn.columns, tt.wantCols) {
+				t.Errorf("got columns %v, want %v", fn.columns, tt.wantCols)
+			}
+		})
+	}
+}
+
+func TestFunctionCallExpr(t *testing.T) {
+	t.Parallel()
+
+	fn := function{ //nolint:exhaustruct
+		name: "f",
+		args: []argument{
+			{name: "n", typ: "integer", variadic: false, optional: false},
+			{name: "tags", typ: "text[]", variadic: false, optional: true},
+			{name: "data", typ: "jsonb", variadic: false, optional: true},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		want     string
+		wantArgs []any
+		wantErr  error
+	}{
+		{
+			name:     "required only",
+			body:     `{"n": 1}`,
+			want:     `"s"."f"("n" => $1::text::integer)`,
+			wantArgs: []any{"1"},
+		},
+		{
+			name: "coerced",
+			body: `{"n": "2", "tags": ["a", "b"], "data": {"a": 1}}`,
+			want: `"s"."f"("n" => $1::text::integer, ` +
+				`"tags" => ARRAY(SELECT jsonb_array_elements_text($2::jsonb))::text[], "data" => $3::text::jsonb)`,
+			wantArgs: []any{"2", `["a", "b"]`, `{"a": 1}`},
+		},
+		{
+			name:     "null",
+			body:     `{"n": null}`,
+			want:     `"s"."f"("n" => $1::text::integer)`,
+			wantArgs: []any{nil},
+		},
+		{
+			name:    "missing argument",
+			body:    `{"tags": []}`,
+			wantErr: ErrInvalidBody,
+		},
+		{
+			name:    "unknown argument",
+			body:    `{"n": 1, "m": 2}`,
+			wantErr: ErrInvalidBody,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var values map[string]json.RawMessage
+
+			err := json.Unmarshal([]byte(tt.body), &values)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var args []any
+
+			got, err := fn.callExpr("s", values, &args, ErrInvalidBody)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+
+			if err == nil && !slices.Equal(args, tt.wantArgs) {
+				t.Errorf("got args %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestFunctionQueryArgs(t *testing.T) {
+	t.Parallel()
+
+	fn := function{ //nolint:exhaustruct
+		name: "f",
+		args: []argument{
+			{name: "n", typ: "integer", variadic: false, optional: false},
+			{name: "data", typ: "jsonb", variadic: false, optional: true},
+		},
+	}
+
+	values, rest, err := fn.queryArgs(url.Values{"n": {"1"}, "data": {`{"a":1}`}, "_limit": {"5"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(values["n"]) != `"1"` || string(values["data"]) != `{"a":1}` {
+		t.Errorf("got values %s", values)
+	}
+
+	if rest.Encode() != "_limit=5" {
+		t.Errorf("got rest %s", rest.Encode())
+	}
+
+	_, _, err = fn.queryArgs(url.Values{"data": {"{"}})
+	if !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("got error %v, want %v", err, ErrInvalidQuery)
+	}
+}
@@ -0,0 +1,194 @@
+package dbx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Soft delete
+//
+// Relations with soft delete keep deleted rows, with the time they were deleted in a column.
+// Reads leave them out unless include_deleted=true, POST /{id}/_restore undeletes them,
+// and a RetentionRule on the column hard-deletes them after a retention period.
+
+// includeDeletedParam is the query parameter that includes soft-deleted rows in reads.
+const includeDeletedParam = "include_deleted"
+
+// SoftDelete makes deletes set a column instead of removing rows.
+type SoftDelete struct {
+	// Column is the timestamptz column that is set when a row is deleted, such as deleted_at.
+	// Deletes remove rows if it is empty.
+	Column string
+
+	// ShowDeleted decides if the requester can read soft-deleted rows with include_deleted=true.
+	// Nobody can if it is nil.
+	ShowDeleted func(ctx context.Context) bool
+}
+
+// parseIncludeDeleted returns the value of the include_deleted query parameter.
+func (r Relation) parseIncludeDeleted(values url.Values) (bool, error) {
+	if !values.Has(includeDeletedParam) {
+		return false, nil
+	}
+
+	if r.SoftDelete.Column == "" {
+		return false, fmt.Errorf("%w: %s needs a relation with soft delete", ErrInvalidQuery, includeDeletedParam)
+	}
+
+	include, err := strconv.ParseBool(values.Get(includeDeletedParam))
+	if err != nil {
+		return false, fmt.Errorf("%w: %s must be true or false", ErrInvalidQuery, includeDeletedParam)
+	}
+
+	return include, nil
+}
+
+// checkIncludeDeleted returns ErrForbidden if soft-deleted rows are included, and the requester cannot see them.
+func (r Relation) checkIncludeDeleted(ctx context.Context, include bool) error {
+	if include && (r.SoftDelete.ShowDeleted == nil || !r.SoftDelete.ShowDeleted(ctx)) {
+		return fmt.Errorf("%w: cannot read deleted resources", ErrForbidden)
+	}
+
+	return nil
+}
+
+// visible returns the condition for rows of the alias that are not soft-deleted,
+// or "true" if soft-deleted rows are included or the relation has no soft delete.
+func (r Relation) visible(alias string, includeDeleted bool) string {
+	if r.SoftDelete.Column == "" || includeDeleted {
+		return "true"
+	}
+
+	return alias + "." + quoteIdentifier(r.SoftDelete.Column) + " IS NULL"
+}
+
+// checkVisible returns ErrNotFound if the resource with key is soft-deleted or purged, unless includeDeleted.
+// Relations without soft delete have nothing to hide, so the history of their deleted rows stays readable.
+func (s *CRUDHandler) checkVisible(ctx context.Context, db rowQuerier, key keyValue, includeDeleted bool) error {
+	if s.rel.SoftDelete.Column == "" || includeDeleted {
+		return nil
+	}
+
+	var args []any
+
+	qry := fmt.Sprintf(`SELECT EXISTS (SELECT FROM %s AS _dbx WHERE %s AND %s)`,
+		s.rel.identifier(),
+		s.rel.keyWhere("_dbx", key, &args),
+		s.rel.visible("_dbx", false),
+	)
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	var exists bool
+
+	err := db.QueryRow(ctx, qry, args...).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("could not get resource: %w", err)
+	}
+
+	if !exists {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// restore undeletes a soft-deleted resource.
+// Restoring a resource that is not deleted changes nothing, and returns it as it is.
+func (s *CRUDHandler) restore(key keyValue, req *http.Request, prefs preferences, opts responseOptions) (resource, error) {
+	if s.rel.SoftDelete.Column == "" {
+		return resource{}, ErrNotFound
+	}
+
+	ctx := req.Context()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return resource{}, fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = s.lockRow(ctx, tx, key)
+	if err != nil {
+		return resource{}, err
+	}
+
+	_, err = s.checkPreconditions(ctx, tx, key, req, true)
+	if err != nil {
+		return resource{}, err
+	}
+
+	oldRow, err := s.auditRow(ctx, tx, key)
+	if err != nil {
+		return resource{}, err
+	}
+
+	var args []any
+
+	qry := fmt.Sprintf(`WITH %[1]s AS (
+		UPDATE %[2]s AS _dbx
+		SET %[4]s = NULL
+		WHERE %[6]s AND _dbx.%[4]s IS NOT NULL
+		RETURNING _dbx.*, %[3]s
+		)
+		SELECT %[5]s FROM %[1]s`,
+		rowsAlias,
+		s.rel.identifier(),
+		s.rel.metaSelect("_dbx"),
+		quoteIdentifier(s.rel.SoftDelete.Column),
+		s.rel.responseSelect(s.rel.readable(), opts),
+		s.rel.keyWhere("_dbx", key, &args),
+	)
+
+	slog.InfoContext(ctx, "ready to query db", "query", qry)
+
+	var res resource
+
+	err = tx.QueryRow(ctx, qry, args...).Scan(&res.response, &res.etag, &res.lastModified, &res.id)
+	if errors.Is(err, sql.ErrNoRows) {
+		// not deleted, so there is nothing to write, or missing, which getOne reports as ErrNotFound
+		res, err = s.getOne(ctx, tx, s.rel.readable(), key, false, opts)
+		if err != nil {
+			return resource{}, err
+		}
+
+		err = prefs.finish(ctx, tx)
+		if err != nil {
+			return resource{}, err
+		}
+
+		return res, nil
+	}
+
+	if err != nil {
+		return resource{}, fmt.Errorf("could not restore resource: %w", err)
+	}
+
+	err = s.recordOutbox(ctx, tx, writeUpdate, res.id)
+	if err != nil {
+		return resource{}, err
+	}
+
+	newRow, err := s.auditRow(ctx, tx, res.id)
+	if err != nil {
+		return resource{}, err
+	}
+
+	err = s.recordAudit(ctx, tx, writeUpdate, res.id, oldRow, newRow)
+	if err != nil {
+		return resource{}, err
+	}
+
+	err = prefs.finish(ctx, tx)
+	if err != nil {
+		return resource{}, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,91 @@
+package dbx
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestIncludeDeleted(t *testing.T) {
+	t.Parallel()
+
+	admin := func(ctx context.Context) bool {
+		identity, _ := IdentityFrom(ctx)
+
+		return identity == "admin"
+	}
+
+	tests := []struct {
+		name       string
+		rel        Relation
+		query      string
+		identity   string
+		wantQuery  error
+		wantPolicy error
+		wantWhere  string
+	}{
+		{
+			name:      "deleted rows are left out",
+			rel:       Relation{Schema: "s", Name: "n", SoftDelete: SoftDelete{Column: "deleted_at"}}, //nolint:exhaustruct
+			query:     "",
+			wantWhere: `_dbx."deleted_at" IS NULL`,
+		},
+		{
+			name:      "include deleted rows",
+			rel:       Relation{Schema: "s", Name: "n", SoftDelete: SoftDelete{Column: "deleted_at", ShowDeleted: admin}}, //nolint:exhaustruct,lll
+			query:     "include_deleted=true",
+			identity:  "admin",
+			wantWhere: "true",
+		},
+		{
+			name:       "include deleted rows without permission",
+			rel:        Relation{Schema: "s", Name: "n", SoftDelete: SoftDelete{Column: "deleted_at", ShowDeleted: admin}}, //nolint:exhaustruct,lll
+			query:      "include_deleted=true",
+			identity:   "someone",
+			wantPolicy: ErrForbidden,
+		},
+		{
+			name:      "invalid value",
+			rel:       Relation{Schema: "s", Name: "n", SoftDelete: SoftDelete{Column: "deleted_at"}}, //nolint:exhaustruct
+			query:     "include_deleted=maybe",
+			wantQuery: ErrInvalidQuery,
+		},
+		{
+			name:      "relation without soft delete",
+			rel:       Relation{Schema: "s", Name: "n"}, //nolint:exhaustruct
+			query:     "include_deleted=true",
+			wantQuery: ErrInvalidQuery,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			values, _ := url.ParseQuery(tt.query)
+
+			include, err := tt.rel.parseIncludeDeleted(values)
+			if !errors.Is(err, tt.wantQuery) {
+				t.Fatalf("got error %v, want %v", err, tt.wantQuery)
+			}
+
+			if err != nil {
+				return
+			}
+
+			err = tt.rel.checkIncludeDeleted(WithIdentity(t.Context(), tt.identity), include)
+			if !errors.Is(err, tt.wantPolicy) {
+				t.Fatalf("got error %v, want %v", err, tt.wantPolicy)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if got := tt.rel.visible("_dbx", include); got != tt.wantWhere {
+				t.Errorf("got %s, want %s", got, tt.wantWhere)
+			}
+		})
+	}
+}
@@ -10,7 +10,7 @@ import (
 	"log/slog"
 	"net/http"
 	"regexp"
-	"strconv"
+	"slices"
 	"strings"
 
 	"github.com/jackc/pgx/v5"
@@ -23,8 +23,14 @@ import (
 type CRUDHandler struct {
 	http.Handler
 
-	db  *pgxpool.Pool
-	rel Relation
+	db      *pgxpool.Pool
+	rel     Relation
+	ops     *Operations
+	events  *Events
+	outbox  *Outbox
+	writes  writes
+	view    bool
+	lookups []KeyColumn
 }
 
 // TODO proper structure
@@ -37,16 +43,122 @@ type CRUDHandler struct {
 //nolint:funlen,cyclop
 func NewCRUDHandler(db *pgxpool.Pool, relation Relation) *CRUDHandler {
 	srv := CRUDHandler{ //nolint:exhaustruct
-		db:  db,
-		rel: relation,
+		db:     db,
+		rel:    relation,
+		writes: allWrites,
 	}
 
 	mux := http.NewServeMux()
-	// getOne endpoint based on id
-	mux.HandleFunc("GET /{id}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		id, err := strconv.Atoi(req.PathValue("id"))
+	// list endpoint with filters
+	mux.HandleFunc("GET /{$}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mediaType, ok := negotiate(w, req, readMediaTypes()...)
+		if !ok {
+			return
+		}
+
+		prefs := newPreferences(req, header.PreferHandling, metaPreference)
+
+		q, err := srv.rel.parseQuery(req.URL.Query(), prefs.handling)
+		if err == nil {
+			err = srv.rel.checkIncludeDeleted(req.Context(), q.IncludeDeleted)
+		}
+
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		opts, err := newResponseOptions(req).withMediaType(mediaType)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		ctx := req.Context()
+
+		// etag and list must see the same snapshot
+		tx, err := srv.db.BeginTx(ctx, pgx.TxOptions{ //nolint:exhaustruct
+			IsoLevel:   pgx.RepeatableRead,
+			AccessMode: pgx.ReadOnly,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "could not start transaction",
+				"relation", relation.Name,
+				"schema", relation.Schema,
+				"operation", "list",
+				"error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		etagStr, err := srv.collectionETag(ctx, tx, q, opts)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		reqHeaders, err := header.ParseRequest(req.Header)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		prefs.setApplied(w)
+
+		var etag *header.ETag
+
+		if etagStr != "" {
+			tag := header.NewETag(true, etagStr)
+			etag = &tag
+			w.Header().Set(header.NameEtag, etag.String())
+		}
+
+		if status := header.EvaluatePreconditions(reqHeaders, req.Method, etag, nil, true).Status(); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+
+		err = srv.list(ctx, tx, newListWriter(w, q.Select, opts), q)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}))
+
+	// getOne endpoint based on id, or a unique column
+	getOne := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key, err := srv.locate(req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		mediaType, ok := negotiate(w, req, readMediaTypes()...)
+		if !ok {
+			return
+		}
+
+		opts, err := newResponseOptions(req).withMediaType(mediaType)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		asOf, err := srv.rel.parseAsOf(req.URL.Query())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		includeDeleted, err := srv.rel.parseIncludeDeleted(req.URL.Query())
+		if err == nil {
+			err = srv.rel.checkIncludeDeleted(req.Context(), includeDeleted)
+		}
+
 		if err != nil {
-			http.Error(w, "invalid id", http.StatusBadRequest)
+			writeError(w, err)
 			return
 		}
 
@@ -65,73 +177,426 @@ func NewCRUDHandler(db *pgxpool.Pool, relation Relation) *CRUDHandler {
 		}
 		defer tx.Rollback(req.Context())
 
-		str, etagStr, err := srv.getOne(ctx, tx, srv.rel.Columns, id)
+		fields := srv.rel.readable()
+
+		var res resource
+
+		if asOf != nil {
+			// a version of a resource that is deleted now is as hidden as the resource
+			err = srv.checkVisible(ctx, tx, key, includeDeleted)
+			if err == nil {
+				res, err = srv.getVersion(ctx, tx, fields, key, *asOf, includeDeleted, opts)
+			}
+		} else {
+			res, err = srv.getOne(ctx, tx, fields, key, includeDeleted, opts)
+		}
+
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, err)
+			return
+		}
+
+		reqHeaders, err := header.ParseRequest(req.Header)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		newPreferences(req, metaPreference).setApplied(w)
+		res.setValidators(w)
+
+		etag := res.ETag()
+		if status := header.EvaluatePreconditions(reqHeaders, req.Method, &etag, res.lastModified, true).Status(); status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+
+		newRepresentationWriter(w, fields, opts).write(res.response)
+	})
+
+	mux.Handle("GET /{id}", getOne)
+	mux.Handle("GET /by/{column}/{value}", getOne)
+
+	// updateOne endpoint based on id, or a unique column
+	updateOne := func(w http.ResponseWriter, req *http.Request) {
+		key, err := srv.locate(req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		mediaType, ok := negotiate(w, req, mediaTypeJSON)
+		if !ok {
+			return
+		}
+
+		opts, err := newResponseOptions(req).withMediaType(mediaType)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		prefs := newPreferences(req, header.PreferReturn, header.PreferHandling, header.PreferTx, metaPreference)
+
+		rawJSON, err := NewRawJSONObjectFromRequest(req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		res, err := srv.update(key, req, rawJSON, prefs, opts)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		prefs.writeResource(w, res, newRepresentationWriter(w, srv.rel.readable(), opts), http.StatusOK)
+	}
+
+	mux.HandleFunc("PATCH /{id}", srv.requires(writeUpdate, srv.itemMethods, updateOne))
+	mux.HandleFunc("PATCH /by/{column}/{value}", srv.requires(writeUpdate, srv.lookupMethods, updateOne))
+
+	// deleteOne endpoint based on id, or a unique column
+	deleteOne := func(w http.ResponseWriter, req *http.Request) {
+		key, err := srv.locate(req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		prefs := newPreferences(req, header.PreferTx)
+
+		err = srv.delete(key, req, prefs)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		prefs.setApplied(w)
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	mux.HandleFunc("DELETE /{id}", srv.requires(srv.deleteWrite(), srv.itemMethods, deleteOne))
+	mux.HandleFunc("DELETE /by/{column}/{value}", srv.requires(srv.deleteWrite(), srv.lookupMethods, deleteOne))
+
+	// upsert endpoint based on a unique column
+	mux.HandleFunc("PUT /by/{column}/{value}", srv.requires(writeInsert, srv.lookupMethods,
+		srv.requires(writeUpdate, srv.lookupMethods, func(w http.ResponseWriter, req *http.Request) {
+			column, value, err := srv.lookup(req)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			mediaType, ok := negotiate(w, req, mediaTypeJSON)
+			if !ok {
+				return
+			}
+
+			opts, err := newResponseOptions(req).withMediaType(mediaType)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			rawJSON, err := NewRawJSONObjectFromRequest(req)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			prefs := newPreferences(req, header.PreferReturn, header.PreferHandling, header.PreferTx, metaPreference)
+
+			res, created, err := srv.put(column, value, req, rawJSON, prefs, opts)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			if !created {
+				prefs.writeResource(w, res, newRepresentationWriter(w, srv.rel.readable(), opts), http.StatusOK)
+				return
+			}
+
+			w.Header().Set("Location", basePath(req)+"/"+res.id.path())
+			prefs.writeResource(w, res, newRepresentationWriter(w, srv.rel.readable(), opts), http.StatusCreated)
+		})))
+
+	mux.HandleFunc("POST /", srv.requires(writeInsert, srv.collectionMethods, func(w http.ResponseWriter, req *http.Request) {
+		slog.InfoContext(req.Context(), "post")
+
+		mediaType, ok := negotiate(w, req, mediaTypeJSON)
+		if !ok {
+			return
+		}
+
+		opts, err := newResponseOptions(req).withMediaType(mediaType)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		prefs := newPreferences(req, header.PreferReturn, header.PreferHandling, header.PreferTx, metaPreference)
+
+		rawJSON, err := NewRawJSONObjectFromRequest(req)
+		if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		etag := header.NewETag(false, etagStr)
-		ifMatch := req.Header.Get(header.NameIfMatch)
+		res, err := srv.create(req, rawJSON, prefs, opts)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Location", basePath(req)+"/"+res.id.path())
+		prefs.writeResource(w, res, newRepresentationWriter(w, srv.rel.readable(), opts), http.StatusCreated)
+	}))
 
-		if ifMatch != "" {
-			match, err := header.ParseMatch(ifMatch)
+	// bulk import with copy
+	mux.HandleFunc("POST /_import", srv.requires(writeInsert, noMethods, func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := negotiate(w, req, mediaTypeJSON); !ok {
+			return
+		}
+
+		opts, err := srv.rel.parseImportOptions(req.URL.Query())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		prefs := newPreferences(req, srv.preferAsync(header.PreferTx)...)
+
+		if prefs.async {
+			id, err := srv.importAsync(req, opts, prefs)
 			if err != nil {
-				http.Error(w, "invalid If-Match header", http.StatusBadRequest)
+				writeError(w, err)
 				return
 			}
 
-			if match.MatchStrong(etag) {
-				w.WriteHeader(http.StatusNotModified)
+			srv.writeAccepted(w, req, prefs, id)
+
+			return
+		}
+
+		src, err := newImportSource(req.Header.Get(header.NameContentType), req.Body)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		res, err := srv.importAll(req.Context(), src, opts, prefs)
+
+		var fieldErrs FieldErrors
+		if errors.As(err, &fieldErrs) && res.Rows > 0 {
+			writeProblem(w, Problem{ //nolint:exhaustruct
+				Status: http.StatusUnprocessableEntity,
+				Detail: "one or more rows cannot be imported, nothing was imported",
+				Errors: fieldErrs,
+				Rows:   res.Rows,
+			})
+
+			return
+		}
+
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		prefs.setApplied(w)
+		w.Header().Set(header.NameContentType, mediaTypeJSON.String())
+		json.NewEncoder(w).Encode(res) //nolint:errcheck,errchkjson
+	}))
+
+	// full export with copy
+	mux.HandleFunc("GET /_export", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		prefs := newPreferences(req, srv.preferAsync(header.PreferHandling)...)
+
+		format, q, err := srv.rel.parseExport(req.URL.Query(), prefs.handling)
+		if err == nil {
+			err = srv.rel.checkIncludeDeleted(req.Context(), q.IncludeDeleted)
+		}
+
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if prefs.async {
+			id, err := srv.exportAsync(req.Context(), format, q)
+			if err != nil {
+				writeError(w, err)
 				return
 			}
+
+			srv.writeAccepted(w, req, prefs, id)
+
+			return
+		}
+
+		prefs.setApplied(w)
+		w.Header().Add(header.NameVary, header.NameAcceptEncoding)
+
+		ew := &exportWriter{ //nolint:exhaustruct
+			w:        w,
+			format:   format,
+			filename: srv.rel.Name,
+			compress: header.AcceptsEncoding(req.Header.Values(header.NameAcceptEncoding), "gzip"),
+		}
+
+		err = srv.export(req.Context(), ew, format, q)
+		if err != nil {
+			writeError(w, ew.abort(req.Context(), err))
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("ETag", etag.String())
-		w.Write([]byte(str)) //nolint:errcheck,gosec
+		ew.close()
 	}))
 
-	// updateOne endpoint based on id
-	mux.HandleFunc("PATCH /{id}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		id, err := strconv.Atoi(req.PathValue("id"))
+	// undelete a soft-deleted resource
+	mux.HandleFunc("POST /{id}/_restore", srv.requires(writeUpdate, noMethods, func(w http.ResponseWriter, req *http.Request) {
+		key, err := srv.rel.parseKey(req.PathValue("id"))
 		if err != nil {
-			http.Error(w, "invalid id", http.StatusBadRequest)
+			writeError(w, err)
 			return
 		}
 
-		str, err := srv.update(id, req)
+		mediaType, ok := negotiate(w, req, mediaTypeJSON)
+		if !ok {
+			return
+		}
+
+		opts, err := newResponseOptions(req).withMediaType(mediaType)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		prefs := newPreferences(req, header.PreferReturn, header.PreferTx, metaPreference)
+
+		res, err := srv.restore(key, req, prefs, opts)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		prefs.writeResource(w, res, newRepresentationWriter(w, srv.rel.readable(), opts), http.StatusOK)
+	}))
+
+	// subresources of a resource.
+	// They share one pattern, since GET /{id}/_history would conflict with GET /_operations/{operation}.
+	mux.HandleFunc("GET /{id}/{subresource}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key, err := srv.rel.parseKey(req.PathValue("id"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		if _, ok := negotiate(w, req, mediaTypeJSON); !ok {
+			return
+		}
+
+		// the history of a soft-deleted resource is as hidden as the resource
+		includeDeleted, err := srv.rel.parseIncludeDeleted(req.URL.Query())
+		if err == nil {
+			err = srv.rel.checkIncludeDeleted(req.Context(), includeDeleted)
+		}
+
+		if err == nil {
+			err = srv.checkVisible(req.Context(), srv.db, key, includeDeleted)
+		}
+
 		if err != nil {
-			if errors.Is(err, ErrNotFound) {
-				http.Error(w, err.Error(), http.StatusNotFound)
+			writeError(w, err)
+			return
+		}
+
+		switch req.PathValue("subresource") {
+		case "_history":
+			entries, err := srv.history(req.Context(), key, req.URL.Query())
+			if err != nil {
+				writeError(w, err)
 				return
 			}
 
-			if errors.Is(err, ErrPreconditionFailed) {
-				http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			w.Header().Set(header.NameContentType, mediaTypeJSON.String())
+			io.WriteString(w, entries) //nolint:errcheck,gosec
+		case "_versions":
+			versions, err := srv.versions(req.Context(), key, req.URL.Query())
+			if err != nil {
+				writeError(w, err)
 				return
 			}
 
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			w.Header().Set(header.NameContentType, mediaTypeJSON.String())
+			json.NewEncoder(w).Encode(versions) //nolint:errcheck,errchkjson
+		default:
+			writeError(w, ErrNotFound)
+		}
+	}))
 
+	// change stream
+	mux.HandleFunc("GET /_events", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, ok := negotiate(w, req, mediaTypeEventStream); !ok {
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(str)) //nolint:errcheck,gosec
+		err := srv.serveEvents(w, req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 	}))
 
-	mux.HandleFunc("POST /", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		slog.InfoContext(req.Context(), "post")
+	// status of long-running operations
+	mux.HandleFunc("GET /_operations/{operation}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if srv.ops == nil {
+			writeError(w, ErrNotFound)
+			return
+		}
 
-		str, err := srv.create(req)
+		operation, status, err := srv.ops.get(req.Context(), srv.rel, req.PathValue("operation"), basePath(req))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, err)
+			return
+		}
+
+		if status == statusPending || status == statusRunning {
+			w.Header().Set("Retry-After", "1")
+		}
+
+		w.Header().Set(header.NameContentType, mediaTypeJSON.String())
+		w.Write([]byte(operation)) //nolint:errcheck,gosec
+	}))
+
+	mux.HandleFunc("DELETE /_operations/{operation}", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if srv.ops == nil {
+			writeError(w, ErrNotFound)
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(str)) //nolint:errcheck,gosec
+		err := srv.ops.cancel(req.Context(), srv.rel, req.PathValue("operation"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("GET /_operations/{operation}/result", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if srv.ops == nil {
+			writeError(w, ErrNotFound)
+			return
+		}
+
+		err := srv.ops.serveResult(w, req, srv.rel, req.PathValue("operation"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 	}))
 
 	srv.Handler = mux
@@ -150,6 +615,25 @@ var (
 	ErrInvalidFieldIdentifier = errors.New("invalid key identifier")
 	// ErrEmptyObject is returned when a RawJSONObject is empty.
 	ErrEmptyObject = errors.New("empty object")
+	// ErrInvalidBody is returned when a request body cannot be decoded - HTTP 400.
+	ErrInvalidBody = errors.New("invalid body")
+	// ErrInvalidQuery is returned when the query parameters of a request are invalid - HTTP 400.
+	ErrInvalidQuery = errors.New("invalid query")
+	// ErrUnprocessable is returned when a request is well-formed, but cannot be processed - HTTP 422.
+	ErrUnprocessable = errors.New("unprocessable entity")
+	// ErrNotAcceptable is returned when a response cannot be produced in an acceptable media type - HTTP 406.
+	ErrNotAcceptable = errors.New("not acceptable")
+	// ErrUnsupportedMediaType is returned when a request body has a media type that is not supported - HTTP 415.
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+	// ErrUnavailable is returned when the server is too busy to take a request - HTTP 503.
+	ErrUnavailable = errors.New("unavailable")
+)
+
+// Kinds of writes, as recorded in the outbox and the audit log.
+const (
+	writeInsert = "insert"
+	writeUpdate = "update"
+	writeDelete = "delete"
 )
 
 // RawJSONObject a struct for holding raw JSON messages while keeping order.
@@ -170,7 +654,7 @@ func NewRawJSONObjectFromRequest(req *http.Request) (*RawJSONObject, error) {
 
 	err = json.Unmarshal(body, &rawJSON)
 	if err != nil {
-		return nil, fmt.Errorf("could decode body: %w", err)
+		return nil, fmt.Errorf("%w: could not decode body: %w", ErrInvalidBody, err)
 	}
 
 	if len(rawJSON.fields) == 0 {
@@ -228,6 +712,45 @@ func (rjo *RawJSONObject) Values() []any {
 	return rjo.values
 }
 
+// retain removes the fields, and their values, that keep returns false for.
+func (rjo *RawJSONObject) retain(keep func(field string) bool) {
+	fields := rjo.fields[:0]
+	values := rjo.values[:0]
+
+	for i, field := range rjo.fields {
+		if keep(field) {
+			fields = append(fields, field)
+			values = append(values, rjo.values[i])
+		}
+	}
+
+	rjo.fields = fields
+	rjo.values = values
+}
+
+// value returns the value of field, and whether the object has the field.
+func (rjo *RawJSONObject) value(field string) (any, bool) {
+	idx := slices.Index(rjo.fields, field)
+	if idx < 0 {
+		return nil, false
+	}
+
+	return rjo.values[idx], true
+}
+
+// set sets field to value, adding the field if the object does not have it.
+func (rjo *RawJSONObject) set(field string, value any) {
+	idx := slices.Index(rjo.fields, field)
+	if idx < 0 {
+		rjo.fields = append(rjo.fields, field)
+		rjo.values = append(rjo.values, value)
+
+		return
+	}
+
+	rjo.values[idx] = value
+}
+
 func databaseType(jrm json.RawMessage) string {
 	firstByte := jrm[0]
 	switch firstByte {
@@ -249,88 +772,119 @@ func databaseType(jrm json.RawMessage) string {
 }
 
 // getOne returns a single resource.
-// Returns response, etag and error.
 // Error is ErrNotFound if the resource is not found.
-func (s *CRUDHandler) getOne(ctx context.Context, tx pgx.Tx, fields []string, id int) (string, string, error) {
-	qry := fmt.Sprintf(`SELECT
-			( select row_to_json(_obj) from (select %[1]s) as _obj ) as _response,
-			_etag
-		FROM "%[2]s"."%[3]s" _dbx  WHERE  "id" = $1 LIMIT 1`,
-		strings.Join(prependIdentifier("_dbx", fields), " ,"),
-		s.rel.Schema,
-		s.rel.Name,
+func (s *CRUDHandler) getOne(
+	ctx context.Context, tx pgx.Tx, fields []string, key keyValue, includeDeleted bool, opts responseOptions,
+) (resource, error) {
+	var args []any
+
+	qry := fmt.Sprintf(`WITH %[1]s AS (
+			SELECT _dbx.*, %[2]s
+			FROM %[3]s AS _dbx WHERE %[6]s AND %[5]s LIMIT 1
+		)
+		SELECT %[4]s FROM %[1]s`,
+		rowsAlias,
+		s.rel.metaSelect("_dbx"),
+		s.rel.identifier(),
+		s.rel.responseSelect(fields, opts),
+		s.rel.visible("_dbx", includeDeleted),
+		s.rel.keyWhere("_dbx", key, &args),
 	)
 
 	slog.InfoContext(ctx, "query prepped", "query", qry)
 
-	row := tx.QueryRow(ctx, qry, id)
+	row := tx.QueryRow(ctx, qry, args...)
 
-	var (
-		response string
-		etag     string
-	)
+	var res resource
 
-	switch err := row.Scan(&response, &etag); {
+	switch err := row.Scan(&res.response, &res.etag, &res.lastModified, &res.id); {
 	case errors.Is(err, sql.ErrNoRows):
-		return "", "", ErrNotFound
+		return resource{}, ErrNotFound
 	case err == nil:
-		return response, etag, nil
+		return res, nil
 	default:
-		panic(err)
+		return resource{}, fmt.Errorf("could not get resource: %w", err)
 	}
 }
 
-func (s *CRUDHandler) create(req *http.Request) (string, error) {
+// writeFields checks the fields of rawJSON against the column policies of the relation.
+// Returns the fields and values to write in op, including server-assigned columns.
+// With lenient handling, unknown fields are ignored instead of rejected.
+func (s *CRUDHandler) writeFields(
+	ctx context.Context, op operation, rawJSON *RawJSONObject, handling string,
+) ([]string, []any, error) {
+	if handling == header.HandlingLenient {
+		rawJSON.retain(s.rel.known)
+
+		if len(rawJSON.Fields()) == 0 {
+			return nil, nil, ErrEmptyObject
+		}
+	}
+
+	err := s.rel.checkFields(op, rawJSON.Fields())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	assignedFields, assignedValues, err := s.rel.assign(ctx, op)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields := append(slices.Clone(rawJSON.Fields()), assignedFields...)
+	values := append(slices.Clone(rawJSON.Values()), assignedValues...)
+
+	return fields, values, nil
+}
+
+// create creates a resource from the fields of rawJSON.
+func (s *CRUDHandler) create(
+	req *http.Request, rawJSON *RawJSONObject, prefs preferences, opts responseOptions,
+) (resource, error) {
 	ctx := req.Context()
 
-	rawJSON, err := NewRawJSONObjectFromRequest(req)
+	fields, args, err := s.writeFields(ctx, opCreate, rawJSON, prefs.handling)
 	if err != nil {
-		return "", err
+		return resource{}, err
 	}
 
-	fields := rawJSON.Fields()
 	argNums := make([]string, len(fields))
 
 	for idx := range fields {
 		argNums[idx] = fmt.Sprintf("$%d", idx+1)
 	}
 
-	qry := fmt.Sprintf(`WITH _dbx_insert AS (
-		INSERT INTO "%[1]s"."%[2]s" ( %[4]s )
+	qry := fmt.Sprintf(`WITH %[1]s AS (
+		INSERT INTO %[2]s AS _dbx ( %[4]s )
 		VALUES ( %[5]s )
-		RETURNING %[3]s
+		RETURNING _dbx.*, %[3]s
 		)
-		SELECT
-		coalesce(json_agg(_dbx_res)->0, 'null') AS _response
-		FROM (
-			SELECT %[6]s FROM _dbx_insert
-			) _dbx_res;`,
-		s.rel.Schema,
-		s.rel.Name,
-		s.rel.returning(),
+		SELECT %[6]s FROM %[1]s`,
+		rowsAlias,
+		s.rel.identifier(),
+		s.rel.metaSelect("_dbx"),
 		strings.Join(quoteIdentifiers(fields), ", "),
 		strings.Join(argNums, ", "),
-		strings.Join(quoteIdentifiers(s.rel.Columns), ", "),
+		s.rel.responseSelect(s.rel.readable(), opts),
 	)
 
 	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return "", fmt.Errorf("could not begin transaction: %w", err)
+		return resource{}, fmt.Errorf("could not begin transaction: %w", err)
 	}
 
 	defer tx.Rollback(ctx)
 
-	args := rawJSON.Values()
 	row := tx.QueryRow(ctx, qry, args...)
 
 	slog.InfoContext(ctx, "ready to query db", "query", qry)
 
-	var response string
+	var res resource
 
-	err = row.Scan(&response)
+	err = row.Scan(&res.response, &res.etag, &res.lastModified, &res.id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return "", ErrNotFound
+			return resource{}, ErrNotFound
 		}
 
 		pgErr := &pq.Error{} //nolint:exhaustruct
@@ -338,97 +892,105 @@ func (s *CRUDHandler) create(req *http.Request) (string, error) {
 			slog.InfoContext(ctx, "pq error", "codename", pgErr.Code.Name(), "error", pgErr.Severity)
 		}
 
-		return "", fmt.Errorf("could not create resource: %w", err)
+		return resource{}, fmt.Errorf("could not create resource: %w", err)
+	}
+
+	err = s.recordOutbox(ctx, tx, writeInsert, res.id)
+	if err != nil {
+		return resource{}, err
+	}
+
+	newRow, err := s.auditRow(ctx, tx, res.id)
+	if err != nil {
+		return resource{}, err
 	}
 
-	return response, nil
+	err = s.recordAudit(ctx, tx, writeInsert, res.id, nil, newRow)
+	if err != nil {
+		return resource{}, err
+	}
+
+	err = prefs.finish(ctx, tx)
+	if err != nil {
+		return resource{}, err
+	}
+
+	return res, nil
 }
 
+// update updates a resource with the fields of rawJSON.
+//
 //nolint:funlen,cyclop
-func (s *CRUDHandler) update(id int, req *http.Request) (string, error) {
+func (s *CRUDHandler) update(
+	key keyValue, req *http.Request, rawJSON *RawJSONObject, prefs preferences, opts responseOptions,
+) (resource, error) {
 	ctx := req.Context()
 
-	rawJSON, err := NewRawJSONObjectFromRequest(req)
+	fields, args, err := s.writeFields(ctx, opUpdate, rawJSON, prefs.handling)
 	if err != nil {
-		return "", err
+		return resource{}, err
 	}
 
-	fields := rawJSON.Fields()
-
 	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return "", fmt.Errorf("could not begin transaction: %w", err)
+		return resource{}, fmt.Errorf("could not begin transaction: %w", err)
 	}
 	defer tx.Rollback(ctx)
 
-	ifMatch := req.Header.Get(header.NameIfMatch)
-	if ifMatch != "" { //nolint:nestif
-		match, err := header.ParseMatch(ifMatch)
-		if err != nil {
-			return "", fmt.Errorf("could not parse %s header: %w", header.NameIfMatch, header.ErrInvalidMatch)
-		}
-
-		// TODO: Compare current resource with the one in the request
-		// Return 200 if no updates
-		_, etagStr, err := s.getOne(ctx, tx, s.rel.Columns, id)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				return "", ErrNotFound
-			}
-
-			return "", err
-		}
+	err = s.lockRow(ctx, tx, key)
+	if err != nil {
+		return resource{}, err
+	}
 
-		etag := header.NewETag(false, etagStr)
+	// TODO: Compare current resource with the one in the request
+	// Return 200 if no updates
+	seen, err := s.checkPreconditions(ctx, tx, key, req, false)
+	if err != nil {
+		return resource{}, err
+	}
 
-		if !match.MatchStrong(etag) {
-			return "", fmt.Errorf("%w: %s does not match current resource", ErrPreconditionFailed, header.NameIfMatch)
-		}
+	oldRow, err := s.auditRow(ctx, tx, key)
+	if err != nil {
+		return resource{}, err
 	}
 
 	setList := make([]string, len(fields))
 
 	for idx, field := range fields {
-		setList[idx] = fmt.Sprintf("\"%s\" = $%d", field, idx+1)
+		setList[idx] = fmt.Sprintf("%s = $%d", quoteIdentifier(field), idx+1)
 	}
 
-	qry := fmt.Sprintf(`WITH _dbx_update AS (
-		UPDATE "%[1]s"."%[2]s"
+	qry := fmt.Sprintf(`WITH %[1]s AS (
+		UPDATE %[2]s AS _dbx
 		SET %[4]v
-		WHERE "id" = $%[5]d
-		RETURNING %[3]s
+		WHERE %[5]s AND %[7]s
+		RETURNING _dbx.*, %[3]s
 		)
-		SELECT
-			coalesce(json_agg(_dbx_res)->0, 'null') AS _response
-		FROM (
-			SELECT %[6]s FROM _dbx_update
-			) _dbx_res;`,
-		s.rel.Schema,
-		s.rel.Name,
-		s.rel.returning(),
+		SELECT %[6]s FROM %[1]s`,
+		rowsAlias,
+		s.rel.identifier(),
+		s.rel.metaSelect("_dbx"),
 		strings.Join(setList, ", "),
-		len(fields)+1,
-		strings.Join(quoteIdentifiers(s.rel.Columns), ", "),
+		s.rel.keyWhere("_dbx", key, &args),
+		s.rel.responseSelect(s.rel.readable(), opts),
+		s.rel.visible("_dbx", false),
 	)
 
-	args := rawJSON.Values()
-	args = append(args, id)
-
 	row := tx.QueryRow(ctx, qry, args...)
 
 	slog.InfoContext(ctx, "ready to query db", "query", qry)
 
-	var response string
+	var res resource
 
-	err = row.Scan(&response)
+	err = row.Scan(&res.response, &res.etag, &res.lastModified, &res.id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			if ifMatch != "" {
-				// We already evaluated If-Match and we know that the user can see the resource.
-				return "", ErrForbidden
+			if seen {
+				// We read the resource while evaluating the preconditions, so we know that the user can see it.
+				return resource{}, ErrForbidden
 			}
 
-			return "", ErrNotFound
+			return resource{}, ErrNotFound
 		}
 
 		pgErr := &pq.Error{} //nolint:exhaustruct
@@ -436,31 +998,181 @@ func (s *CRUDHandler) update(id int, req *http.Request) (string, error) {
 			slog.InfoContext(ctx, "pq error", "codename", pgErr.Code.Name(), "error", pgErr.Severity)
 		}
 
-		return "", fmt.Errorf("could not update resource: %w", err)
+		return resource{}, fmt.Errorf("could not update resource: %w", err)
+	}
+
+	err = s.recordOutbox(ctx, tx, writeUpdate, res.id)
+	if err != nil {
+		return resource{}, err
+	}
+
+	newRow, err := s.auditRow(ctx, tx, res.id)
+	if err != nil {
+		return resource{}, err
+	}
+
+	err = s.recordAudit(ctx, tx, writeUpdate, res.id, oldRow, newRow)
+	if err != nil {
+		return resource{}, err
+	}
+
+	err = prefs.finish(ctx, tx)
+	if err != nil {
+		return resource{}, err
+	}
+
+	return res, nil
+}
+
+// lockRow locks the row with key, if it exists, until the end of tx.
+// Writes lock the row before they read it, so that the preconditions and the audit log
+// see the row that is written, and not one that another transaction changes meanwhile.
+func (s *CRUDHandler) lockRow(ctx context.Context, tx pgx.Tx, key keyValue) error {
+	var args []any
+
+	qry := fmt.Sprintf(`SELECT FROM %s AS _dbx WHERE %s FOR UPDATE`,
+		s.rel.identifier(), s.rel.keyWhere("_dbx", key, &args))
+
+	slog.InfoContext(ctx, "query prepped", "query", qry)
+
+	_, err := tx.Exec(ctx, qry, args...)
+	if err != nil {
+		return fmt.Errorf("could not lock resource: %w", err)
+	}
+
+	return nil
+}
+
+// checkPreconditions evaluates the conditional headers of req against the current resource,
+// using the shared evaluator in [header.EvaluatePreconditions].
+// The entity tag is read with the ETag strategy of the relation, so conditional writes
+// work the same whichever strategy is used.
+// Returns true if the resource was read to evaluate the preconditions.
+// Error is ErrPreconditionFailed if a precondition failed.
+func (s *CRUDHandler) checkPreconditions(
+	ctx context.Context, tx pgx.Tx, key keyValue, req *http.Request, includeDeleted bool,
+) (bool, error) {
+	reqHeaders, err := header.ParseRequest(req.Header)
+	if err != nil {
+		return false, err
+	}
+
+	if !reqHeaders.Conditional() {
+		return false, nil
+	}
+
+	res, err := s.getOne(ctx, tx, s.rel.readable(), key, includeDeleted, responseOptions{}) //nolint:exhaustruct
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+
+	exists := err == nil
+	etag := res.ETag()
+
+	if header.EvaluatePreconditions(reqHeaders, req.Method, &etag, res.lastModified, exists).Status() != 0 {
+		return false, fmt.Errorf("%w: conditional headers do not match current resource", ErrPreconditionFailed)
+	}
+
+	return exists, nil
+}
+
+// delete deletes a resource.
+// Deleting follows the same read-and-write pattern as update when If-Match is present.
+func (s *CRUDHandler) delete(key keyValue, req *http.Request, prefs preferences) error {
+	ctx := req.Context()
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = s.lockRow(ctx, tx, key)
+	if err != nil {
+		return err
+	}
+
+	seen, err := s.checkPreconditions(ctx, tx, key, req, false)
+	if err != nil {
+		return err
+	}
+
+	// the deleted row is recorded, and is rolled back with the delete if it fails
+	err = s.recordOutbox(ctx, tx, writeDelete, key)
+	if err != nil {
+		return err
+	}
+
+	oldRow, err := s.auditRow(ctx, tx, key)
+	if err != nil {
+		return err
+	}
+
+	var args []any
+
+	where := s.rel.keyWhere("_dbx", key, &args)
+
+	qry := fmt.Sprintf(`DELETE FROM %s AS _dbx WHERE %s`, s.rel.identifier(), where)
+
+	if s.rel.SoftDelete.Column != "" {
+		qry = fmt.Sprintf(`UPDATE %[1]s AS _dbx SET %[2]s = now() WHERE %[4]s AND %[3]s`,
+			s.rel.identifier(), quoteIdentifier(s.rel.SoftDelete.Column), s.rel.visible("_dbx", false), where)
+	}
+
+	slog.InfoContext(ctx, "ready to query db", "query", qry)
+
+	tag, err := tx.Exec(ctx, qry, args...)
+	if err != nil {
+		return fmt.Errorf("could not delete resource: %w", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		if seen {
+			// We read the resource while evaluating the preconditions, so we know that the user can see it.
+			return ErrForbidden
+		}
+
+		return ErrNotFound
+	}
+
+	// soft-deleted rows are still there, with the column that marks them deleted
+	newRow, err := s.auditRow(ctx, tx, key)
+	if err != nil {
+		return err
 	}
 
-	err = tx.Commit(ctx)
+	err = s.recordAudit(ctx, tx, writeDelete, key, oldRow, newRow)
 	if err != nil {
-		return "", fmt.Errorf("could not commit transaction: %w", err)
+		return err
 	}
 
-	return response, nil
+	return prefs.finish(ctx, tx)
+}
+
+// quoteIdentifier quotes a sql identifier.
+func quoteIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
 }
 
 func quoteIdentifiers(s []string) []string {
 	qs := make([]string, len(s))
 	for i, v := range s {
-		qs[i] = fmt.Sprintf(`"%s"`, v)
+		qs[i] = quoteIdentifier(v)
 	}
 
 	return qs
 }
 
+// quoteLiteral quotes a sql string literal.
+func quoteLiteral(s string) string {
+	return `'` + strings.ReplaceAll(s, `'`, `''`) + `'`
+}
+
 func prependIdentifier(identifier string, identifiers []string) []string {
 	result := make([]string, len(identifiers))
 
 	for i, v := range identifiers {
-		result[i] = fmt.Sprintf(`"%s"."%s"`, identifier, v)
+		result[i] = identifier + "." + quoteIdentifier(v)
 	}
 
 	return result
@@ -2,16 +2,24 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"expvar"
 	"fmt"
 	"log"
 	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/krilor/skabelon/cdc"
 	"github.com/krilor/skabelon/dbx"
 	"github.com/krilor/skabelon/dev"
 )
@@ -80,7 +88,7 @@ func start(ctx context.Context) error {
 	}
 	defer db.Close()
 
-	service := dbx.NewCRUDHandler(db, dbx.Relation{
+	resource := dbx.Relation{
 		Schema: "skabelon",
 		Name:   "resource",
 		Columns: []string{
@@ -89,9 +97,191 @@ func start(ctx context.Context) error {
 			"is_fun",
 			"my_int",
 			"description",
+			"created_by",
+			"updated_at",
+			"deleted_at",
+		},
+		ReadOnly: []string{"id", "_etag", "updated_at", "deleted_at"},
+		Meta: dbx.Metadata{ //nolint:exhaustruct
+			ETag:      dbx.ETagRowHash{},
+			UpdatedAt: "updated_at",
+		},
+		Assigned: []dbx.Assigned{
+			{Column: "created_by", OnCreate: true, OnUpdate: false, Value: dbx.AssignIdentity},
+		},
+		// soft-deleted rows are purged after 30 days
+		Retention: dbx.RetentionRule{
+			Column:    "deleted_at",
+			OlderThan: 30 * 24 * time.Hour, //nolint:mnd
+		},
+		AuditTable:   "dbx_audit",
+		HistoryTable: "resource_history",
+		SoftDelete: dbx.SoftDelete{
+			Column: "deleted_at",
+			// Nobody reads deleted rows, since identities are claimed by clients.
+			// TODO: Allow admins once there is authentication.
+			ShowDeleted: nil,
+		},
+	}
+
+	service := dbx.NewCRUDHandler(db, resource)
+
+	err = service.Introspect(ctx)
+	if err != nil {
+		return fmt.Errorf("could not introspect resource: %w", err)
+	}
+
+	ops, err := dbx.NewOperations(ctx, db, dbx.OperationsConfig{
+		Schema:  "skabelon",
+		Table:   "dbx_operations",
+		Dir:     filepath.Join(os.TempDir(), "skabelon-operations"),
+		Workers: 4,  //nolint:mnd
+		Queue:   16, //nolint:mnd
+	})
+	if err != nil {
+		return fmt.Errorf("could not start operations: %w", err)
+	}
+	defer ops.Close()
+
+	service.UseOperations(ops)
+
+	err = service.UseHistory(ctx)
+	if err != nil {
+		return fmt.Errorf("could not start history: %w", err)
+	}
+
+	events := dbx.NewEvents(ctx, db, dbx.EventsConfig{
+		Channel: "dbx_events",
+		Replay:  1024, //nolint:mnd
+		Buffer:  64,   //nolint:mnd
+	})
+	defer events.Close()
+
+	err = service.UseEvents(ctx, events)
+	if err != nil {
+		return fmt.Errorf("could not start events: %w", err)
+	}
+
+	outbox := dbx.NewOutbox(ctx, db, dbx.OutboxConfig{
+		Schema:       "skabelon",
+		Table:        "dbx_outbox",
+		Webhooks:     "dbx_webhooks",
+		Batch:        50, //nolint:mnd
+		PollInterval: time.Second,
+		MaxAttempts:  12, //nolint:mnd
+		Lease:        time.Minute,
+		Client:       &http.Client{Timeout: 10 * time.Second}, //nolint:exhaustruct,mnd
+
+		AllowPrivateTargets: os.Getenv(webhooksAllowPrivateEnv) != "",
+	})
+	defer outbox.Close()
+
+	service.UseOutbox(outbox)
+
+	// webhook subscriptions, with secrets that can be written but never read
+	webhooks := dbx.NewCRUDHandler(db, dbx.Relation{ //nolint:exhaustruct
+		Schema:   "skabelon",
+		Name:     "dbx_webhooks",
+		Columns:  []string{"id", "url", "secret", "relation", "enabled", "created_by", "created_at"},
+		ReadOnly: []string{"id", "created_by", "created_at"},
+		Hidden:   []string{"secret"},
+		Meta: dbx.Metadata{ //nolint:exhaustruct
+			// a hash of the row would include the secret
+			ETag:      dbx.ETagXmin{},
+			CreatedAt: "created_at",
+		},
+		Assigned: []dbx.Assigned{
+			{Column: "created_by", OnCreate: true, OnUpdate: false, Value: dbx.AssignIdentity},
+		},
+	})
+
+	err = webhooks.Introspect(ctx)
+	if err != nil {
+		return fmt.Errorf("could not introspect webhooks: %w", err)
+	}
+
+	// webhooks receive every write, so they are only managed with the token, and not at all without one
+	if token := os.Getenv(webhooksTokenEnv); token != "" {
+		mux.Handle("/webhooks/", LoggingMiddleware(RequestIDMiddleware(TokenMiddleware(token, IdentityMiddleware(
+			http.StripPrefix("/webhooks", webhooks),
+		)))))
+	}
+
+	retention := dbx.NewRetentionScheduler(ctx, db, dbx.RetentionConfig{
+		Interval: 10 * time.Minute, //nolint:mnd
+		Batch:    1000,             //nolint:mnd
+		LockKey:  retentionLockKey,
+		DryRun:   os.Getenv(retentionDryRunEnv) != "",
+	},
+		resource,
+		dbx.Relation{ //nolint:exhaustruct
+			Schema: "skabelon",
+			Name:   "dbx_outbox",
+			Retention: dbx.RetentionRule{
+				Column:    "delivered_at",
+				OlderThan: 7 * 24 * time.Hour, //nolint:mnd
+				Filter:    "_dbx.status = 'delivered'",
+			},
+		},
+	)
+	defer retention.Close()
+
+	// metrics, such as rows purged by retention, also show the command line and memory of the process,
+	// so they are only served with the token, and not at all without one
+	if token := os.Getenv(metricsTokenEnv); token != "" {
+		mux.Handle("GET /debug/vars", LoggingMiddleware(RequestIDMiddleware(TokenMiddleware(token, expvar.Handler()))))
+	}
+
+	capture, err := startCapture(ctx, db, resource)
+	if err != nil {
+		return err
+	}
+
+	if capture != nil {
+		defer capture.Close()
+	}
+
+	// a receiver for the webhook sink, which logs the changes
+	mux.Handle("POST /_cdc", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for s := bufio.NewScanner(r.Body); s.Scan(); {
+			slog.InfoContext(r.Context(), "change received", "event", s.Text())
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// a read-only view, which only takes reads
+	stats := dbx.NewCRUDHandler(db, dbx.Relation{ //nolint:exhaustruct
+		Schema:  "skabelon",
+		Name:    "resource_stats",
+		Key:     []dbx.KeyColumn{{Name: "bucket", Type: dbx.KeyInt}},
+		Columns: []string{"bucket", "resources"},
+		Meta: dbx.Metadata{ //nolint:exhaustruct
+			ETag: dbx.ETagRowHash{},
 		},
 	})
-	mux.Handle("/resource/", LoggingMiddleware(http.StripPrefix("/resource", service)))
+
+	err = stats.Introspect(ctx)
+	if err != nil {
+		return fmt.Errorf("could not introspect resource stats: %w", err)
+	}
+
+	mux.Handle("/resource_stats/", LoggingMiddleware(RequestIDMiddleware(IdentityMiddleware(
+		http.StripPrefix("/resource_stats", stats),
+	))))
+
+	rpc, err := dbx.NewRPCHandler(ctx, db, "skabelon")
+	if err != nil {
+		return fmt.Errorf("could not start rpc: %w", err)
+	}
+
+	mux.Handle("/rpc/", LoggingMiddleware(RequestIDMiddleware(IdentityMiddleware(
+		http.StripPrefix("/rpc", rpc),
+	))))
+
+	mux.Handle("/resource/", LoggingMiddleware(RequestIDMiddleware(IdentityMiddleware(
+		http.StripPrefix("/resource", service),
+	))))
 
 	slog.InfoContext(ctx, "Starting server on http://localhost:8080...")
 
@@ -109,6 +299,65 @@ func start(ctx context.Context) error {
 	return nil
 }
 
+// retentionLockKey is the key of the advisory lock held while expired rows are purged.
+const retentionLockKey = 0x736b6162 // "skab"
+
+// retentionDryRunEnv is the environment variable that makes retention log the expired rows instead of purging them.
+const retentionDryRunEnv = "SKABELON_RETENTION_DRY_RUN"
+
+// webhooksTokenEnv is the environment variable with the bearer token that manages webhooks at /webhooks/.
+// Webhooks cannot be managed over HTTP when it is empty.
+const webhooksTokenEnv = "SKABELON_WEBHOOKS_TOKEN"
+
+// metricsTokenEnv is the environment variable with the bearer token that reads metrics at /debug/vars.
+// Metrics are not served when it is empty.
+const metricsTokenEnv = "SKABELON_METRICS_TOKEN"
+
+// webhooksAllowPrivateEnv is the environment variable that lets webhooks post to loopback and private addresses,
+// such as the sample receiver at http://localhost:8080/_cdc.
+const webhooksAllowPrivateEnv = "SKABELON_WEBHOOKS_ALLOW_PRIVATE"
+
+// cdcEnv is the environment variable choosing the sink of change data capture:
+// stdout, file:<path> or a webhook URL, such as http://localhost:8080/_cdc.
+// Capture is off when it is empty, since an unread replication slot keeps the write-ahead log forever.
+const cdcEnv = "SKABELON_CDC"
+
+// startCapture starts change data capture of relations to the sink chosen by cdcEnv.
+// Returns nil if capture is off.
+func startCapture(ctx context.Context, db *pgxpool.Pool, relations ...dbx.Relation) (*cdc.Capture, error) {
+	var sink cdc.Sink
+
+	switch target := os.Getenv(cdcEnv); {
+	case target == "":
+		return nil, nil //nolint:nilnil
+	case target == "stdout":
+		sink = cdc.NewWriterSink(os.Stdout)
+	case strings.HasPrefix(target, "file:"):
+		file, err := cdc.NewFileSink(strings.TrimPrefix(target, "file:"))
+		if err != nil {
+			return nil, err //nolint:wrapcheck
+		}
+
+		sink = file
+	default:
+		sink = cdc.NewWebhookSink(target, &http.Client{Timeout: 10 * time.Second}) //nolint:exhaustruct,mnd
+	}
+
+	capture, err := cdc.New(ctx, db, cdc.Config{
+		Publication: "skabelon_cdc",
+		Slot:        "skabelon_cdc",
+		Relations:   relations,
+		Schema:      "skabelon",
+		Table:       "cdc_positions",
+		Sink:        sink,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not start change data capture: %w", err)
+	}
+
+	return capture, nil
+}
+
 // LoggingMiddleware logs the request using slog.
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -119,6 +368,57 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// TokenMiddleware responds 401 Unauthorized to requests without token as bearer token.
+func TokenMiddleware(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// identityHeader is the request header that carries the identity of the requester.
+const identityHeader = "X-Identity"
+
+// IdentityMiddleware adds the identity of the requester to the request context.
+//
+// TODO: This trusts the client. Replace with proper authentication.
+func IdentityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := r.Header.Get(identityHeader)
+		if identity == "" {
+			identity = "anonymous"
+		}
+
+		next.ServeHTTP(w, r.WithContext(dbx.WithIdentity(r.Context(), identity)))
+	})
+}
+
+// requestIDHeader is the header that carries the id of a request.
+const requestIDHeader = "X-Request-Id"
+
+// RequestIDMiddleware adds the id of the request to the request context, and echoes it in the response.
+// The id is taken from the request, or generated if there is none.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = rand.Text()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		next.ServeHTTP(w, r.WithContext(dbx.WithRequestID(r.Context(), id)))
+	})
+}
+
 func main() {
 	ctx := context.Background()
 
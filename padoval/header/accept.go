@@ -0,0 +1,267 @@
+package header
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidMediaType is returned when a media type is invalid.
+var ErrInvalidMediaType = errors.New("invalid media type")
+
+// wildcard is the wildcard type and subtype in media ranges.
+const wildcard = "*"
+
+// MediaType is a media type with parameters, such as text/csv; delimiter=";".
+// Type, subtype and parameter names are in lower case.
+type MediaType struct {
+	// Type is the top-level type, such as "text"
+	Type string
+	// Subtype is the subtype, such as "csv"
+	Subtype string
+	// Params are the parameters
+	Params map[string]string
+}
+
+// NewMediaType creates a new MediaType without parameters.
+func NewMediaType(typ, subtype string) MediaType {
+	return MediaType{Type: strings.ToLower(typ), Subtype: strings.ToLower(subtype), Params: nil}
+}
+
+// String returns a string representation of the media type, as used in Content-Type.
+// Parameters are sorted by name.
+func (m MediaType) String() string {
+	var b strings.Builder
+
+	b.WriteString(m.Type + "/" + m.Subtype)
+
+	for _, name := range slices.Sorted(maps.Keys(m.Params)) {
+		b.WriteString("; " + name + "=" + quoteWordIfNeeded(m.Params[name]))
+	}
+
+	return b.String()
+}
+
+// Essence returns the type and subtype, without parameters.
+func (m MediaType) Essence() string {
+	return m.Type + "/" + m.Subtype
+}
+
+// ParseMediaType parses a media type as described in RFC 9110 section 8.3.1:
+//
+//	media-type = type "/" subtype parameters
+//	parameters = *( OWS ";" OWS [ parameter ] )
+//	parameter  = parameter-name "=" parameter-value
+func ParseMediaType(value string) (MediaType, error) {
+	parts := splitQuoted(value, ';')
+
+	typ, subtype, ok := strings.Cut(strings.Trim(parts[0], optionalWhitespace), "/")
+	if !ok || !isToken(typ) || !isToken(subtype) {
+		return MediaType{}, fmt.Errorf("%w: %s", ErrInvalidMediaType, value) //nolint:exhaustruct
+	}
+
+	if typ == wildcard && subtype != wildcard {
+		return MediaType{}, fmt.Errorf("%w: %s", ErrInvalidMediaType, value) //nolint:exhaustruct
+	}
+
+	mediaType := NewMediaType(typ, subtype)
+
+	for _, part := range parts[1:] {
+		if strings.Trim(part, optionalWhitespace) == "" {
+			continue
+		}
+
+		name, paramValue, ok := parseNameValue(part)
+		if !ok || !strings.Contains(part, "=") {
+			return MediaType{}, fmt.Errorf("%w: invalid parameter %s", ErrInvalidMediaType, part) //nolint:exhaustruct
+		}
+
+		if mediaType.Params == nil {
+			mediaType.Params = map[string]string{}
+		}
+
+		mediaType.Params[name] = paramValue
+	}
+
+	return mediaType, nil
+}
+
+// MediaRange is a media range in an Accept header, with its quality value.
+type MediaRange struct {
+	MediaType
+
+	// Q is the quality value, between 0 and 1
+	Q float64
+}
+
+// Accept is a parsed Accept header.
+type Accept struct {
+	ranges []MediaRange
+}
+
+// ParseAccept parses the values of one or more Accept headers, as described in RFC 9110 section 12.5.1:
+//
+//	Accept       = #( media-range [ weight ] )
+//	media-range  = ( "*/*" / ( type "/*" ) / ( type "/" subtype ) ) parameters
+//	weight       = OWS ";" OWS "q=" qvalue
+//
+// Malformed media ranges are ignored.
+// If there are no media ranges, any media type is acceptable.
+func ParseAccept(values []string) Accept {
+	accept := Accept{ranges: nil}
+
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			if strings.Trim(element, optionalWhitespace) == "" {
+				continue
+			}
+
+			mediaRange, err := parseMediaRange(element)
+			if err != nil {
+				continue
+			}
+
+			accept.ranges = append(accept.ranges, mediaRange)
+		}
+	}
+
+	return accept
+}
+
+// parseMediaRange parses a media range with an optional weight.
+// Accept extensions after the weight are rare, and are kept as parameters.
+func parseMediaRange(element string) (MediaRange, error) {
+	mediaType, err := ParseMediaType(element)
+	if err != nil {
+		return MediaRange{}, err //nolint:exhaustruct
+	}
+
+	mediaRange := MediaRange{MediaType: mediaType, Q: 1}
+
+	q, ok := mediaType.Params["q"]
+	if !ok {
+		return mediaRange, nil
+	}
+
+	mediaRange.Q, err = strconv.ParseFloat(q, 64)
+	if err != nil || mediaRange.Q < 0 || mediaRange.Q > 1 {
+		return MediaRange{}, fmt.Errorf("%w: invalid weight %s", ErrInvalidMediaType, q) //nolint:exhaustruct
+	}
+
+	delete(mediaRange.Params, "q")
+
+	if len(mediaRange.Params) == 0 {
+		mediaRange.Params = nil
+	}
+
+	return mediaRange, nil
+}
+
+// Ranges returns the media ranges in the order they were sent.
+func (a Accept) Ranges() []MediaRange {
+	return a.ranges
+}
+
+// Negotiate returns the offered media type that is most preferred by the client.
+// Each offer gets the quality value of the most specific media range matching it,
+// and the offer with the highest quality value wins. Ties go to the earliest offer.
+//
+// The parameters of the matching media range are added to the returned media type,
+// so that clients can ask for variants such as text/csv; delimiter=";".
+// Returns false if no offer is acceptable, which should give 406 Not Acceptable.
+func (a Accept) Negotiate(offered []MediaType) (MediaType, bool) {
+	if len(a.ranges) == 0 {
+		if len(offered) == 0 {
+			return MediaType{}, false //nolint:exhaustruct
+		}
+
+		return offered[0], true
+	}
+
+	var (
+		best     MediaType
+		bestQ    float64
+		bestSeen bool
+	)
+
+	for _, offer := range offered {
+		mediaRange, specificity := a.match(offer)
+		if specificity < 0 || mediaRange.Q <= 0 {
+			continue
+		}
+
+		if !bestSeen || mediaRange.Q > bestQ {
+			best = withParams(offer, mediaRange)
+			bestQ = mediaRange.Q
+			bestSeen = true
+		}
+	}
+
+	return best, bestSeen
+}
+
+// match returns the most specific media range matching offer, and its specificity.
+// Specificity is -1 if no media range matches.
+func (a Accept) match(offer MediaType) (MediaRange, int) {
+	bestRange := MediaRange{} //nolint:exhaustruct
+	bestSpecificity := -1
+
+	for _, mediaRange := range a.ranges {
+		specificity := mediaRange.specificity(offer)
+		if specificity > bestSpecificity {
+			bestRange = mediaRange
+			bestSpecificity = specificity
+		}
+	}
+
+	return bestRange, bestSpecificity
+}
+
+// specificity returns how specific the media range matches offer, or -1 if it doesn't match.
+// */* is 0, type/* is 1, type/subtype is 2, and each matching parameter adds one.
+func (m MediaRange) specificity(offer MediaType) int {
+	switch {
+	case m.Type == wildcard:
+		return 0
+	case m.Type != offer.Type:
+		return -1
+	case m.Subtype == wildcard:
+		return 1
+	case m.Subtype != offer.Subtype:
+		return -1
+	}
+
+	specificity := 2 //nolint:mnd
+
+	for name, value := range m.Params {
+		offerValue, ok := offer.Params[name]
+		if !ok {
+			continue
+		}
+
+		if !strings.EqualFold(offerValue, value) {
+			return -1
+		}
+
+		specificity++
+	}
+
+	return specificity
+}
+
+// withParams returns offer with the parameters of a specific media range added.
+// Parameters of the offer take precedence.
+func withParams(offer MediaType, mediaRange MediaRange) MediaType {
+	if mediaRange.Type == wildcard || mediaRange.Subtype == wildcard || len(mediaRange.Params) == 0 {
+		return offer
+	}
+
+	params := maps.Clone(mediaRange.Params)
+	maps.Copy(params, offer.Params)
+	offer.Params = params
+
+	return offer
+}
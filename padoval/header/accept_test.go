@@ -0,0 +1,151 @@
+package header_test
+
+import (
+	"testing"
+
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+func TestParseMediaType(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		mediaType string
+		want      string
+		wantErr   bool
+	}{
+		{
+			name:      "type and subtype",
+			mediaType: "Application/JSON",
+			want:      "application/json",
+		},
+		{
+			name:      "parameters",
+			mediaType: `text/csv ; Delimiter=";" ;charset=utf-8`,
+			want:      `text/csv; charset=utf-8; delimiter=";"`,
+		},
+		{
+			name:      "missing subtype",
+			mediaType: "text",
+			wantErr:   true,
+		},
+		{
+			name:      "wildcard type with subtype",
+			mediaType: "*/json",
+			wantErr:   true,
+		},
+		{
+			name:      "parameter without value",
+			mediaType: "text/csv; header",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := header.ParseMediaType(tt.mediaType)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseMediaType() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("ParseMediaType() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	t.Parallel()
+
+	json := header.NewMediaType("application", "json")
+	csv := header.NewMediaType("text", "csv")
+	ndjson := header.NewMediaType("application", "x-ndjson")
+	offered := []header.MediaType{json, csv, ndjson}
+
+	tests := []struct {
+		name   string
+		accept []string
+		want   string
+		wantOk bool
+	}{
+		{
+			name:   "no accept header gives the first offer",
+			accept: nil,
+			want:   "application/json",
+			wantOk: true,
+		},
+		{
+			name:   "any",
+			accept: []string{"*/*"},
+			want:   "application/json",
+			wantOk: true,
+		},
+		{
+			name:   "exact match",
+			accept: []string{"text/csv"},
+			want:   "text/csv",
+			wantOk: true,
+		},
+		{
+			name:   "highest quality wins",
+			accept: []string{"application/json;q=0.5, text/csv;q=0.9, */*;q=0.1"},
+			want:   "text/csv",
+			wantOk: true,
+		},
+		{
+			name:   "most specific range decides the quality",
+			accept: []string{"application/*;q=0.2, application/x-ndjson, text/*;q=0.5"},
+			want:   "application/x-ndjson",
+			wantOk: true,
+		},
+		{
+			name:   "q=0 excludes a type",
+			accept: []string{"application/json;q=0, */*"},
+			want:   "text/csv",
+			wantOk: true,
+		},
+		{
+			name:   "parameters are passed on",
+			accept: []string{`text/csv; delimiter=";"`},
+			want:   `text/csv; delimiter=";"`,
+			wantOk: true,
+		},
+		{
+			name:   "multiple headers",
+			accept: []string{"text/html", "application/x-ndjson;q=0.8"},
+			want:   "application/x-ndjson",
+			wantOk: true,
+		},
+		{
+			name:   "malformed ranges are ignored",
+			accept: []string{"text/csv;q=2, text, application/json"},
+			want:   "application/json",
+			wantOk: true,
+		},
+		{
+			name:   "nothing acceptable",
+			accept: []string{"text/html, application/xml;q=0.9"},
+			wantOk: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok := header.ParseAccept(tt.accept).Negotiate(offered)
+			if ok != tt.wantOk {
+				t.Fatalf("Negotiate() ok = %v, want %v", ok, tt.wantOk)
+			}
+
+			if ok && got.String() != tt.want {
+				t.Errorf("Negotiate() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
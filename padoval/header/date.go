@@ -0,0 +1,33 @@
+package header
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrInvalidDate is returned when a HTTP-date is invalid.
+var ErrInvalidDate = errors.New("invalid date")
+
+// ParseDate parses a HTTP-date as described in RFC 9110 section 5.6.7.
+// The preferred IMF-fixdate format, as well as the obsolete RFC 850 and asctime formats, are accepted.
+func ParseDate(value string) (time.Time, error) {
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s", ErrInvalidDate, value)
+	}
+
+	return t, nil
+}
+
+// FormatDate formats t as a IMF-fixdate HTTP-date.
+func FormatDate(t time.Time) string {
+	return t.UTC().Format(http.TimeFormat)
+}
+
+// IsModifiedSince returns true if lastModified is later than since.
+// HTTP-dates have a resolution of one second, so lastModified is truncated before comparing.
+func IsModifiedSince(lastModified, since time.Time) bool {
+	return lastModified.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,111 @@
+package header_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+func TestParseDate(t *testing.T) {
+	t.Parallel()
+
+	want := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		date    string
+		wantErr bool
+	}{
+		{
+			name:    "IMF-fixdate",
+			date:    "Sun, 06 Nov 1994 08:49:37 GMT",
+			wantErr: false,
+		},
+		{
+			name:    "obsolete RFC 850 format",
+			date:    "Sunday, 06-Nov-94 08:49:37 GMT",
+			wantErr: false,
+		},
+		{
+			name:    "obsolete asctime format",
+			date:    "Sun Nov  6 08:49:37 1994",
+			wantErr: false,
+		},
+		{
+			name:    "empty",
+			date:    "",
+			wantErr: true,
+		},
+		{
+			name:    "not a date",
+			date:    "yesterday",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := header.ParseDate(tt.date)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseDate() date = %v, error = %v, wantErr %v", tt.date, err, tt.wantErr)
+				return
+			}
+
+			if !tt.wantErr && !got.Equal(want) {
+				t.Errorf("ParseDate() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	t.Parallel()
+
+	date := time.Date(1994, time.November, 6, 9, 49, 37, 0, time.FixedZone("CET", 3600))
+
+	got := header.FormatDate(date)
+	if got != "Sun, 06 Nov 1994 08:49:37 GMT" {
+		t.Errorf("FormatDate() = %v", got)
+	}
+}
+
+func TestIsModifiedSince(t *testing.T) {
+	t.Parallel()
+
+	since := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		lastModified time.Time
+		want         bool
+	}{
+		{
+			name:         "same second",
+			lastModified: since.Add(500 * time.Millisecond),
+			want:         false,
+		},
+		{
+			name:         "before",
+			lastModified: since.Add(-time.Second),
+			want:         false,
+		},
+		{
+			name:         "after",
+			lastModified: since.Add(time.Second),
+			want:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := header.IsModifiedSince(tt.lastModified, since); got != tt.want {
+				t.Errorf("IsModifiedSince() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
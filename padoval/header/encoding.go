@@ -0,0 +1,53 @@
+package header
+
+import (
+	"strconv"
+	"strings"
+)
+
+// AcceptsEncoding returns true if the values of the Accept-Encoding headers explicitly accept coding,
+// as described in RFC 9110 section 12.5.3:
+//
+//	Accept-Encoding = #( codings [ weight ] )
+//	codings         = content-coding / "identity" / "*"
+//
+// Codings with q=0 are not acceptable, and "*" matches codings that are not listed.
+// Malformed elements are ignored.
+func AcceptsEncoding(values []string, coding string) bool {
+	coding = strings.ToLower(coding)
+	wildcardQ := -1.0
+
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			parts := splitQuoted(element, ';')
+
+			name := strings.ToLower(strings.Trim(parts[0], optionalWhitespace))
+			if !isToken(name) {
+				continue
+			}
+
+			q := 1.0
+
+			for _, part := range parts[1:] {
+				paramName, paramValue, ok := parseNameValue(part)
+				if !ok || paramName != "q" {
+					continue
+				}
+
+				parsed, err := strconv.ParseFloat(paramValue, 64)
+				if err == nil && parsed >= 0 && parsed <= 1 {
+					q = parsed
+				}
+			}
+
+			switch name {
+			case coding:
+				return q > 0
+			case wildcard:
+				wildcardQ = q
+			}
+		}
+	}
+
+	return wildcardQ > 0
+}
@@ -0,0 +1,34 @@
+package header_test
+
+import (
+	"testing"
+
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		values []string
+		want   bool
+	}{
+		{name: "no header", values: nil, want: false},
+		{name: "listed", values: []string{"br, GZIP"}, want: true},
+		{name: "listed in second header", values: []string{"br", "gzip;q=0.5"}, want: true},
+		{name: "q=0", values: []string{"gzip;q=0, *"}, want: false},
+		{name: "wildcard", values: []string{"br, *;q=0.1"}, want: true},
+		{name: "not listed", values: []string{"br, deflate"}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := header.AcceptsEncoding(tt.values, "gzip"); got != tt.want {
+				t.Errorf("AcceptsEncoding() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
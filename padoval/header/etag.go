@@ -3,17 +3,12 @@ package header
 import (
 	"errors"
 	"fmt"
-	"regexp"
+	"strings"
 )
 
 // ErrInvalidEtag is returned when an etag is invalid.
 var ErrInvalidEtag = errors.New("invalid etag")
 
-// etagPattern is used to validate etags
-// This is a bit more restricted than what it probably should be.
-// The spec allows "ASCII characters".
-var etagPattern = regexp.MustCompile(`^[a-zA-Z0-9-_]*$`)
-
 // ETag are the individual Etags in a Match header.
 type ETag struct {
 	weak bool
@@ -62,30 +57,58 @@ func (e ETag) MatchStrong(other ETag) bool {
 }
 
 // ParseEtag creates a new ETag from a string.
+// The string must be a single entity-tag as described in RFC 9110 section 8.8.3:
+//
+//	entity-tag = [ weak ] opaque-tag
+//	weak       = %s"W/"
+//	opaque-tag = DQUOTE *etagc DQUOTE
+//	etagc      = %x21 / %x23-7E / obs-text
 func ParseEtag(etag string) (ETag, error) {
 	if etag == "" {
 		return ETag{}, fmt.Errorf("%w: empty etag value", ErrInvalidEtag)
 	}
 
-	if len(etag) < 3 { //nolint:mnd
-		return ETag{}, fmt.Errorf("%w: etag is to short", ErrInvalidEtag)
+	parsed, rest, err := parseEntityTag(etag)
+	if err != nil {
+		return ETag{}, err
 	}
 
-	weak := false
-	if etag[0:2] == "W/" {
-		weak = true
-		etag = etag[2:]
+	if rest != "" {
+		return ETag{}, fmt.Errorf("%w: unexpected characters after closing quote", ErrInvalidEtag)
 	}
 
-	if etag[0] != '"' && etag[len(etag)-1] != '"' {
-		return ETag{}, fmt.Errorf("%w: missing quotes", ErrInvalidEtag)
+	return parsed, nil
+}
+
+// weakPrefix is the prefix of weak entity tags. It is case-sensitive.
+const weakPrefix = "W/"
+
+// parseEntityTag parses the entity-tag at the start of s.
+// Returns the entity tag and the rest of s after the closing quote.
+func parseEntityTag(s string) (ETag, string, error) {
+	weak := strings.HasPrefix(s, weakPrefix)
+	if weak {
+		s = s[len(weakPrefix):]
 	}
 
-	etag = etag[1 : len(etag)-1]
+	if s == "" || s[0] != '"' {
+		return ETag{}, "", fmt.Errorf("%w: missing opening quote", ErrInvalidEtag)
+	}
 
-	if !etagPattern.MatchString(etag) {
-		return ETag{}, fmt.Errorf("%w: unwanted characters", ErrInvalidEtag)
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			return ETag{weak: weak, etag: s[1:i]}, s[i+1:], nil
+		case !isEtagc(c):
+			return ETag{}, "", fmt.Errorf("%w: unwanted character %q", ErrInvalidEtag, c)
+		}
 	}
 
-	return ETag{weak: weak, etag: etag}, nil
+	return ETag{}, "", fmt.Errorf("%w: missing closing quote", ErrInvalidEtag)
+}
+
+// isEtagc returns true if c is allowed in an opaque-tag.
+// That is any visible ASCII character except DQUOTE, and obs-text.
+func isEtagc(c byte) bool {
+	return c == 0x21 || (c >= 0x23 && c <= 0x7E) || c >= 0x80
 }
@@ -31,9 +31,44 @@ func TestParseEtag(t *testing.T) {
 		},
 		{
 			name:    "etag with unwanted characters",
-			etag:    "\"abc-123?\"",
+			etag:    "\"abc 123\"",
 			wantErr: true,
 		},
+		{
+			name:    "missing closing quote",
+			etag:    "\"abc",
+			wantErr: true,
+		},
+		{
+			name:    "missing opening quote",
+			etag:    "abc\"",
+			wantErr: true,
+		},
+		{
+			name:    "characters after closing quote",
+			etag:    "\"abc\"def",
+			wantErr: true,
+		},
+		{
+			name:    "lowercase weak prefix",
+			etag:    "w/\"abc\"",
+			wantErr: true,
+		},
+		{
+			name:    "empty opaque tag",
+			etag:    "\"\"",
+			wantErr: false,
+		},
+		{
+			name:    "etag with ascii punctuation",
+			etag:    "\"abc-123?,/+=:;!#$%&'()*<>@[]^`{|}~\\\"",
+			wantErr: false,
+		},
+		{
+			name:    "etag with obs-text",
+			etag:    "\"bl\xe5b\xe6r\"",
+			wantErr: false,
+		},
 		{
 			name:    "etag with quotes",
 			etag:    "\"abc\"",
@@ -134,3 +169,25 @@ func TestEtagMatch(t *testing.T) {
 		})
 	}
 }
+
+func FuzzParseEtag(f *testing.F) {
+	for _, seed := range []string{`"abc"`, `W/"abc"`, `""`, `"a,b"`, `"abc`, `W/`, "\"\x80\""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		etag, err := header.ParseEtag(value)
+		if err != nil {
+			return
+		}
+
+		if etag.String() != value {
+			t.Errorf("ParseEtag(%q).String() = %q", value, etag.String())
+		}
+
+		again, err := header.ParseEtag(etag.String())
+		if err != nil || again != etag {
+			t.Errorf("ParseEtag(%q) did not round-trip: %v, %v", etag.String(), again, err)
+		}
+	})
+}
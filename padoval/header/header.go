@@ -9,4 +9,30 @@ const (
 	NameIfNoneMatch = "If-None-Match"
 	// NameIfMatch is a variable for the "If-Match" header name.
 	NameIfMatch = "If-Match"
+	// NameLastModified is a variable for the "Last-Modified" header name.
+	NameLastModified = "Last-Modified"
+	// NameIfModifiedSince is a variable for the "If-Modified-Since" header name.
+	NameIfModifiedSince = "If-Modified-Since"
+	// NameIfUnmodifiedSince is a variable for the "If-Unmodified-Since" header name.
+	NameIfUnmodifiedSince = "If-Unmodified-Since"
+	// NameIfRange is a variable for the "If-Range" header name.
+	NameIfRange = "If-Range"
+	// NameRange is a variable for the "Range" header name.
+	NameRange = "Range"
+	// NamePrefer is a variable for the "Prefer" header name.
+	NamePrefer = "Prefer"
+	// NamePreferenceApplied is a variable for the "Preference-Applied" header name.
+	NamePreferenceApplied = "Preference-Applied"
+	// NameAccept is a variable for the "Accept" header name.
+	NameAccept = "Accept"
+	// NameContentType is a variable for the "Content-Type" header name.
+	NameContentType = "Content-Type"
+	// NameVary is a variable for the "Vary" header name.
+	NameVary = "Vary"
+	// NameAcceptEncoding is a variable for the "Accept-Encoding" header name.
+	NameAcceptEncoding = "Accept-Encoding"
+	// NameContentEncoding is a variable for the "Content-Encoding" header name.
+	NameContentEncoding = "Content-Encoding"
+	// NameAllow is a variable for the "Allow" header name.
+	NameAllow = "Allow"
 )
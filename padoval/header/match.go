@@ -2,6 +2,7 @@ package header
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 )
 
@@ -40,6 +41,11 @@ func (m Match) MatchWeak(etag ETag) bool {
 	return false
 }
 
+// IsAny returns true if the Match is the wildcard "*".
+func (m Match) IsAny() bool {
+	return len(m.values) == 0
+}
+
 // MatchStrong returns true if the ETag is matched using strong comparison.
 func (m Match) MatchStrong(etag ETag) bool {
 	if len(m.values) == 0 {
@@ -58,6 +64,9 @@ func (m Match) MatchStrong(etag ETag) bool {
 // matchAny is the wildcard value.
 const matchAny = "*"
 
+// optionalWhitespace are the characters allowed as OWS.
+const optionalWhitespace = " \t"
+
 // ErrEmptyHeader is returned when a header is empty.
 var ErrEmptyHeader = errors.New("empty value")
 
@@ -76,7 +85,15 @@ func (m Match) String() string {
 }
 
 // ParseMatch creates a new Match from a string.
+// The string must be "*" or a comma separated list of entity tags, as described in RFC 9110 section 13.1.1:
+//
+//	If-Match = "*" / #entity-tag
+//
+// Commas are allowed inside entity tags, whitespace is allowed around list elements,
+// and empty list elements are ignored.
 func ParseMatch(value string) (Match, error) {
+	value = strings.Trim(value, optionalWhitespace)
+
 	if len(value) == 0 {
 		return Match{}, errors.Join(ErrInvalidMatch, ErrEmptyHeader)
 	}
@@ -86,18 +103,34 @@ func ParseMatch(value string) (Match, error) {
 		return Match{}, nil
 	}
 
-	etags := strings.Split(value, ",")
+	etagValues := []ETag{}
+
+	for rest := value; rest != ""; {
+		rest = strings.TrimLeft(rest, optionalWhitespace+",")
+		if rest == "" {
+			break
+		}
 
-	etagValues := make([]ETag, 0, len(etags))
-	for _, etagStr := range etags {
-		etagStr = strings.TrimSpace(etagStr)
+		if strings.HasPrefix(rest, matchAny) {
+			return Match{}, fmt.Errorf("%w: %s cannot be combined with entity tags", ErrInvalidMatch, matchAny)
+		}
 
-		etag, err := ParseEtag(etagStr)
+		etag, after, err := parseEntityTag(rest)
 		if err != nil {
 			return Match{}, errors.Join(ErrInvalidMatch, err)
 		}
 
 		etagValues = append(etagValues, etag)
+
+		rest = strings.TrimLeft(after, optionalWhitespace)
+		if rest != "" && rest[0] != ',' {
+			return Match{}, fmt.Errorf("%w: expected comma after %s", ErrInvalidMatch, etag)
+		}
+	}
+
+	if len(etagValues) == 0 {
+		// An empty Match would be interpreted as "*"
+		return Match{}, errors.Join(ErrInvalidMatch, ErrEmptyHeader)
 	}
 
 	return Match{values: etagValues}, nil
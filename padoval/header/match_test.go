@@ -26,7 +26,7 @@ func TestParseMatch(t *testing.T) {
 		},
 		{
 			name:    "match with unwanted characters",
-			match:   "\"abc-123?\"",
+			match:   "\"abc 123\"",
 			wantErr: true,
 		},
 		{
@@ -34,6 +34,26 @@ func TestParseMatch(t *testing.T) {
 			match:   "\"abc\"",
 			wantErr: false,
 		},
+		{
+			name:    "missing closing quote",
+			match:   "\"abc",
+			wantErr: true,
+		},
+		{
+			name:    "wildcard mixed with entity tags",
+			match:   "\"abc\", *",
+			wantErr: true,
+		},
+		{
+			name:    "only commas",
+			match:   " , ,",
+			wantErr: true,
+		},
+		{
+			name:    "missing comma",
+			match:   "\"abc\" \"def\"",
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -48,3 +68,66 @@ func TestParseMatch(t *testing.T) {
 		})
 	}
 }
+
+func TestParseMatchList(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		match string
+		want  string
+	}{
+		{
+			name:  "wildcard",
+			match: " * ",
+			want:  "*",
+		},
+		{
+			name:  "commas inside entity tags",
+			match: "\"a,b\",W/\"c,d\"",
+			want:  "\"a,b\", W/\"c,d\"",
+		},
+		{
+			name:  "whitespace and empty list elements",
+			match: ", \t\"xyzzy\" ,, W/\"r2d2xxxx\",\t",
+			want:  "\"xyzzy\", W/\"r2d2xxxx\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := header.ParseMatch(tt.match)
+			if err != nil {
+				t.Fatalf("ParseMatch() error = %v", err)
+			}
+
+			if got.String() != tt.want {
+				t.Errorf("ParseMatch() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func FuzzParseMatch(f *testing.F) {
+	for _, seed := range []string{`*`, `"abc"`, `"a,b", W/"c"`, `, ,"a",,`, `"a" "b"`, `"a", *`} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		match, err := header.ParseMatch(value)
+		if err != nil {
+			return
+		}
+
+		again, err := header.ParseMatch(match.String())
+		if err != nil {
+			t.Fatalf("ParseMatch(%q) error = %v", match.String(), err)
+		}
+
+		if again.String() != match.String() {
+			t.Errorf("ParseMatch(%q) did not round-trip: %q", match.String(), again.String())
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package header
+
+import (
+	"net/http"
+	"time"
+)
+
+// Decision is the outcome of evaluating the preconditions of a request.
+type Decision int
+
+const (
+	// DecisionProceed means that the method should be performed, including any Range request.
+	DecisionProceed Decision = iota
+	// DecisionIgnoreRange means that the method should be performed, but the Range header ignored.
+	// The full representation is sent with 200 OK, because If-Range did not match.
+	DecisionIgnoreRange
+	// DecisionNotModified means that the server should respond with 304 Not Modified.
+	DecisionNotModified
+	// DecisionPreconditionFailed means that the server should respond with 412 Precondition Failed.
+	DecisionPreconditionFailed
+)
+
+// Status returns the HTTP status code for decisions that end the request,
+// and 0 for decisions where the method should be performed.
+func (d Decision) Status() int {
+	switch d {
+	case DecisionNotModified:
+		return http.StatusNotModified
+	case DecisionPreconditionFailed:
+		return http.StatusPreconditionFailed
+	case DecisionProceed, DecisionIgnoreRange:
+		return 0
+	}
+
+	return 0
+}
+
+// EvaluatePreconditions evaluates the conditional headers of a request
+// in the order described in RFC 9110 section 13.2.2.
+//
+// etag and lastModified are the current validators of the target resource,
+// and are nil if the resource doesn't have them.
+// exists is false if the target resource doesn't have a current representation.
+//
+//nolint:cyclop
+func EvaluatePreconditions(req *Request, method string, etag *ETag, lastModified *time.Time, exists bool) Decision {
+	isGetOrHead := method == http.MethodGet || method == http.MethodHead
+
+	// Step 1 and 2
+	switch {
+	case req.IfMatch != nil:
+		if !evaluateIfMatch(*req.IfMatch, etag, exists) {
+			return DecisionPreconditionFailed
+		}
+	case req.IfUnmodifiedSince != nil && lastModified != nil:
+		if IsModifiedSince(*lastModified, *req.IfUnmodifiedSince) {
+			return DecisionPreconditionFailed
+		}
+	}
+
+	// Step 3 and 4
+	switch {
+	case req.IfNoneMatch != nil:
+		if !evaluateIfNoneMatch(*req.IfNoneMatch, etag, exists) {
+			if isGetOrHead {
+				return DecisionNotModified
+			}
+
+			return DecisionPreconditionFailed
+		}
+	case req.IfModifiedSince != nil && lastModified != nil && isGetOrHead:
+		if !IsModifiedSince(*lastModified, *req.IfModifiedSince) {
+			return DecisionNotModified
+		}
+	}
+
+	// Step 5
+	if method == http.MethodGet && req.Range != nil && req.IfRange != nil {
+		if !evaluateIfRange(*req.IfRange, etag, lastModified) {
+			return DecisionIgnoreRange
+		}
+	}
+
+	// Step 6
+	return DecisionProceed
+}
+
+// evaluateIfMatch evaluates If-Match as described in RFC 9110 section 13.1.1.
+// "*" is true if the resource exists, and a list of entity tags uses strong comparison.
+func evaluateIfMatch(match Match, etag *ETag, exists bool) bool {
+	if !exists {
+		return false
+	}
+
+	if match.IsAny() {
+		return true
+	}
+
+	return etag != nil && match.MatchStrong(*etag)
+}
+
+// evaluateIfNoneMatch evaluates If-None-Match as described in RFC 9110 section 13.1.2.
+// "*" is false if the resource exists, and a list of entity tags uses weak comparison.
+func evaluateIfNoneMatch(match Match, etag *ETag, exists bool) bool {
+	if !exists {
+		return true
+	}
+
+	if match.IsAny() {
+		return false
+	}
+
+	return etag == nil || !match.MatchWeak(*etag)
+}
+
+// evaluateIfRange evaluates If-Range as described in RFC 9110 section 13.1.5.
+// An entity tag must match strongly, and a date must match the last modification date exactly.
+func evaluateIfRange(ifRange IfRange, etag *ETag, lastModified *time.Time) bool {
+	switch {
+	case ifRange.ETag != nil:
+		return etag != nil && ifRange.ETag.MatchStrong(*etag)
+	case ifRange.Date != nil:
+		return lastModified != nil && lastModified.Truncate(time.Second).Equal(*ifRange.Date)
+	}
+
+	return false
+}
@@ -0,0 +1,271 @@
+package header_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+func TestEvaluatePreconditions(t *testing.T) {
+	t.Parallel()
+
+	// Entity tags and dates are taken from the examples in RFC 9110 section 13.1.
+	xyzzy := header.NewETag(false, "xyzzy")
+	weakXyzzy := header.NewETag(true, "xyzzy")
+	lastModified := time.Date(1994, time.October, 29, 19, 43, 31, 0, time.UTC)
+
+	const (
+		lastModifiedDate = "Sat, 29 Oct 1994 19:43:31 GMT"
+		earlierDate      = "Sat, 29 Oct 1994 19:43:30 GMT"
+		laterDate        = "Sat, 29 Oct 1994 19:43:32 GMT"
+		otherTags        = `"r2d2xxxx", "c3piozzzz"`
+	)
+
+	tests := []struct {
+		name         string
+		method       string
+		headers      map[string]string
+		etag         *header.ETag
+		lastModified *time.Time
+		exists       bool
+		want         header.Decision
+	}{
+		{
+			name:   "no preconditions",
+			method: http.MethodPut,
+			exists: true,
+			want:   header.DecisionProceed,
+		},
+		{
+			name:    "If-Match matches one of a list",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-Match": `"xyzzy", ` + otherTags},
+			etag:    &xyzzy,
+			exists:  true,
+			want:    header.DecisionProceed,
+		},
+		{
+			name:    "If-Match does not match",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-Match": otherTags},
+			etag:    &xyzzy,
+			exists:  true,
+			want:    header.DecisionPreconditionFailed,
+		},
+		{
+			name:    "If-Match uses strong comparison",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-Match": `W/"xyzzy"`},
+			etag:    &weakXyzzy,
+			exists:  true,
+			want:    header.DecisionPreconditionFailed,
+		},
+		{
+			name:    "If-Match * on existing resource",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-Match": "*"},
+			etag:    &xyzzy,
+			exists:  true,
+			want:    header.DecisionProceed,
+		},
+		{
+			name:    "If-Match * on missing resource",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-Match": "*"},
+			exists:  false,
+			want:    header.DecisionPreconditionFailed,
+		},
+		{
+			name:         "If-Match takes precedence over If-Unmodified-Since",
+			method:       http.MethodDelete,
+			headers:      map[string]string{"If-Match": `"xyzzy"`, "If-Unmodified-Since": earlierDate},
+			etag:         &xyzzy,
+			lastModified: &lastModified,
+			exists:       true,
+			want:         header.DecisionProceed,
+		},
+		{
+			name:         "If-Unmodified-Since unmodified",
+			method:       http.MethodDelete,
+			headers:      map[string]string{"If-Unmodified-Since": lastModifiedDate},
+			etag:         &xyzzy,
+			lastModified: &lastModified,
+			exists:       true,
+			want:         header.DecisionProceed,
+		},
+		{
+			name:         "If-Unmodified-Since modified",
+			method:       http.MethodDelete,
+			headers:      map[string]string{"If-Unmodified-Since": earlierDate},
+			etag:         &xyzzy,
+			lastModified: &lastModified,
+			exists:       true,
+			want:         header.DecisionPreconditionFailed,
+		},
+		{
+			name:    "If-Unmodified-Since is ignored without a modification date",
+			method:  http.MethodDelete,
+			headers: map[string]string{"If-Unmodified-Since": earlierDate},
+			etag:    &xyzzy,
+			exists:  true,
+			want:    header.DecisionProceed,
+		},
+		{
+			name:    "If-None-Match uses weak comparison on GET",
+			method:  http.MethodGet,
+			headers: map[string]string{"If-None-Match": `W/"xyzzy", W/"r2d2xxxx", W/"c3piozzzz"`},
+			etag:    &xyzzy,
+			exists:  true,
+			want:    header.DecisionNotModified,
+		},
+		{
+			name:    "If-None-Match does not match on GET",
+			method:  http.MethodGet,
+			headers: map[string]string{"If-None-Match": otherTags},
+			etag:    &xyzzy,
+			exists:  true,
+			want:    header.DecisionProceed,
+		},
+		{
+			name:    "If-None-Match matches on HEAD",
+			method:  http.MethodHead,
+			headers: map[string]string{"If-None-Match": `"xyzzy"`},
+			etag:    &xyzzy,
+			exists:  true,
+			want:    header.DecisionNotModified,
+		},
+		{
+			name:    "If-None-Match matches on PUT",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-None-Match": `"xyzzy"`},
+			etag:    &xyzzy,
+			exists:  true,
+			want:    header.DecisionPreconditionFailed,
+		},
+		{
+			name:    "If-None-Match * prevents overwriting an existing resource",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-None-Match": "*"},
+			etag:    &xyzzy,
+			exists:  true,
+			want:    header.DecisionPreconditionFailed,
+		},
+		{
+			name:    "If-None-Match * allows creating a missing resource",
+			method:  http.MethodPut,
+			headers: map[string]string{"If-None-Match": "*"},
+			exists:  false,
+			want:    header.DecisionProceed,
+		},
+		{
+			name:         "If-None-Match takes precedence over If-Modified-Since",
+			method:       http.MethodGet,
+			headers:      map[string]string{"If-None-Match": otherTags, "If-Modified-Since": laterDate},
+			etag:         &xyzzy,
+			lastModified: &lastModified,
+			exists:       true,
+			want:         header.DecisionProceed,
+		},
+		{
+			name:         "If-Modified-Since not modified",
+			method:       http.MethodGet,
+			headers:      map[string]string{"If-Modified-Since": lastModifiedDate},
+			etag:         &xyzzy,
+			lastModified: &lastModified,
+			exists:       true,
+			want:         header.DecisionNotModified,
+		},
+		{
+			name:         "If-Modified-Since modified",
+			method:       http.MethodGet,
+			headers:      map[string]string{"If-Modified-Since": earlierDate},
+			etag:         &xyzzy,
+			lastModified: &lastModified,
+			exists:       true,
+			want:         header.DecisionProceed,
+		},
+		{
+			name:         "If-Modified-Since is ignored for other methods than GET and HEAD",
+			method:       http.MethodPatch,
+			headers:      map[string]string{"If-Modified-Since": lastModifiedDate},
+			etag:         &xyzzy,
+			lastModified: &lastModified,
+			exists:       true,
+			want:         header.DecisionProceed,
+		},
+		{
+			name:         "If-Modified-Since with invalid date is ignored",
+			method:       http.MethodGet,
+			headers:      map[string]string{"If-Modified-Since": "yesterday"},
+			etag:         &xyzzy,
+			lastModified: &lastModified,
+			exists:       true,
+			want:         header.DecisionProceed,
+		},
+		{
+			name:    "If-Range with matching entity tag",
+			method:  http.MethodGet,
+			headers: map[string]string{"Range": "bytes=0-99", "If-Range": `"xyzzy"`},
+			etag:    &xyzzy,
+			exists:  true,
+			want:    header.DecisionProceed,
+		},
+		{
+			name:    "If-Range with weak entity tag never matches",
+			method:  http.MethodGet,
+			headers: map[string]string{"Range": "bytes=0-99", "If-Range": `W/"xyzzy"`},
+			etag:    &weakXyzzy,
+			exists:  true,
+			want:    header.DecisionIgnoreRange,
+		},
+		{
+			name:         "If-Range with matching date",
+			method:       http.MethodGet,
+			headers:      map[string]string{"Range": "bytes=0-99", "If-Range": lastModifiedDate},
+			etag:         &xyzzy,
+			lastModified: &lastModified,
+			exists:       true,
+			want:         header.DecisionProceed,
+		},
+		{
+			name:         "If-Range with other date",
+			method:       http.MethodGet,
+			headers:      map[string]string{"Range": "bytes=0-99", "If-Range": laterDate},
+			etag:         &xyzzy,
+			lastModified: &lastModified,
+			exists:       true,
+			want:         header.DecisionIgnoreRange,
+		},
+		{
+			name:    "If-Range without Range is ignored",
+			method:  http.MethodGet,
+			headers: map[string]string{"If-Range": `"r2d2xxxx"`},
+			etag:    &xyzzy,
+			exists:  true,
+			want:    header.DecisionProceed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			httpHeader := http.Header{}
+			for name, value := range tt.headers {
+				httpHeader.Set(name, value)
+			}
+
+			req, err := header.ParseRequest(httpHeader)
+			if err != nil {
+				t.Fatalf("ParseRequest() error = %v", err)
+			}
+
+			got := header.EvaluatePreconditions(req, tt.method, tt.etag, tt.lastModified, tt.exists)
+			if got != tt.want {
+				t.Errorf("EvaluatePreconditions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package header
+
+import (
+	"strings"
+)
+
+// Preferences and values as described in RFC 7240 and used by postgREST.
+const (
+	// PreferReturn asks for the content of the response to successful writes.
+	PreferReturn = "return"
+	// ReturnMinimal asks for a minimal response, without content.
+	ReturnMinimal = "minimal"
+	// ReturnHeadersOnly asks for the headers of the response, but no content.
+	ReturnHeadersOnly = "headers-only"
+	// ReturnRepresentation asks for the representation of the resource.
+	ReturnRepresentation = "representation"
+
+	// PreferHandling asks for strict or lenient handling of invalid or unknown parts of a request.
+	PreferHandling = "handling"
+	// HandlingStrict asks the server to reject anything it doesn't understand.
+	HandlingStrict = "strict"
+	// HandlingLenient asks the server to ignore anything it doesn't understand.
+	HandlingLenient = "lenient"
+
+	// PreferRespondAsync asks the server to process the request asynchronously.
+	PreferRespondAsync = "respond-async"
+
+	// PreferWait is the number of seconds the client is willing to wait for a synchronous response.
+	PreferWait = "wait"
+
+	// PreferTx asks for the transaction of the request to be committed or rolled back.
+	PreferTx = "tx"
+	// TxCommit asks for the transaction to be committed. This is the default.
+	TxCommit = "commit"
+	// TxRollback asks for the transaction to be rolled back, making the request a dry-run.
+	TxRollback = "rollback"
+)
+
+// Preference is a single preference in a Prefer header.
+type Preference struct {
+	// Name is the preference token, in lower case
+	Name string
+	// Value is the value of the preference, if any
+	Value string
+	// Params are the parameters of the preference, with names in lower case
+	Params map[string]string
+}
+
+// String returns a string representation of the preference, as used in Preference-Applied.
+// Parameters are not included.
+func (p Preference) String() string {
+	if p.Value == "" {
+		return p.Name
+	}
+
+	return p.Name + "=" + quoteWordIfNeeded(p.Value)
+}
+
+// Prefer is a parsed Prefer header.
+// Preferences are kept in the order they were sent.
+type Prefer struct {
+	preferences []Preference
+}
+
+// ParsePrefer parses the values of one or more Prefer headers, as described in RFC 7240 section 2:
+//
+//	Prefer     = 1#preference
+//	preference = token [ BWS "=" BWS word ] *( OWS ";" [ OWS parameter ] )
+//	parameter  = token [ BWS "=" BWS word ]
+//
+// Preferences are optional, so malformed preferences are ignored instead of failing the request.
+// If a preference is given more than once, only the first is considered.
+func ParsePrefer(values []string) Prefer {
+	prefer := Prefer{preferences: nil}
+
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			pref, ok := parsePreference(element)
+			if !ok {
+				continue
+			}
+
+			if _, seen := prefer.Get(pref.Name); !seen {
+				prefer.preferences = append(prefer.preferences, pref)
+			}
+		}
+	}
+
+	return prefer
+}
+
+// parsePreference parses a single preference.
+func parsePreference(element string) (Preference, bool) {
+	parts := splitQuoted(element, ';')
+
+	name, value, ok := parseNameValue(parts[0])
+	if !ok {
+		return Preference{}, false //nolint:exhaustruct
+	}
+
+	pref := Preference{Name: name, Value: value, Params: nil}
+
+	for _, part := range parts[1:] {
+		paramName, paramValue, ok := parseNameValue(part)
+		if !ok {
+			continue
+		}
+
+		if pref.Params == nil {
+			pref.Params = map[string]string{}
+		}
+
+		pref.Params[paramName] = paramValue
+	}
+
+	return pref, true
+}
+
+// parseNameValue parses token [ BWS "=" BWS word ].
+func parseNameValue(s string) (string, string, bool) {
+	name, value, _ := strings.Cut(s, "=")
+
+	name = strings.ToLower(strings.Trim(name, optionalWhitespace))
+	if !isToken(name) {
+		return "", "", false
+	}
+
+	value = strings.Trim(value, optionalWhitespace)
+	if strings.HasPrefix(value, `"`) {
+		unquoted, ok := unquote(value)
+		if !ok {
+			return "", "", false
+		}
+
+		return name, unquoted, true
+	}
+
+	if value != "" && !isToken(value) {
+		return "", "", false
+	}
+
+	return name, value, true
+}
+
+// Get returns the preference with the given name.
+func (p Prefer) Get(name string) (Preference, bool) {
+	name = strings.ToLower(name)
+
+	for _, pref := range p.preferences {
+		if pref.Name == name {
+			return pref, true
+		}
+	}
+
+	return Preference{}, false //nolint:exhaustruct
+}
+
+// Value returns the value of the preference with the given name,
+// or an empty string if the preference isn't present.
+func (p Prefer) Value(name string) string {
+	pref, _ := p.Get(name)
+
+	return pref.Value
+}
+
+// Has returns true if the preference with the given name is present.
+func (p Prefer) Has(name string) bool {
+	_, ok := p.Get(name)
+
+	return ok
+}
+
+// Preferences returns all preferences in the order they were sent.
+func (p Prefer) Preferences() []Preference {
+	return p.preferences
+}
+
+// FormatPreferenceApplied returns the value of a Preference-Applied header for the applied preferences.
+func FormatPreferenceApplied(applied ...Preference) string {
+	values := make([]string, len(applied))
+	for i, pref := range applied {
+		values[i] = pref.String()
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// splitQuoted splits s on sep, except inside quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var (
+		parts  []string
+		quoted bool
+		start  int
+	)
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// unquote returns the content of a quoted-string, as described in RFC 9110 section 5.6.4.
+func unquote(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' { //nolint:mnd
+		return "", false
+	}
+
+	var b strings.Builder
+
+	for i := 1; i < len(s)-1; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+			if i == len(s)-1 {
+				return "", false
+			}
+		case '"':
+			return "", false
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String(), true
+}
+
+// quoteWordIfNeeded returns s as a token if possible, or as a quoted-string.
+func quoteWordIfNeeded(s string) string {
+	if isToken(s) {
+		return s
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// isToken returns true if s is a token, as described in RFC 9110 section 5.6.2.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := range len(s) {
+		if !isTchar(s[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isTchar returns true if c is allowed in a token.
+func isTchar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	default:
+		return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+	}
+}
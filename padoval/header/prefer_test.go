@@ -0,0 +1,96 @@
+package header_test
+
+import (
+	"testing"
+
+	"github.com/krilor/skabelon/padoval/header"
+)
+
+func TestParsePrefer(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		values []string
+		want   string
+	}{
+		{
+			name:   "empty",
+			values: nil,
+			want:   "",
+		},
+		{
+			name:   "single preference",
+			values: []string{"return=minimal"},
+			want:   "return=minimal",
+		},
+		{
+			name:   "list of preferences",
+			values: []string{"respond-async, wait=100"},
+			want:   "respond-async, wait=100",
+		},
+		{
+			name:   "multiple headers",
+			values: []string{"return=minimal", "handling=lenient"},
+			want:   "return=minimal, handling=lenient",
+		},
+		{
+			name:   "names are case-insensitive and whitespace is allowed",
+			values: []string{" Return = representation ; foo=bar , TX=rollback"},
+			want:   "return=representation, tx=rollback",
+		},
+		{
+			name:   "only the first of repeated preferences is considered",
+			values: []string{"return=minimal, return=representation"},
+			want:   "return=minimal",
+		},
+		{
+			name:   "quoted values",
+			values: []string{`foo="bar, baz;qux", wait=10`},
+			want:   `foo="bar, baz;qux", wait=10`,
+		},
+		{
+			name:   "malformed preferences are ignored",
+			values: []string{`=minimal, return=mini mal, foo="unterminated, wait=5`},
+			want:   "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := header.FormatPreferenceApplied(header.ParsePrefer(tt.values).Preferences()...)
+			if got != tt.want {
+				t.Errorf("ParsePrefer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreferParams(t *testing.T) {
+	t.Parallel()
+
+	prefer := header.ParsePrefer([]string{`return=representation; include="a b"; Omit`})
+
+	pref, ok := prefer.Get("RETURN")
+	if !ok {
+		t.Fatal("Get() preference not found")
+	}
+
+	if pref.Value != header.ReturnRepresentation {
+		t.Errorf("Get() value = %v, want %v", pref.Value, header.ReturnRepresentation)
+	}
+
+	if pref.Params["include"] != "a b" {
+		t.Errorf("Get() param include = %v, want %v", pref.Params["include"], "a b")
+	}
+
+	if _, ok := pref.Params["omit"]; !ok {
+		t.Errorf("Get() params = %v, want omit", pref.Params)
+	}
+
+	if prefer.Has(header.PreferRespondAsync) {
+		t.Errorf("Has() = true, want false")
+	}
+}
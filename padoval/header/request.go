@@ -3,6 +3,7 @@ package header
 import (
 	"fmt"
 	"net/http"
+	"time"
 )
 
 // Request is a parsed HTTP request header.
@@ -12,6 +13,42 @@ type Request struct {
 
 	// IfMatch is the If-Match header
 	IfMatch *Match
+
+	// IfModifiedSince is the If-Modified-Since header
+	IfModifiedSince *time.Time
+
+	// IfUnmodifiedSince is the If-Unmodified-Since header
+	IfUnmodifiedSince *time.Time
+
+	// IfRange is the If-Range header
+	IfRange *IfRange
+
+	// Range is the unparsed Range header
+	Range *string
+
+	// Prefer are the Prefer headers
+	Prefer Prefer
+
+	// Accept are the Accept headers
+	Accept Accept
+}
+
+// IfRange is the If-Range header. It holds either an entity tag or a date.
+// An IfRange with neither is invalid, and never matches.
+type IfRange struct {
+	// ETag is the entity tag, if the header is an entity tag
+	ETag *ETag
+
+	// Date is the date, if the header is a HTTP-date
+	Date *time.Time
+}
+
+// Conditional returns true if the request has any conditional headers.
+// Range is not conditional, and If-Range is only conditional together with Range.
+func (r *Request) Conditional() bool {
+	return r.IfMatch != nil || r.IfNoneMatch != nil ||
+		r.IfModifiedSince != nil || r.IfUnmodifiedSince != nil ||
+		(r.IfRange != nil && r.Range != nil)
 }
 
 // ParseRequest takes a http.Header and returns a parsed Header.
@@ -50,5 +87,50 @@ func ParseRequest(httpHeader http.Header) (*Request, error) {
 		}
 	}
 
+	// Invalid dates are ignored, as required by RFC 9110 section 13.1.3 and 13.1.4.
+	reqHeaders.IfModifiedSince = parseDateHeader(httpHeader, NameIfModifiedSince)
+	reqHeaders.IfUnmodifiedSince = parseDateHeader(httpHeader, NameIfUnmodifiedSince)
+
+	if rangeValue := httpHeader.Get(NameRange); rangeValue != "" {
+		reqHeaders.Range = &rangeValue
+	}
+
+	if ifRange := httpHeader.Get(NameIfRange); ifRange != "" {
+		reqHeaders.IfRange = parseIfRange(ifRange)
+	}
+
+	reqHeaders.Prefer = ParsePrefer(httpHeader.Values(NamePrefer))
+	reqHeaders.Accept = ParseAccept(httpHeader.Values(NameAccept))
+
 	return &reqHeaders, nil
 }
+
+// parseIfRange parses the If-Range header.
+// An invalid value gives an empty IfRange, so that the Range header is ignored.
+func parseIfRange(value string) *IfRange {
+	ifRange := IfRange{ETag: nil, Date: nil}
+
+	if etag, err := ParseEtag(value); err == nil {
+		ifRange.ETag = &etag
+	} else if date, err := ParseDate(value); err == nil {
+		ifRange.Date = &date
+	}
+
+	return &ifRange
+}
+
+// parseDateHeader returns the date in the named header.
+// Returns nil if the header is missing, repeated or invalid.
+func parseDateHeader(httpHeader http.Header, name string) *time.Time {
+	values := httpHeader.Values(name)
+	if len(values) != 1 {
+		return nil
+	}
+
+	date, err := ParseDate(values[0])
+	if err != nil {
+		return nil
+	}
+
+	return &date
+}